@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	"errors"
 	"fmt"
@@ -11,58 +12,90 @@ import (
 	"os/signal"
 	"path/filepath"
 	"runtime"
-	"strings"
 	"syscall"
+	"time"
 
+	"github.com/nichol20/http-server/internal/compression"
+	"github.com/nichol20/http-server/internal/fileserver"
 	"github.com/nichol20/http-server/internal/header"
 	"github.com/nichol20/http-server/internal/request"
 	"github.com/nichol20/http-server/internal/response"
+	"github.com/nichol20/http-server/internal/router"
 	"github.com/nichol20/http-server/internal/server"
 )
 
 const port = 42069
+const shutdownTimeout = 10 * time.Second
 
 func main() {
-	server, err := server.Serve(port, func(w *response.Writer, req *request.Request) {
-		rt := req.RequestLine.RequestTarget
-		method := req.RequestLine.Method
-		if method != "GET" {
-			serveHTML(w, 200)
-			return
-		}
-
-		switch {
-		case rt == "/bad-request":
-			serveHTML(w, 400)
-			return
-		case rt == "/server-error":
-			serveHTML(w, 500)
-			return
-		case strings.HasPrefix(rt, "/httpbin/"):
-			httpbinPath := strings.TrimPrefix(rt, "/httpbin/")
-			serveChunkedData(w, httpbinPath)
-			return
-		case rt == "/video":
-			serveVideo(w)
-			return
-		default:
-			serveHTML(w, 200)
-			return
-		}
+	r := router.New()
+	r.HandleFunc("GET /bad-request", func(w *response.Writer, req *request.Request) {
+		serveHTML(w, 400)
 	})
+	r.HandleFunc("GET /server-error", func(w *response.Writer, req *request.Request) {
+		serveHTML(w, 500)
+	})
+	r.HandleFunc("GET /httpbin/{path...}", func(w *response.Writer, req *request.Request) {
+		serveChunkedData(w, req.PathValue("path"))
+	})
+	r.Handle("GET /assets/{path...}", router.StripPrefix("/assets", fileserver.FileServer(assetsDir())))
+	r.HandleFunc("GET /video", func(w *response.Writer, req *request.Request) {
+		w.Redirect("/assets/video.mp4", response.StatusMovedPermanently)
+	})
+	r.HandleFunc("/{path...}", func(w *response.Writer, req *request.Request) {
+		serveHTML(w, 200)
+	})
+
+	opts := []server.Option{server.WithMiddleware(logRequests, compression.Middleware())}
+	// HTTP/2 is negotiated over TLS, H2C=1 also serves it in cleartext
+	if os.Getenv("H2C") == "1" {
+		opts = append(opts, server.WithH2C())
+	}
+	// TLS_CERT_FILE and TLS_KEY_FILE switch to https, the files are reloaded on SIGHUP
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	var srv *server.Server
+	var err error
+	if certFile != "" || keyFile != "" {
+		srv, err = server.ServeTLS(port, r, certFile, keyFile, opts...)
+	} else {
+		srv, err = server.Serve(port, r, opts...)
+	}
 
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
-	defer server.Close()
 	log.Println("Server started on port", port)
+	srv.RegisterOnShutdown(func() {
+		log.Println("Shutting down, waiting for in-flight requests...")
+	})
 
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := <-sigChan; sig == syscall.SIGHUP; sig = <-sigChan {
+		if err := srv.ReloadCertificates(); err != nil {
+			log.Printf("Error reloading certificates: %v", err)
+			continue
+		}
+		log.Println("Certificates reloaded")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down server: %v", err)
+		return
+	}
 	log.Println("Server gracefully stopped")
 }
 
+func logRequests(next server.Handler) server.Handler {
+	return server.HandlerFunc(func(w *response.Writer, req *request.Request) {
+		start := time.Now()
+		next.ServeHTTP(w, req)
+		log.Printf("%s %s (%s)", req.RequestLine.Method, req.RequestLine.RequestTarget, time.Since(start))
+	})
+}
+
 func thisFile() string {
 	_, thisFile, _, ok := runtime.Caller(0)
 	if !ok {
@@ -92,20 +125,22 @@ func assetsDir() string {
 	return abs
 }
 
-func serveHTML(w *response.Writer, statusCode int16) {
+func serveHTML(w *response.Writer, statusCode response.StatusCode) {
 	fileName := fmt.Sprintf("%d.html", statusCode)
 	tplDir := templatesDir()
 	body, err := os.ReadFile(filepath.Join(tplDir, fileName))
 	if err != nil && !errors.Is(err, os.ErrNotExist) {
-		log.Fatal("error reading file: ", err)
+		log.Printf("error reading file: %v", err)
+		body = []byte("internal server error")
+		statusCode = 500
 	}
 
 	header := response.GetDefaultHeaders(len(body))
-	header.Replace("Content-Type", "text/html")
+	header.Set("Content-Type", "text/html")
 
 	err = w.WriteRespose(statusCode, header, body)
 	if err != nil {
-		log.Fatal("error writing response message: ", err)
+		log.Printf("error writing response message: %v", err)
 	}
 }
 
@@ -114,28 +149,34 @@ func serveChunkedData(w *response.Writer, path string) {
 	hdr := response.GetDefaultHeaders(0)
 	hdr.Del("Content-Length")
 	hdr.Set("Transfer-Encoding", "chunked")
-	hdr.Set("Trailer", "X-Content-SHA256")
-	hdr.Set("Trailer", "X-Content-Length")
+	hdr.Add("Trailer", "X-Content-SHA256")
+	hdr.Add("Trailer", "X-Content-Length")
 
 	resp, err := http.Get(fmt.Sprintf("https://httpbin.org/%s", path))
 	if err != nil {
-		log.Fatal("error getting response from httpbin: ", err)
+		log.Printf("error getting response from httpbin: %v", err)
+		serveHTML(w, 500)
+		return
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		log.Fatalf("upstream returned non-2xx: %d %s", resp.StatusCode, resp.Status)
+		log.Printf("upstream returned non-2xx: %d %s", resp.StatusCode, resp.Status)
+		serveHTML(w, 500)
+		return
 	}
 
 	log.Println("starting to serve chunked data...")
 
 	err = w.WriteStatusLine(200)
 	if err != nil {
-		log.Fatal("error writing status line: ", err)
+		log.Printf("error writing status line: %v", err)
+		return
 	}
 	err = w.WriteHeader(hdr)
 	if err != nil {
-		log.Fatal("error writing header: ", err)
+		log.Printf("error writing header: %v", err)
+		return
 	}
 
 	buf := make([]byte, 1024)
@@ -145,82 +186,36 @@ func serveChunkedData(w *response.Writer, path string) {
 		if n > 0 {
 			body = append(body, buf[:n]...)
 			if _, werr := w.WriteChunkedBody(buf[:n]); werr != nil {
-				log.Fatalf("error writing chunk to client: %v", werr)
+				log.Printf("error writing chunk to client: %v", werr)
+				return
+			}
+			// the client sees each piece as soon as upstream sends it
+			if ferr := w.Flush(); ferr != nil {
+				log.Printf("error flushing chunk to client: %v", ferr)
+				return
 			}
 		}
 
 		if rerr != nil {
 			if errors.Is(rerr, io.EOF) {
 				if _, doneErr := w.WriteChunkedBodyDone(); doneErr != nil {
-					log.Fatalf("error writing final chunk done: %v", doneErr)
+					log.Printf("error writing final chunk done: %v", doneErr)
+					return
 				}
 
 				sum := sha256.Sum256(body)
-				trailer := header.Header{}
-				trailer["X-Content-SHA256"] = fmt.Sprintf("%x", sum)
-				trailer["X-Content-Length"] = fmt.Sprintf("%d", len(body))
+				trailer := header.NewHeader()
+				trailer.Set("X-Content-SHA256", fmt.Sprintf("%x", sum))
+				trailer.Set("X-Content-Length", fmt.Sprintf("%d", len(body)))
 
 				if terr := w.WriteTrailer(trailer); terr != nil {
-					log.Fatalf("error writing final chunk done: %v", terr)
+					log.Printf("error writing trailer: %v", terr)
 				}
 				return
 			}
-			log.Fatalf("error reading upstream body: %v", rerr)
-		}
-	}
-}
-
-func serveVideo(w *response.Writer) {
-	f, err := os.Open(filepath.Join(assetsDir(), "video.mp4"))
-	if err != nil {
-		log.Printf("error opening video file: %v", err)
-		serveHTML(w, 500)
-		return
-	}
-	defer f.Close()
-
-	fi, err := f.Stat()
-	if err != nil {
-		log.Printf("error stating video file: %v", err)
-		serveHTML(w, 500)
-		return
-	}
-	size := fi.Size()
-
-	if _, err := f.Seek(0, io.SeekStart); err != nil {
-		log.Printf("error seeking video file: %v", err)
-		serveHTML(w, 500)
-		return
-	}
-
-	hdr := response.GetDefaultHeaders(int(size))
-	hdr.Replace("Content-Type", "video/mp4")
-	hdr.Set("Accept-Ranges", "bytes")
-
-	if err := w.WriteStatusLine(200); err != nil {
-		log.Printf("error writing status line for video: %v", err)
-		return
-	}
-	if err := w.WriteHeader(hdr); err != nil {
-		log.Printf("error writing headers for video: %v", err)
-		return
-	}
-
-	buf := make([]byte, 32*1024) // 32KB
-	for {
-		n, rerr := f.Read(buf)
-		if n > 0 {
-			if _, werr := w.WriteBody(buf[:n]); werr != nil {
-				log.Printf("error writing video chunk: %v", werr)
-				return
-			}
-		}
-		if rerr != nil {
-			if errors.Is(rerr, io.EOF) {
-				log.Println("finished streaming video")
-				return
-			}
-			log.Printf("error reading video file: %v", rerr)
+			// the chunked body can't be finished properly, so the client has to see the connection close
+			log.Printf("error reading upstream body: %v", rerr)
+			w.SetKeepAlive(false)
 			return
 		}
 	}
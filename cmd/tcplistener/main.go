@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"net"
 
@@ -33,11 +34,17 @@ func main() {
 			req.RequestLine.Method, req.RequestLine.RequestTarget, req.RequestLine.HttpVersion,
 		)
 		fmt.Println("Header:")
-		for key, value := range req.Header {
-			fmt.Printf("- %s: %s\n", key, value)
+		for _, name := range req.Header.Names() {
+			for _, value := range req.Header.Values(name) {
+				fmt.Printf("- %s: %s\n", name, value)
+			}
 		}
 		fmt.Println("Body:")
-		fmt.Println(string(req.Body))
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			log.Fatal("Error reading body: ", err)
+		}
+		fmt.Println(string(body))
 
 		conn.Close()
 		fmt.Println("A connection has been closed!")
@@ -0,0 +1,258 @@
+// Package compression negotiates a content coding with the client and compresses responses
+package compression
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nichol20/http-server/internal/header"
+	"github.com/nichol20/http-server/internal/request"
+	"github.com/nichol20/http-server/internal/response"
+	"github.com/nichol20/http-server/internal/server"
+)
+
+// DefaultMinSize is the smallest body compressed, below it the encoding costs more than it saves
+const DefaultMinSize = 1024
+
+// codings are the content codings the middleware produces, in order of preference
+// when the client likes them equally
+var codings = []string{"gzip", "deflate"}
+
+// incompressible are media types whose format is compressed already,
+// compressing them again costs time and gains nothing
+var incompressible = map[string]bool{
+	"application/gzip":             true,
+	"application/x-gzip":           true,
+	"application/zip":              true,
+	"application/zstd":             true,
+	"application/x-bzip2":          true,
+	"application/x-7z-compressed":  true,
+	"application/x-rar-compressed": true,
+	"application/pdf":              true,
+	"application/ogg":              true,
+	"font/woff":                    true,
+	"font/woff2":                   true,
+}
+
+type config struct {
+	minSize        int64
+	level          int
+	maxDecodedSize int64
+}
+
+type Option func(*config)
+
+// WithMinSize sets the smallest body compressed, DefaultMinSize by default.
+// A body of unknown length is compressed once it is known to be at least that long
+func WithMinSize(n int) Option {
+	return func(c *config) {
+		c.minSize = int64(n)
+	}
+}
+
+// WithLevel sets the compression level, from flate.BestSpeed to flate.BestCompression.
+// Other values use flate.DefaultCompression
+func WithLevel(level int) Option {
+	return func(c *config) {
+		c.level = level
+	}
+}
+
+// WithMaxDecodedSize sets how long a request body may be once DecompressRequests decoded it.
+// Zero uses DefaultMaxDecodedSize and a negative value disables the limit
+func WithMaxDecodedSize(n int64) Option {
+	return func(c *config) {
+		c.maxDecodedSize = n
+	}
+}
+
+// encoder is what gzip.Writer and zlib.Writer have in common
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+type compressor struct {
+	cfg   config
+	pools map[string]*sync.Pool
+}
+
+// Middleware compresses response bodies with the content coding the client prefers in
+// Accept-Encoding, gzip or deflate. Bodies already encoded, of compressed media types,
+// partial or smaller than the minimum size are sent as is. The body is encoded as it is
+// written, so streamed and chunked responses stay streamed and Flush still reaches the client
+func Middleware(opts ...Option) server.Middleware {
+	cfg := config{minSize: DefaultMinSize, level: flate.DefaultCompression}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.level < flate.BestSpeed || cfg.level > flate.BestCompression {
+		cfg.level = flate.DefaultCompression
+	}
+
+	c := &compressor{cfg: cfg, pools: map[string]*sync.Pool{}}
+	c.pools["gzip"] = &sync.Pool{New: func() any {
+		zw, _ := gzip.NewWriterLevel(io.Discard, cfg.level)
+		return zw
+	}}
+	c.pools["deflate"] = &sync.Pool{New: func() any {
+		zw, _ := zlib.NewWriterLevel(io.Discard, cfg.level)
+		return zw
+	}}
+
+	return func(next server.Handler) server.Handler {
+		return server.HandlerFunc(func(w *response.Writer, req *request.Request) {
+			coding := negotiate(req.Header)
+			head := req.RequestLine.Method == "HEAD"
+			w.SetEncoder(func(statusCode response.StatusCode, h header.Header, size int64, dst io.Writer) io.WriteCloser {
+				return c.encoder(coding, head, statusCode, h, size, dst)
+			})
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+func (c *compressor) encoder(coding string, head bool, statusCode response.StatusCode, h header.Header, size int64, dst io.Writer) io.WriteCloser {
+	// a range is a range of the body as is
+	if statusCode == response.StatusPartialContent || h.Has("content-range") {
+		return nil
+	}
+	if h.Has("content-encoding") || h.HasToken("cache-control", "no-transform") || !compressible(h.Get("content-type")) {
+		return nil
+	}
+	// caches must not hand a compressed body to a client that didn't ask for it, or the opposite
+	if !h.HasToken("vary", "accept-encoding") && !h.HasToken("vary", "*") {
+		h.Add("Vary", "Accept-Encoding")
+	}
+	if coding == "" || (size >= 0 && size < c.cfg.minSize) {
+		return nil
+	}
+
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", coding)
+	// the encoded body is not byte for byte the one a strong tag was computed for
+	if etag := h.Get("etag"); strings.HasPrefix(etag, `"`) {
+		h.Set("ETag", "W/"+etag)
+	}
+	// a HEAD response gets the fields of the GET one, but no body to encode
+	if head {
+		return discard{}
+	}
+
+	pool := c.pools[coding]
+	enc := pool.Get().(encoder)
+	enc.Reset(dst)
+	return &pooledEncoder{encoder: enc, pool: pool}
+}
+
+// pooledEncoder puts the encoder back in its pool once the body is done
+type pooledEncoder struct {
+	encoder
+	pool *sync.Pool
+}
+
+func (p *pooledEncoder) Close() error {
+	err := p.encoder.Close()
+	p.encoder.Reset(io.Discard)
+	p.pool.Put(p.encoder)
+	return err
+}
+
+type discard struct{}
+
+func (discard) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (discard) Close() error {
+	return nil
+}
+
+// compressible reports whether a body of media type ctype is worth compressing.
+// Without a Content-Type nothing is known, so it is tried
+func compressible(ctype string) bool {
+	mediaType, _, _ := strings.Cut(ctype, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if mediaType == "image/svg+xml" || mediaType == "image/bmp" {
+		return true
+	}
+	for _, prefix := range []string{"image/", "video/", "audio/"} {
+		if strings.HasPrefix(mediaType, prefix) {
+			return false
+		}
+	}
+	return !incompressible[mediaType]
+}
+
+// negotiate picks the content coding of the response from Accept-Encoding (RFC 9110 section 12.5.3),
+// "" when the body is sent as is. A client that sent no Accept-Encoding gets no encoding,
+// it may not understand any
+func negotiate(h header.Header) string {
+	if !h.Has("accept-encoding") {
+		return ""
+	}
+	prefs := parseAcceptEncoding(h.Get("accept-encoding"))
+
+	best, bestQ := "", 0.0
+	for _, coding := range codings {
+		q, ok := prefs[coding]
+		if !ok && coding == "gzip" {
+			q, ok = prefs["x-gzip"]
+		}
+		if !ok {
+			q, ok = prefs["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	// identity is only compared when the client ranked it
+	if q, ok := prefs["identity"]; ok && q > bestQ {
+		return ""
+	}
+	return best
+}
+
+// parseAcceptEncoding maps each content coding in v to its quality value.
+// Entries with an invalid quality are ignored
+func parseAcceptEncoding(v string) map[string]float64 {
+	prefs := map[string]float64{}
+	for _, entry := range strings.Split(v, ",") {
+		coding, params, _ := strings.Cut(entry, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+		q, ok := 1.0, true
+		for _, param := range strings.Split(params, ";") {
+			name, value, found := strings.Cut(param, "=")
+			if !found || !strings.EqualFold(strings.TrimSpace(name), "q") {
+				continue
+			}
+			q, ok = parseQValue(strings.TrimSpace(value))
+		}
+		if ok {
+			prefs[coding] = q
+		}
+	}
+	return prefs
+}
+
+// parseQValue parses a weight, a number from 0 to 1 with at most three decimals (RFC 9110 section 12.4.2)
+func parseQValue(s string) (float64, bool) {
+	whole, frac, _ := strings.Cut(s, ".")
+	if (whole != "0" && whole != "1") || len(frac) > 3 || strings.Trim(frac, "0123456789") != "" {
+		return 0, false
+	}
+	if whole == "1" && strings.Trim(frac, "0") != "" {
+		return 0, false
+	}
+	q, err := strconv.ParseFloat(s, 64)
+	return q, err == nil
+}
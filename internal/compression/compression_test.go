@@ -0,0 +1,268 @@
+package compression
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nichol20/http-server/internal/header"
+	"github.com/nichol20/http-server/internal/request"
+	"github.com/nichol20/http-server/internal/response"
+	"github.com/nichol20/http-server/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var text = strings.Repeat("all work and no play makes jack a dull boy\n", 200)
+
+// serve runs a GET with the given field lines through h wrapped in Middleware,
+// and parses the response
+func serve(t *testing.T, h server.Handler, fields string, opts ...Option) (*http.Response, []byte) {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\n" + fields + "\r\n"))
+	require.NoError(t, err)
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	w.SetKeepAlive(true)
+	Middleware(opts...)(h).ServeHTTP(w, req)
+	require.NoError(t, w.Finish())
+
+	resp, err := http.ReadResponse(bufio.NewReader(buf), nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, body
+}
+
+func reply(ctype string, body string, withLength bool) server.HandlerFunc {
+	return func(w *response.Writer, req *request.Request) {
+		h := header.NewHeader()
+		h.Set("Content-Type", ctype)
+		if withLength {
+			h.Set("Content-Length", strconv.Itoa(len(body)))
+		}
+		w.WriteRespose(200, h, []byte(body))
+	}
+}
+
+func gunzip(t *testing.T, data []byte) string {
+	t.Helper()
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	out, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return string(out)
+}
+
+func TestNegotiate(t *testing.T) {
+	cases := map[string]string{
+		"gzip":                       "gzip",
+		"deflate":                    "deflate",
+		"gzip, deflate, br":          "gzip",
+		"deflate, gzip;q=0.5":        "deflate",
+		"x-gzip":                     "gzip",
+		"br":                         "",
+		"*":                          "gzip",
+		"*;q=0.1, gzip;q=0":          "deflate",
+		"gzip;q=0, deflate;q=0":      "",
+		"gzip;q=0.8, identity":       "",
+		"GZIP;Q=0.5":                 "gzip",
+		"gzip;q=2":                   "",
+		"gzip;q=0.0001, deflate;q=.": "",
+		"":                           "",
+	}
+	for accept, want := range cases {
+		h := header.NewHeader()
+		h.Set("Accept-Encoding", accept)
+		assert.Equal(t, want, negotiate(h), accept)
+	}
+
+	// Test: Without the field the client may not understand any coding
+	assert.Equal(t, "", negotiate(header.NewHeader()))
+}
+
+func TestMiddleware(t *testing.T) {
+	// Test: A body of unknown length is compressed with the preferred coding
+	resp, body := serve(t, reply("text/plain", text, false), "Accept-Encoding: gzip, deflate\r\n")
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+	assert.Less(t, len(body), len(text))
+	// it outgrew the buffer before the handler was done, its length was never known
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+	assert.Equal(t, text, gunzip(t, body))
+
+	// Test: A declared Content-Length is replaced by the encoded one
+	resp, body = serve(t, reply("text/html", text, true), "Accept-Encoding: deflate\r\n")
+	assert.Equal(t, "deflate", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, int64(len(body)), resp.ContentLength)
+	r, err := zlib.NewReader(bytes.NewReader(body))
+	require.NoError(t, err)
+	out, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, text, string(out))
+
+	// Test: A client that doesn't accept any coding gets the body as is, but caches still have to know
+	resp, body = serve(t, reply("text/plain", text, true), "Accept-Encoding: br\r\n")
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+	assert.Equal(t, text, string(body))
+
+	// Test: Small bodies are not worth it, whether their length is declared or not
+	for _, withLength := range []bool{true, false} {
+		resp, body = serve(t, reply("text/plain", "tiny", withLength), "Accept-Encoding: gzip\r\n")
+		assert.Empty(t, resp.Header.Get("Content-Encoding"))
+		assert.Equal(t, "tiny", string(body))
+	}
+	resp, _ = serve(t, reply("text/plain", "tiny", true), "Accept-Encoding: gzip\r\n", WithMinSize(0))
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+
+	// Test: Compressed formats are left alone
+	for _, ctype := range []string{"image/png", "video/mp4", "application/zip", "font/woff2"} {
+		resp, body = serve(t, reply(ctype, text, true), "Accept-Encoding: gzip\r\n")
+		assert.Empty(t, resp.Header.Get("Content-Encoding"), ctype)
+		assert.Empty(t, resp.Header.Get("Vary"), ctype)
+		assert.Equal(t, text, string(body), ctype)
+	}
+	resp, _ = serve(t, reply("image/svg+xml", text, true), "Accept-Encoding: gzip\r\n")
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+
+	// Test: A body encoded by the handler is not encoded twice
+	encoded := server.HandlerFunc(func(w *response.Writer, req *request.Request) {
+		h := header.NewHeader()
+		h.Set("Content-Encoding", "br")
+		w.WriteRespose(200, h, []byte(text))
+	})
+	resp, body = serve(t, encoded, "Accept-Encoding: gzip, br\r\n")
+	assert.Equal(t, "br", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, text, string(body))
+
+	// Test: A strong ETag is weakened, the bytes differ from the ones it was computed for
+	tagged := server.HandlerFunc(func(w *response.Writer, req *request.Request) {
+		h := header.NewHeader()
+		h.Set("ETag", `"v1"`)
+		w.WriteRespose(200, h, []byte(text))
+	})
+	resp, _ = serve(t, tagged, "Accept-Encoding: gzip\r\n")
+	assert.Equal(t, `W/"v1"`, resp.Header.Get("ETag"))
+
+	// Test: HEAD gets the fields of the GET response and no body
+	req, err := request.RequestFromReader(strings.NewReader("HEAD / HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: gzip\r\n\r\n"))
+	require.NoError(t, err)
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	w.SetMethod("HEAD")
+	Middleware()(reply("text/plain", text, true)).ServeHTTP(w, req)
+	require.NoError(t, w.Finish())
+	raw := buf.String()
+	assert.True(t, strings.HasSuffix(raw, "\r\n\r\n"), raw)
+	resp, err = http.ReadResponse(bufio.NewReader(strings.NewReader(raw)), &http.Request{Method: "HEAD"})
+	require.NoError(t, err)
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+
+	// Test: No encoder is taken from the pool for it
+	c := &compressor{cfg: config{minSize: DefaultMinSize}, pools: map[string]*sync.Pool{"gzip": {New: func() any {
+		t.Error("encoder taken for a HEAD response")
+		return nil
+	}}}}
+	assert.IsType(t, discard{}, c.encoder("gzip", true, 200, header.NewHeader(), int64(len(text)), io.Discard))
+}
+
+func TestDeclaredLength(t *testing.T) {
+	run := func(declared int, body string) (*response.Writer, []byte, error) {
+		req, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: gzip\r\n\r\n"))
+		require.NoError(t, err)
+		buf := &bytes.Buffer{}
+		w := response.NewWriter(buf)
+		w.SetKeepAlive(true)
+		var writeErr error
+		Middleware()(server.HandlerFunc(func(w *response.Writer, req *request.Request) {
+			h := header.NewHeader()
+			h.Set("Content-Type", "text/plain")
+			h.Set("Content-Length", strconv.Itoa(declared))
+			require.NoError(t, w.WriteStatusLine(200))
+			require.NoError(t, w.WriteHeader(h))
+			_, writeErr = w.WriteBody([]byte(body))
+		})).ServeHTTP(w, req)
+		if writeErr == nil {
+			writeErr = w.Finish()
+		}
+		return w, buf.Bytes(), writeErr
+	}
+
+	// Test: A body shorter than declared fails and isn't passed off as whole
+	w, out, err := run(len(text), text[:2000])
+	require.ErrorIs(t, err, response.ErrContentLengthShort)
+	assert.False(t, w.KeepAlive())
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(out)), nil)
+	if err == nil {
+		_, err = io.ReadAll(resp.Body)
+	}
+	assert.Error(t, err)
+
+	// Test: A body longer than declared is refused before it reaches the encoder
+	_, _, err = run(2000, text)
+	assert.ErrorIs(t, err, response.ErrContentLengthExceeded)
+
+	// Test: The declared length written in full is encoded as usual
+	w, out, err = run(len(text), text)
+	require.NoError(t, err)
+	assert.True(t, w.KeepAlive())
+	resp, err = http.ReadResponse(bufio.NewReader(bytes.NewReader(out)), nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, text, gunzip(t, body))
+}
+
+func TestStreaming(t *testing.T) {
+	// the handler streams like serveChunkedData, flushing each chunk
+	var flushed []int
+	conn := &bytes.Buffer{}
+	stream := server.HandlerFunc(func(w *response.Writer, req *request.Request) {
+		h := header.NewHeader()
+		h.Set("Content-Type", "application/json")
+		h.Set("Transfer-Encoding", "chunked")
+		h.Set("Trailer", "X-Count")
+		require.NoError(t, w.WriteStatusLine(200))
+		require.NoError(t, w.WriteHeader(h))
+		for i := 0; i < 3; i++ {
+			_, err := w.WriteChunkedBody([]byte(`{"line": "` + strings.Repeat("x", 100) + `"}` + "\n"))
+			require.NoError(t, err)
+			require.NoError(t, w.Flush())
+			flushed = append(flushed, conn.Len())
+		}
+		_, err := w.WriteChunkedBodyDone()
+		require.NoError(t, err)
+		trailer := header.NewHeader()
+		trailer.Set("X-Count", "3")
+		require.NoError(t, w.WriteTrailer(trailer))
+	})
+
+	req, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: gzip\r\n\r\n"))
+	require.NoError(t, err)
+	w := response.NewWriter(conn)
+	Middleware()(stream).ServeHTTP(w, req)
+	require.NoError(t, w.Finish())
+
+	// Test: Every flush reached the connection, the encoder didn't hold the chunks back
+	require.Len(t, flushed, 3)
+	assert.Less(t, flushed[0], flushed[1])
+	assert.Less(t, flushed[1], flushed[2])
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, strings.Repeat(`{"line": "`+strings.Repeat("x", 100)+`"}`+"\n", 3), gunzip(t, body))
+	assert.Equal(t, "3", resp.Trailer.Get("X-Count"))
+}
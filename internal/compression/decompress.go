@@ -0,0 +1,143 @@
+package compression
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/nichol20/http-server/internal/request"
+	"github.com/nichol20/http-server/internal/response"
+	"github.com/nichol20/http-server/internal/server"
+)
+
+// DefaultMaxDecodedSize is how long a decoded request body may be by default
+const DefaultMaxDecodedSize = 10 << 20
+
+// maxCodings is how many content codings a request body may be encoded with,
+// nobody compresses a body more than twice
+const maxCodings = 2
+
+// DecompressRequests decodes request bodies sent with a Content-Encoding of gzip or deflate,
+// so handlers read Body as it was before it was encoded. Content-Encoding and Content-Length
+// are removed from the request header, they describe the encoded body.
+//
+// A few kilobytes of gzip can decode to gigabytes, so reading more than the maximum decoded
+// size fails with request.ErrBodyTooLarge. Bodies in any other coding are answered with
+// a 415 listing the supported ones in Accept-Encoding (RFC 9110 section 12.5.3)
+func DecompressRequests(opts ...Option) server.Middleware {
+	cfg := config{maxDecodedSize: DefaultMaxDecodedSize}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.maxDecodedSize == 0 {
+		cfg.maxDecodedSize = DefaultMaxDecodedSize
+	}
+
+	return func(next server.Handler) server.Handler {
+		return server.HandlerFunc(func(w *response.Writer, req *request.Request) {
+			if !req.Header.Has("content-encoding") {
+				next.ServeHTTP(w, req)
+				return
+			}
+			codings, ok := requestCodings(req.Header.Get("content-encoding"))
+			if !ok {
+				unsupportedEncoding(w)
+				return
+			}
+			if len(codings) > 0 {
+				req.Body = &decodedBody{raw: req.Body, codings: codings, max: cfg.maxDecodedSize}
+				req.Header.Del("Content-Length")
+			}
+			req.Header.Del("Content-Encoding")
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// requestCodings lists the codings in a Content-Encoding in the order they were applied,
+// reporting false when one of them can't be decoded
+func requestCodings(v string) ([]string, bool) {
+	codings := []string{}
+	for _, coding := range strings.Split(v, ",") {
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		switch coding {
+		case "", "identity":
+			continue
+		case "x-gzip":
+			coding = "gzip"
+		case "gzip", "deflate":
+		default:
+			return nil, false
+		}
+		codings = append(codings, coding)
+	}
+	return codings, len(codings) <= maxCodings
+}
+
+func unsupportedEncoding(w *response.Writer) {
+	message := "415 unsupported content encoding"
+	h := response.GetDefaultHeaders(len(message))
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	h.Set("Accept-Encoding", strings.Join(codings, ", "))
+	w.WriteRespose(response.StatusUnsupportedMediaType, h, []byte(message))
+}
+
+// decodedBody decodes a request body as it is read. The decoders are only created on the
+// first read, creating them reads the body, which the handler may never want
+type decodedBody struct {
+	raw     io.ReadCloser
+	codings []string
+	r       io.Reader
+	read    int64
+	// negative when there is no limit
+	max int64
+	// sticky error, once decoding failed it keeps failing
+	err error
+}
+
+func (d *decodedBody) Read(p []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	if d.r == nil {
+		r := io.Reader(d.raw)
+		// the last coding applied is the first one to undo
+		for i := len(d.codings) - 1; i >= 0; i-- {
+			var err error
+			if r, err = newDecoder(d.codings[i], r); err != nil {
+				d.err = err
+				return 0, err
+			}
+		}
+		d.r = r
+	}
+
+	// one byte past the limit tells a body of exactly max bytes from a longer one
+	if left := d.max - d.read + 1; d.max >= 0 && int64(len(p)) > left {
+		p = p[:left]
+	}
+	n, err := d.r.Read(p)
+	d.read += int64(n)
+	if d.max >= 0 && d.read > d.max {
+		d.err = fmt.Errorf("%w: decoded body longer than %d bytes", request.ErrBodyTooLarge, d.max)
+		return n - int(d.read-d.max), d.err
+	}
+	if err != nil && err != io.EOF {
+		d.err = err
+	}
+	return n, err
+}
+
+func (d *decodedBody) Close() error {
+	return d.raw.Close()
+}
+
+func newDecoder(coding string, r io.Reader) (io.Reader, error) {
+	if coding == "gzip" {
+		return gzip.NewReader(r)
+	}
+	// deflate in HTTP is the zlib format (RFC 9110 section 8.4.1.2)
+	return zlib.NewReader(r)
+}
@@ -0,0 +1,121 @@
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/nichol20/http-server/internal/request"
+	"github.com/nichol20/http-server/internal/response"
+	"github.com/nichol20/http-server/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gzipped(t *testing.T, data string) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	_, err := zw.Write([]byte(data))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func zlibbed(t *testing.T, data []byte) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	zw := zlib.NewWriter(buf)
+	_, err := zw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+// upload runs a POST of body, sent with the given Content-Encoding, through DecompressRequests.
+// It returns the response and what the handler read, or the error it got
+func upload(t *testing.T, encoding string, body []byte, opts ...Option) (string, string, error) {
+	t.Helper()
+	raw := "POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n"
+	if encoding != "" {
+		raw += "Content-Encoding: " + encoding + "\r\n"
+	}
+	req, err := request.RequestFromReader(strings.NewReader(raw + "\r\n" + string(body)))
+	require.NoError(t, err)
+
+	var read []byte
+	var readErr error
+	h := server.HandlerFunc(func(w *response.Writer, req *request.Request) {
+		assert.False(t, req.Header.Has("content-encoding"))
+		read, readErr = io.ReadAll(req.Body)
+	})
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	DecompressRequests(opts...)(h).ServeHTTP(w, req)
+	require.NoError(t, w.Finish())
+	return buf.String(), string(read), readErr
+}
+
+func TestDecompressRequests(t *testing.T) {
+	payload := `{"items": [` + strings.Repeat(`{"name": "widget"}, `, 100) + `{}]}`
+
+	// Test: A gzip body is read decoded
+	resp, read, err := upload(t, "gzip", gzipped(t, payload))
+	require.NoError(t, err)
+	assert.Equal(t, payload, read)
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"), resp)
+
+	// Test: So is a deflate one, and codings applied one after the other
+	_, read, err = upload(t, "deflate", zlibbed(t, []byte(payload)))
+	require.NoError(t, err)
+	assert.Equal(t, payload, read)
+	_, read, err = upload(t, "gzip, deflate", zlibbed(t, gzipped(t, payload)))
+	require.NoError(t, err)
+	assert.Equal(t, payload, read)
+
+	// Test: Unencoded bodies are untouched
+	_, read, err = upload(t, "", []byte(payload))
+	require.NoError(t, err)
+	assert.Equal(t, payload, read)
+	_, read, err = upload(t, "identity", []byte(payload))
+	require.NoError(t, err)
+	assert.Equal(t, payload, read)
+
+	// Test: A body decoding past the limit fails, however small it was
+	bomb := gzipped(t, strings.Repeat("\x00", 1<<20))
+	assert.Less(t, len(bomb), 4<<10)
+	_, read, err = upload(t, "gzip", bomb, WithMaxDecodedSize(64<<10))
+	assert.ErrorIs(t, err, request.ErrBodyTooLarge)
+	assert.Len(t, read, 64<<10)
+
+	// Test: A body of exactly the limit is fine
+	_, read, err = upload(t, "gzip", gzipped(t, payload), WithMaxDecodedSize(int64(len(payload))))
+	require.NoError(t, err)
+	assert.Equal(t, payload, read)
+
+	// Test: A negative limit disables it, zero uses the default
+	_, read, err = upload(t, "gzip", bomb, WithMaxDecodedSize(-1))
+	require.NoError(t, err)
+	assert.Len(t, read, 1<<20)
+	_, read, err = upload(t, "gzip", bomb, WithMaxDecodedSize(-5))
+	require.NoError(t, err)
+	assert.Len(t, read, 1<<20)
+	_, read, err = upload(t, "gzip", gzipped(t, payload), WithMaxDecodedSize(0))
+	require.NoError(t, err)
+	assert.Equal(t, payload, read)
+
+	// Test: A body that isn't what its coding says fails to read
+	_, _, err = upload(t, "gzip", []byte(payload))
+	assert.Error(t, err)
+
+	// Test: Unknown codings are a 415 telling the client what it can use
+	for _, encoding := range []string{"br", "gzip, zstd", "gzip, gzip, gzip"} {
+		resp, _, _ = upload(t, encoding, []byte(payload))
+		assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 415 Unsupported Media Type\r\n"), resp)
+		assert.Contains(t, resp, "Accept-Encoding: gzip, deflate\r\n")
+	}
+}
@@ -0,0 +1,147 @@
+package fileserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nichol20/http-server/internal/header"
+	"github.com/nichol20/http-server/internal/request"
+	"github.com/nichol20/http-server/internal/response"
+)
+
+// ETag returns a strong entity tag for a body, changing whenever a byte of it does
+func ETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// FileETag returns an entity tag for a file from its size and modification time. The tag is
+// strong so ranges and If-Match work with it, which assumes a file isn't rewritten with the same
+// size within the clock's resolution. Files without a modification time get a weak tag
+func FileETag(info fs.FileInfo) string {
+	tag := `"` + strconv.FormatInt(info.ModTime().UnixNano(), 16) + "-" + strconv.FormatInt(info.Size(), 16) + `"`
+	if info.ModTime().IsZero() {
+		return "W/" + tag
+	}
+	return tag
+}
+
+// CheckPreconditions evaluates If-Match, If-Unmodified-Since, If-None-Match and If-Modified-Since
+// in the order of RFC 9110 section 13.2.2 against the ETag in h and modtime. When one fails it
+// answers with a 304 or a 412 and reports true, the handler must then not write anything else.
+// A zero modtime makes the date conditions be ignored
+func CheckPreconditions(w *response.Writer, req *request.Request, h header.Header, modtime time.Time) bool {
+	etag := ""
+	if h != nil {
+		etag = h.Get("etag")
+	}
+	method := req.RequestLine.Method
+
+	if v := req.Header.Get("if-match"); v != "" {
+		if !etagListMatches(v, etag, true) {
+			w.Error(response.StatusPreconditionFailed, "412 precondition failed")
+			return true
+		}
+	} else if t, ok := conditionDate(req, "if-unmodified-since", modtime); ok && modtime.Truncate(time.Second).After(t) {
+		w.Error(response.StatusPreconditionFailed, "412 precondition failed")
+		return true
+	}
+
+	if v := req.Header.Get("if-none-match"); v != "" {
+		if etagListMatches(v, etag, false) {
+			if method == "GET" || method == "HEAD" {
+				notModified(w, h)
+			} else {
+				w.Error(response.StatusPreconditionFailed, "412 precondition failed")
+			}
+			return true
+		}
+	} else if method == "GET" || method == "HEAD" {
+		if t, ok := conditionDate(req, "if-modified-since", modtime); ok && !modtime.Truncate(time.Second).After(t) {
+			notModified(w, h)
+			return true
+		}
+	}
+	return false
+}
+
+// notModified sends a 304 keeping the fields a cache updates its stored response with
+// (RFC 9110 section 15.4.5). Last-Modified only matters when there is no ETag
+func notModified(w *response.Writer, h header.Header) {
+	nh := header.NewHeader()
+	for _, name := range []string{"Cache-Control", "Content-Location", "ETag", "Expires", "Vary", "Last-Modified"} {
+		if name == "Last-Modified" && nh.Has("etag") {
+			continue
+		}
+		for _, v := range h.Values(name) {
+			nh.Add(name, v)
+		}
+	}
+	w.WriteRespose(response.StatusNotModified, nh, nil)
+}
+
+// conditionDate parses the HTTP-date in the named field. It is ignored when missing,
+// invalid, or when there is no modtime to compare it to
+func conditionDate(req *request.Request, name string, modtime time.Time) (time.Time, bool) {
+	v := req.Header.Get(name)
+	if v == "" || modtime.IsZero() {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(response.TimeFormat, strings.TrimSpace(v))
+	return t, err == nil
+}
+
+// etagListMatches reports whether the comma separated list of entity tags in v, or "*",
+// matches etag. The strong comparison fails for weak tags, the weak one ignores the
+// W/ prefix (RFC 9110 section 8.8.3.2)
+func etagListMatches(v string, etag string, strong bool) bool {
+	if strings.TrimSpace(v) == "*" {
+		// the representation always exists when this is evaluated
+		return true
+	}
+	if etag == "" {
+		return false
+	}
+	for {
+		v = strings.TrimLeft(v, " \t,")
+		if v == "" {
+			return false
+		}
+		tag, rest, ok := scanETag(v)
+		if !ok {
+			return false
+		}
+		if etagsMatch(tag, etag, strong) {
+			return true
+		}
+		v = rest
+	}
+}
+
+// scanETag reads the entity tag at the start of s and returns what follows it
+func scanETag(s string) (string, string, bool) {
+	start := 0
+	if strings.HasPrefix(s, "W/") {
+		start = 2
+	}
+	if len(s) < start+2 || s[start] != '"' {
+		return "", "", false
+	}
+	end := strings.IndexByte(s[start+1:], '"')
+	if end < 0 {
+		return "", "", false
+	}
+	end += start + 2
+	return s[:end], s[end:], true
+}
+
+func etagsMatch(a string, b string, strong bool) bool {
+	if strong {
+		return !strings.HasPrefix(a, "W/") && !strings.HasPrefix(b, "W/") && a == b
+	}
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
@@ -0,0 +1,146 @@
+package fileserver
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/nichol20/http-server/internal/header"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestETag(t *testing.T) {
+	// Test: Byte bodies get a strong tag following the content
+	assert.Equal(t, ETag([]byte("hello")), ETag([]byte("hello")))
+	assert.NotEqual(t, ETag([]byte("hello")), ETag([]byte("hellO")))
+	assert.Regexp(t, `^"[0-9a-f]{32}"$`, ETag([]byte("hello")))
+
+	// Test: Files get a strong tag following the size and modification time
+	fsys := fstest.MapFS{
+		"a": {Data: []byte("abc"), ModTime: modtime},
+		"b": {Data: []byte("abcd"), ModTime: modtime},
+		"c": {Data: []byte("abc"), ModTime: modtime.Add(time.Second)},
+	}
+	tags := map[string]bool{}
+	for _, name := range []string{"a", "b", "c"} {
+		info, err := fsys.Stat(name)
+		require.NoError(t, err)
+		tag := FileETag(info)
+		assert.Regexp(t, `^"[0-9a-f]+-[0-9a-f]+"$`, tag)
+		tags[tag] = true
+	}
+	assert.Len(t, tags, 3)
+
+	// Test: Without a modification time the tag is weak
+	info, err := fstest.MapFS{"d": {Data: []byte("abc")}}.Stat("d")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(FileETag(info), `W/"`))
+}
+
+func TestEtagListMatches(t *testing.T) {
+	assert.True(t, etagListMatches(`*`, `"a"`, true))
+	assert.True(t, etagListMatches(`"x", "a"`, `"a"`, true))
+	assert.True(t, etagListMatches(`"x",W/"a"`, `"a"`, false))
+	assert.True(t, etagListMatches(`"a,b"`, `"a,b"`, true))
+	assert.False(t, etagListMatches(`W/"a"`, `"a"`, true))
+	assert.False(t, etagListMatches(`"a"`, `W/"a"`, true))
+	assert.False(t, etagListMatches(`"a"`, ``, false))
+	assert.False(t, etagListMatches(`a`, `a`, false))
+}
+
+func TestCheckPreconditions(t *testing.T) {
+	etag := header.NewHeader()
+	etag.Set("ETag", `"v1"`)
+	etag.Set("Cache-Control", "max-age=60")
+	h := contentHandler(etag)
+
+	const (
+		before = "Tue, 30 Apr 2024 12:00:00 GMT"
+		at     = "Wed, 01 May 2024 12:00:00 GMT"
+		after  = "Thu, 02 May 2024 12:00:00 GMT"
+	)
+	cases := []struct {
+		method string
+		fields string
+		want   string
+	}{
+		{"GET", "", "200 OK"},
+		{"GET", `If-None-Match: "v1"` + "\r\n", "304 Not Modified"},
+		{"HEAD", `If-None-Match: "v0", W/"v1"` + "\r\n", "304 Not Modified"},
+		{"GET", "If-None-Match: *\r\n", "304 Not Modified"},
+		{"GET", `If-None-Match: "v0"` + "\r\n", "200 OK"},
+		{"PUT", `If-None-Match: "v1"` + "\r\n", "412 Precondition Failed"},
+		{"GET", "If-Modified-Since: " + at + "\r\n", "304 Not Modified"},
+		{"GET", "If-Modified-Since: " + after + "\r\n", "304 Not Modified"},
+		{"GET", "If-Modified-Since: " + before + "\r\n", "200 OK"},
+		{"GET", "If-Modified-Since: yesterday\r\n", "200 OK"},
+		{"PUT", "If-Modified-Since: " + at + "\r\n", "200 OK"},
+		{"GET", `If-Match: "v1"` + "\r\n", "200 OK"},
+		{"GET", "If-Match: *\r\n", "200 OK"},
+		{"PUT", `If-Match: "v0"` + "\r\n", "412 Precondition Failed"},
+		{"GET", `If-Match: W/"v1"` + "\r\n", "412 Precondition Failed"},
+		{"GET", "If-Unmodified-Since: " + at + "\r\n", "200 OK"},
+		{"GET", "If-Unmodified-Since: " + before + "\r\n", "412 Precondition Failed"},
+		// If-None-Match wins over If-Modified-Since
+		{"GET", `If-None-Match: "v0"` + "\r\nIf-Modified-Since: " + after + "\r\n", "200 OK"},
+		// If-Match wins over If-Unmodified-Since
+		{"GET", `If-Match: "v1"` + "\r\nIf-Unmodified-Since: " + before + "\r\n", "200 OK"},
+		// a failed If-Match is answered before If-None-Match is looked at
+		{"GET", `If-Match: "v0"` + "\r\n" + `If-None-Match: "v1"` + "\r\n", "412 Precondition Failed"},
+		// a matching If-None-Match makes Range irrelevant
+		{"GET", `If-None-Match: "v1"` + "\r\nRange: bytes=0-0\r\n", "304 Not Modified"},
+	}
+	for _, c := range cases {
+		resp := serveWithFields(t, h, c.method, "/", c.fields)
+		assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 "+c.want+"\r\n"), "%s %q: %s", c.method, c.fields, resp)
+	}
+
+	// Test: A 304 keeps the validators and caching fields, without the body or its metadata
+	head, body := splitResponse(t, serveWithFields(t, h, "GET", "/", `If-None-Match: "v1"`+"\r\n"))
+	assert.Contains(t, head, `ETag: "v1"`)
+	assert.Contains(t, head, "Cache-Control: max-age=60")
+	assert.NotContains(t, head, "Content-Type")
+	assert.NotContains(t, head, "Content-Length")
+	assert.NotContains(t, head, "Last-Modified")
+	assert.Empty(t, body)
+
+	// Test: Without an ETag, Last-Modified is kept
+	head, _ = splitResponse(t, serveWithFields(t, contentHandler(nil), "GET", "/", "If-Modified-Since: "+at+"\r\n"))
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 304 Not Modified\r\n"), head)
+	assert.Contains(t, head, "Last-Modified: "+at)
+}
+
+func TestFileServerConditional(t *testing.T) {
+	h := FileServerFS(testFS())
+
+	head, _ := splitResponse(t, serve(t, h, "GET", "/hello.txt"))
+	var etag string
+	for _, line := range strings.Split(head, "\r\n") {
+		if v, ok := strings.CutPrefix(line, "ETag: "); ok {
+			etag = v
+		}
+	}
+	require.NotEmpty(t, etag)
+
+	// Test: The tag of the file makes the client's copy valid
+	resp := serveWithFields(t, h, "GET", "/hello.txt", "If-None-Match: "+etag+"\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 304 Not Modified\r\n"), resp)
+
+	// Test: The tag of the file satisfies If-Match
+	resp = serveWithFields(t, h, "GET", "/hello.txt", "If-Match: "+etag+"\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"), resp)
+
+	// Test: The tag of the file makes If-Range send the range
+	resp = serveWithFields(t, h, "GET", "/hello.txt", "Range: bytes=6-\r\nIf-Range: "+etag+"\r\n")
+	head, body := splitResponse(t, resp)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 206 Partial Content\r\n"), head)
+	assert.Equal(t, "world", body)
+
+	// Test: A stale tag gets the whole file instead
+	resp = serveWithFields(t, h, "GET", "/hello.txt", "Range: bytes=6-\r\nIf-Range: \"stale\"\r\n")
+	head, body = splitResponse(t, resp)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 200 OK\r\n"), head)
+	assert.Equal(t, "hello world", body)
+}
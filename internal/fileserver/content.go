@@ -0,0 +1,281 @@
+package fileserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nichol20/http-server/internal/header"
+	"github.com/nichol20/http-server/internal/request"
+	"github.com/nichol20/http-server/internal/response"
+)
+
+// maxRanges is how many ranges a request may ask for before the header is ignored
+// and the whole content is sent, a list of tiny ranges costs far more than the content
+const maxRanges = 100
+
+var errInvalidRange = errors.New("invalid range")
+
+// byteRange is a range of content, both ends included
+type byteRange struct {
+	start, end int64
+}
+
+func (r byteRange) length() int64 {
+	return r.end - r.start + 1
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.end, size)
+}
+
+// ServeContent replies with content, honoring the conditions of CheckPreconditions and
+// Range and If-Range (RFC 9110 section 14). A single range is a 206 with a Content-Range,
+// more than one a multipart/byteranges body, and ranges beyond the end of content a 416.
+// A byte body is served with a bytes.Reader and the ETag of ETag.
+//
+// h holds fields to send along, like an ETag the conditions are compared to, and may be nil.
+// Without a Content-Type in h, it is guessed from the extension of name, then from the content.
+// A non zero modtime is sent as Last-Modified
+func ServeContent(w *response.Writer, req *request.Request, h header.Header, name string, modtime time.Time, content io.ReadSeeker) {
+	if h == nil {
+		h = header.NewHeader()
+	} else {
+		h = h.Clone()
+	}
+
+	size, err := content.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = content.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+
+	if !h.Has("content-type") {
+		ctype, err := contentType(name, content)
+		if err != nil {
+			serveError(w, err)
+			return
+		}
+		h.Set("Content-Type", ctype)
+	}
+	if !modtime.IsZero() && !h.Has("last-modified") {
+		h.Set("Last-Modified", modtime.UTC().Format(response.TimeFormat))
+	}
+	h.Set("Accept-Ranges", "bytes")
+
+	if CheckPreconditions(w, req, h, modtime) {
+		return
+	}
+
+	var ranges []byteRange
+	// ranges only apply to GET, and only while the client's copy is still the current one
+	if rangeHeader := req.Header.Get("range"); rangeHeader != "" && req.RequestLine.Method == "GET" && ifRangeMatches(req, h, modtime) {
+		ranges, err = parseRange(rangeHeader, size)
+		if err != nil {
+			ranges = nil
+		}
+		if err == nil && len(ranges) == 0 {
+			// the client learns the current size from the Content-Range
+			message := "range not satisfiable"
+			h.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			h.Set("Content-Type", "text/plain; charset=utf-8")
+			h.Set("Content-Length", strconv.Itoa(len(message)))
+			w.WriteRespose(response.StatusRangeNotSatisfiable, h, []byte(message))
+			return
+		}
+	}
+
+	switch len(ranges) {
+	case 0:
+		h.Set("Content-Length", strconv.FormatInt(size, 10))
+		if writeHeader(w, response.StatusOK, h) && req.RequestLine.Method != "HEAD" {
+			copyBody(w, content, size)
+		}
+	case 1:
+		r := ranges[0]
+		h.Set("Content-Range", r.contentRange(size))
+		h.Set("Content-Length", strconv.FormatInt(r.length(), 10))
+		if !writeHeader(w, response.StatusPartialContent, h) {
+			return
+		}
+		if _, err := content.Seek(r.start, io.SeekStart); err != nil {
+			w.SetKeepAlive(false)
+			return
+		}
+		copyBody(w, content, r.length())
+	default:
+		serveMultipart(w, h, content, size, ranges)
+	}
+}
+
+// serveMultipart sends every range as a part of a multipart/byteranges body (RFC 9110 section 14.6)
+func serveMultipart(w *response.Writer, h header.Header, content io.ReadSeeker, size int64, ranges []byteRange) {
+	boundary := randomBoundary()
+	ctype := h.Get("content-type")
+
+	// the part headers are known up front, so the length of the whole body is too
+	parts := make([]string, len(ranges))
+	length := int64(0)
+	for i, r := range ranges {
+		sep := "\r\n"
+		if i == 0 {
+			sep = ""
+		}
+		parts[i] = fmt.Sprintf("%s--%s\r\nContent-Type: %s\r\nContent-Range: %s\r\n\r\n", sep, boundary, ctype, r.contentRange(size))
+		length += int64(len(parts[i])) + r.length()
+	}
+	closing := fmt.Sprintf("\r\n--%s--\r\n", boundary)
+	length += int64(len(closing))
+
+	h.Set("Content-Type", "multipart/byteranges; boundary="+boundary)
+	h.Set("Content-Length", strconv.FormatInt(length, 10))
+	if !writeHeader(w, response.StatusPartialContent, h) {
+		return
+	}
+	for i, r := range ranges {
+		if _, err := w.WriteBody([]byte(parts[i])); err != nil {
+			return
+		}
+		if _, err := content.Seek(r.start, io.SeekStart); err != nil {
+			w.SetKeepAlive(false)
+			return
+		}
+		if !copyBody(w, content, r.length()) {
+			return
+		}
+	}
+	w.WriteBody([]byte(closing))
+}
+
+// parseRange parses a Range header against content of size bytes. It returns no ranges when
+// none of them is satisfiable, and errInvalidRange for a header that should be ignored
+func parseRange(s string, size int64) ([]byteRange, error) {
+	unit, set, ok := strings.Cut(s, "=")
+	if !ok || !strings.EqualFold(strings.TrimSpace(unit), "bytes") {
+		return nil, errInvalidRange
+	}
+	specs := strings.Split(set, ",")
+	if len(specs) > maxRanges {
+		return nil, errInvalidRange
+	}
+
+	ranges := []byteRange{}
+	total := int64(0)
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, errInvalidRange
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+
+		var r byteRange
+		if first == "" {
+			// a suffix, the last n bytes
+			n, err := parseOffset(last)
+			if err != nil {
+				return nil, errInvalidRange
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			r = byteRange{start: max(size-n, 0), end: size - 1}
+		} else {
+			start, err := parseOffset(first)
+			if err != nil {
+				return nil, errInvalidRange
+			}
+			end := size - 1
+			if last != "" {
+				if end, err = parseOffset(last); err != nil || end < start {
+					return nil, errInvalidRange
+				}
+			}
+			if start >= size {
+				continue
+			}
+			r = byteRange{start: start, end: min(end, size-1)}
+		}
+		ranges = append(ranges, r)
+		total += r.length()
+	}
+	// overlapping ranges asking for more than the content itself are not worth honoring
+	if total > size {
+		return nil, errInvalidRange
+	}
+	return ranges, nil
+}
+
+func parseOffset(s string) (int64, error) {
+	if s == "" || strings.ContainsAny(s, "+-") {
+		return 0, errInvalidRange
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// ifRangeMatches reports whether the validator in If-Range still matches the content,
+// a missing If-Range always does. Only strong validators match (RFC 9110 section 13.1.5)
+func ifRangeMatches(req *request.Request, h header.Header, modtime time.Time) bool {
+	v := strings.TrimSpace(req.Header.Get("if-range"))
+	if v == "" {
+		return true
+	}
+	if strings.HasPrefix(v, `"`) || strings.HasPrefix(v, "W/") {
+		return etagsMatch(v, h.Get("etag"), true)
+	}
+	t, err := time.Parse(response.TimeFormat, v)
+	return err == nil && !modtime.IsZero() && t.Equal(modtime.Truncate(time.Second))
+}
+
+// contentType guesses the media type from the extension of name, or from the first bytes of content
+func contentType(name string, content io.ReadSeeker) (string, error) {
+	if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+		return ctype, nil
+	}
+	buf := make([]byte, sniffLen)
+	n, err := io.ReadFull(content, buf)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return DetectContentType(buf[:n]), nil
+}
+
+// writeHeader writes the status line and h, reporting whether the body can follow
+func writeHeader(w *response.Writer, statusCode response.StatusCode, h header.Header) bool {
+	if err := w.WriteStatusLine(statusCode); err != nil {
+		return false
+	}
+	return w.WriteHeader(h) == nil
+}
+
+// copyBody copies n bytes of content to the body. The client already has part of the
+// body when that fails, so the connection is closed to tell it the body is incomplete
+func copyBody(w *response.Writer, content io.Reader, n int64) bool {
+	if _, err := io.CopyN(w, content, n); err != nil {
+		w.SetKeepAlive(false)
+		return false
+	}
+	return true
+}
+
+func randomBoundary() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,171 @@
+package fileserver
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nichol20/http-server/internal/header"
+	"github.com/nichol20/http-server/internal/request"
+	"github.com/nichol20/http-server/internal/response"
+	"github.com/nichol20/http-server/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const alphabet = "abcdefghijklmnopqrstuvwxyz"
+
+var modtime = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+func contentHandler(h header.Header) server.Handler {
+	return server.HandlerFunc(func(w *response.Writer, req *request.Request) {
+		ServeContent(w, req, h, "alphabet.txt", modtime, strings.NewReader(alphabet))
+	})
+}
+
+// splitResponse returns the head and the body of a raw response
+func splitResponse(t *testing.T, resp string) (string, string) {
+	t.Helper()
+	head, body, ok := strings.Cut(resp, "\r\n\r\n")
+	require.True(t, ok, resp)
+	return head, body
+}
+
+func TestParseRange(t *testing.T) {
+	cases := []struct {
+		header string
+		want   []byteRange
+		err    bool
+	}{
+		{header: "bytes=0-4", want: []byteRange{{0, 4}}},
+		{header: "bytes=20-", want: []byteRange{{20, 25}}},
+		{header: "bytes=-3", want: []byteRange{{23, 25}}},
+		{header: "bytes=-100", want: []byteRange{{0, 25}}},
+		{header: "bytes=20-100", want: []byteRange{{20, 25}}},
+		{header: "bytes=0-1, 4-5", want: []byteRange{{0, 1}, {4, 5}}},
+		{header: "BYTES=0-0", want: []byteRange{{0, 0}}},
+		// unsatisfiable ones are dropped, none left means a 416
+		{header: "bytes=30-40", want: []byteRange{}},
+		{header: "bytes=30-40, 0-0", want: []byteRange{{0, 0}}},
+		{header: "bytes=-0", want: []byteRange{}},
+		// invalid ones make the whole header ignored
+		{header: "bytes=5-1", err: true},
+		{header: "bytes=a-b", err: true},
+		{header: "bytes=1", err: true},
+		{header: "bytes=--1", err: true},
+		{header: "items=0-1", err: true},
+		{header: "bytes=0-25, 0-25", err: true},
+		{header: "bytes=" + strings.Repeat("0-0,", maxRanges+1), err: true},
+	}
+	for _, c := range cases {
+		ranges, err := parseRange(c.header, int64(len(alphabet)))
+		if c.err {
+			assert.Error(t, err, c.header)
+			continue
+		}
+		require.NoError(t, err, c.header)
+		assert.Equal(t, c.want, ranges, c.header)
+	}
+}
+
+func TestServeContent(t *testing.T) {
+	h := contentHandler(nil)
+
+	// Test: Without Range the whole content, advertising range support
+	head, body := splitResponse(t, serve(t, h, "GET", "/"))
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 200 OK\r\n"), head)
+	assert.Contains(t, head, "Accept-Ranges: bytes")
+	assert.Contains(t, head, "Last-Modified: Wed, 01 May 2024 12:00:00 GMT")
+	assert.Equal(t, alphabet, body)
+
+	// Test: A single range
+	head, body = splitResponse(t, serveWithFields(t, h, "GET", "/", "Range: bytes=2-4\r\n"))
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 206 Partial Content\r\n"), head)
+	assert.Contains(t, head, "Content-Range: bytes 2-4/26")
+	assert.Contains(t, head, "Content-Length: 3")
+	assert.Contains(t, head, "Content-Type: text/plain; charset=utf-8")
+	assert.Equal(t, "cde", body)
+
+	// Test: A range past the end
+	head, _ = splitResponse(t, serveWithFields(t, h, "GET", "/", "Range: bytes=100-\r\n"))
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 416 Range Not Satisfiable\r\n"), head)
+	assert.Contains(t, head, "Content-Range: bytes */26")
+
+	// Test: An invalid Range is ignored
+	head, body = splitResponse(t, serveWithFields(t, h, "GET", "/", "Range: bytes=4-2\r\n"))
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 200 OK\r\n"), head)
+	assert.Equal(t, alphabet, body)
+
+	// Test: HEAD ignores Range
+	head, body = splitResponse(t, serveWithFields(t, h, "HEAD", "/", "Range: bytes=2-4\r\n"))
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 200 OK\r\n"), head)
+	assert.Contains(t, head, "Content-Length: 26")
+	assert.Empty(t, body)
+}
+
+func TestMultipleRanges(t *testing.T) {
+	resp := serveWithFields(t, contentHandler(nil), "GET", "/", "Range: bytes=0-2, -2\r\n")
+	head, body := splitResponse(t, resp)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 206 Partial Content\r\n"), head)
+	assert.Contains(t, head, "Content-Length: "+strconv.Itoa(len(body)))
+
+	var ctype string
+	for _, line := range strings.Split(head, "\r\n") {
+		if v, ok := strings.CutPrefix(line, "Content-Type: "); ok {
+			ctype = v
+		}
+	}
+	mediaType, params, err := mime.ParseMediaType(ctype)
+	require.NoError(t, err)
+	assert.Equal(t, "multipart/byteranges", mediaType)
+
+	mr := multipart.NewReader(strings.NewReader(body), params["boundary"])
+	want := []struct{ contentRange, data string }{
+		{"bytes 0-2/26", "abc"},
+		{"bytes 24-25/26", "yz"},
+	}
+	for _, w := range want {
+		part, err := mr.NextPart()
+		require.NoError(t, err)
+		assert.Equal(t, w.contentRange, part.Header.Get("Content-Range"))
+		assert.Equal(t, "text/plain; charset=utf-8", part.Header.Get("Content-Type"))
+		data, err := io.ReadAll(part)
+		require.NoError(t, err)
+		assert.Equal(t, w.data, string(data))
+	}
+	_, err = mr.NextPart()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestIfRange(t *testing.T) {
+	etag := header.NewHeader()
+	etag.Set("ETag", `"v1"`)
+	h := contentHandler(etag)
+
+	cases := map[string]string{
+		// the client's copy is current, it gets the range
+		`If-Range: "v1"`: "206 Partial Content",
+		"If-Range: Wed, 01 May 2024 12:00:00 GMT": "206 Partial Content",
+		// it changed, the whole content replaces the client's copy
+		`If-Range: "v0"`:                          "200 OK",
+		`If-Range: W/"v1"`:                        "200 OK",
+		"If-Range: Tue, 30 Apr 2024 12:00:00 GMT": "200 OK",
+		"If-Range: not a date":                    "200 OK",
+	}
+	for field, want := range cases {
+		resp := serveWithFields(t, h, "GET", "/", "Range: bytes=0-0\r\n"+field+"\r\n")
+		assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 "+want+"\r\n"), field)
+	}
+}
+
+func TestFileServerRanges(t *testing.T) {
+	resp := serveWithFields(t, FileServerFS(testFS()), "GET", "/hello.txt", "Range: bytes=6-\r\n")
+	head, body := splitResponse(t, resp)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 206 Partial Content\r\n"), head)
+	assert.Contains(t, head, "Content-Range: bytes 6-10/11")
+	assert.Equal(t, "world", body)
+}
@@ -0,0 +1,246 @@
+// Package fileserver serves static files from a directory or any fs.FS
+package fileserver
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/nichol20/http-server/internal/header"
+	"github.com/nichol20/http-server/internal/request"
+	"github.com/nichol20/http-server/internal/response"
+	"github.com/nichol20/http-server/internal/server"
+)
+
+// IndexFile is served for a directory that contains it
+const IndexFile = "index.html"
+
+// sniffLen is how much of a file DetectContentType looks at
+const sniffLen = 512
+
+type config struct {
+	listDirectories bool
+}
+
+type Option func(*config)
+
+// WithDirectoryListing renders an html list of the entries of directories without an index.html.
+// Without it those directories are a 404
+func WithDirectoryListing() Option {
+	return func(c *config) {
+		c.listDirectories = true
+	}
+}
+
+type fileServer struct {
+	fsys fs.FS
+	cfg  config
+}
+
+// FileServer returns a handler serving the files under root on disk. The request path is
+// the path of the file relative to root, use router.StripPrefix to mount it under a prefix.
+// Nothing outside root can be reached, neither with ".." nor through a symlink
+func FileServer(root string, opts ...Option) server.Handler {
+	return FileServerFS(dirFS(root), opts...)
+}
+
+// FileServerFS is like FileServer for the files of fsys, like an embed.FS
+func FileServerFS(fsys fs.FS, opts ...Option) server.Handler {
+	cfg := config{}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return &fileServer{fsys: fsys, cfg: cfg}
+}
+
+func (fsrv *fileServer) ServeHTTP(w *response.Writer, req *request.Request) {
+	if req.RequestLine.Method != "GET" && req.RequestLine.Method != "HEAD" {
+		h := response.GetDefaultHeaders(0)
+		h.Set("Allow", "GET, HEAD")
+		w.WriteRespose(response.StatusMethodNotAllowed, h, nil)
+		return
+	}
+
+	// cleaning a rooted path resolves every ".." without ever going above "/"
+	p := req.URL.Path
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	name := strings.TrimPrefix(path.Clean(p), "/")
+	if name == "" {
+		name = "."
+	}
+	if !fs.ValidPath(name) || strings.Contains(name, "\x00") {
+		w.Error(response.StatusBadRequest, "invalid path")
+		return
+	}
+
+	f, err := fsrv.fsys.Open(name)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+
+	if info.IsDir() {
+		// relative links in the page only work from a path ending with a slash
+		if !strings.HasSuffix(req.URL.Path, "/") {
+			// the name is decoded, it is escaped again so it stays a single path segment
+			target := (&url.URL{Path: path.Base(req.URL.Path) + "/"}).EscapedPath()
+			// a name like "a:b" must not be read as a scheme
+			if strings.Contains(target, ":") {
+				target = "./" + target
+			}
+			redirect(w, req, target)
+			return
+		}
+		index, err := fsrv.fsys.Open(path.Join(name, IndexFile))
+		if err == nil {
+			defer index.Close()
+			indexInfo, err := index.Stat()
+			if err == nil && !indexInfo.IsDir() {
+				serveFile(w, req, IndexFile, indexInfo, index)
+				return
+			}
+		}
+		if !fsrv.cfg.listDirectories {
+			serveError(w, fs.ErrNotExist)
+			return
+		}
+		listDirectory(w, req, f)
+		return
+	}
+	serveFile(w, req, info.Name(), info, f)
+}
+
+// serveFile writes a file, through ServeContent when it can seek so ranges are supported
+func serveFile(w *response.Writer, req *request.Request, name string, info fs.FileInfo, f fs.File) {
+	h := header.NewHeader()
+	h.Set("ETag", FileETag(info))
+	if content, ok := f.(io.ReadSeeker); ok {
+		ServeContent(w, req, h, name, info.ModTime(), content)
+		return
+	}
+
+	if !info.ModTime().IsZero() {
+		h.Set("Last-Modified", info.ModTime().UTC().Format(response.TimeFormat))
+	}
+	if CheckPreconditions(w, req, h, info.ModTime()) {
+		return
+	}
+	h.Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+
+	var content io.Reader = f
+	ctype := mime.TypeByExtension(path.Ext(name))
+	if ctype == "" {
+		buf := make([]byte, sniffLen)
+		n, err := io.ReadFull(f, buf)
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+			serveError(w, err)
+			return
+		}
+		ctype = DetectContentType(buf[:n])
+		// the sniffed bytes still have to be sent
+		content = io.MultiReader(strings.NewReader(string(buf[:n])), f)
+	}
+	h.Set("Content-Type", ctype)
+
+	if !writeHeader(w, response.StatusOK, h) || req.RequestLine.Method == "HEAD" {
+		return
+	}
+	copyBody(w, content, info.Size())
+}
+
+func listDirectory(w *response.Writer, req *request.Request, dir fs.File) {
+	d, ok := dir.(fs.ReadDirFile)
+	if !ok {
+		serveError(w, fs.ErrPermission)
+		return
+	}
+	entries, err := d.ReadDir(-1)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+
+	var b strings.Builder
+	title := html.EscapeString(req.URL.Path)
+	fmt.Fprintf(&b, "<!DOCTYPE html>\n<html>\n<head><title>Index of %s</title></head>\n<body>\n<h1>Index of %s</h1>\n<ul>\n", title, title)
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() {
+			name += "/"
+		}
+		// a name like "a:b" must not be read as a scheme
+		href := (&url.URL{Path: "./" + name}).EscapedPath()
+		fmt.Fprintf(&b, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(href), html.EscapeString(name))
+	}
+	b.WriteString("</ul>\n</body>\n</html>\n")
+
+	h := response.GetDefaultHeaders(b.Len())
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteRespose(response.StatusOK, h, []byte(b.String()))
+}
+
+// redirect sends the client to target, relative to the request path, keeping the query
+func redirect(w *response.Writer, req *request.Request, target string) {
+	if q := req.URL.RawQuery; q != "" {
+		target += "?" + q
+	}
+	w.Redirect(target, response.StatusMovedPermanently)
+}
+
+// serveError answers with the status matching a file system error. The error itself
+// is not sent, it may describe the server's file system
+func serveError(w *response.Writer, err error) {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		w.Error(response.StatusNotFound, "404 page not found")
+	case errors.Is(err, fs.ErrPermission):
+		w.Error(response.StatusForbidden, "403 forbidden")
+	default:
+		w.Error(response.StatusInternalServerError, "500 internal server error")
+	}
+}
+
+// dirFS is os.DirFS that refuses to follow a symlink out of the root
+type dirFS string
+
+func (dir dirFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	root, err := filepath.EvalSymlinks(string(dir))
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	full, err := filepath.EvalSymlinks(filepath.Join(root, filepath.FromSlash(name)))
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	rel, err := filepath.Rel(root, full)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		// reported as missing, whatever is outside root does not exist for the client
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	// a component swapped for a symlink since the check still can't lead out of root
+	return os.OpenInRoot(root, rel)
+}
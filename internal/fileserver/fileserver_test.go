@@ -0,0 +1,160 @@
+package fileserver
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/nichol20/http-server/internal/request"
+	"github.com/nichol20/http-server/internal/response"
+	"github.com/nichol20/http-server/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serve runs a request through h and returns the raw response
+func serve(t *testing.T, h server.Handler, method string, target string) string {
+	t.Helper()
+	return serveWithFields(t, h, method, target, "")
+}
+
+// serveWithFields is serve with extra CRLF terminated field lines in the request
+func serveWithFields(t *testing.T, h server.Handler, method string, target string, fields string) string {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader(method + " " + target + " HTTP/1.1\r\nHost: localhost\r\n" + fields + "\r\n"))
+	require.NoError(t, err)
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	w.SetMethod(method)
+	h.ServeHTTP(w, req)
+	require.NoError(t, w.Finish())
+	return buf.String()
+}
+
+func testFS() fstest.MapFS {
+	return fstest.MapFS{
+		"hello.txt":                  {Data: []byte("hello world"), ModTime: modtime},
+		"style.css":                  {Data: []byte("body {}")},
+		"noext":                      {Data: []byte("\x89PNG\r\n\x1a\nrest")},
+		"docs/index.html":            {Data: []byte("<h1>docs</h1>")},
+		"files/a.txt":                {Data: []byte("a")},
+		"files/sub dir/b.txt":        {Data: []byte("b")},
+		"files/<script>.txt":         {Data: []byte("x")},
+		"empty/.gitkeep":             {Data: []byte("")},
+		"c\r\nSet-Cookie: p=1/x.txt": {Data: []byte("x")},
+		"a?b/x.txt":                  {Data: []byte("x")},
+	}
+}
+
+func TestServeFile(t *testing.T) {
+	h := FileServerFS(testFS())
+
+	// Test: Content-Type from the extension
+	resp := serve(t, h, "GET", "/hello.txt")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"), resp)
+	assert.Contains(t, resp, "Content-Type: text/plain; charset=utf-8\r\n")
+	assert.Contains(t, resp, "Content-Length: 11\r\n")
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\nhello world"), resp)
+
+	resp = serve(t, h, "GET", "/style.css")
+	assert.Contains(t, resp, "Content-Type: text/css; charset=utf-8\r\n")
+
+	// Test: Content-Type from the content, which is still sent whole
+	resp = serve(t, h, "GET", "/noext")
+	assert.Contains(t, resp, "Content-Type: image/png\r\n")
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\n\x89PNG\r\n\x1a\nrest"), resp)
+
+	// Test: HEAD has the header only
+	resp = serve(t, h, "HEAD", "/hello.txt")
+	assert.Contains(t, resp, "Content-Length: 11\r\n")
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\n"), resp)
+
+	// Test: Missing files and other methods
+	assert.Contains(t, serve(t, h, "GET", "/missing.txt"), "404 Not Found")
+	resp = serve(t, h, "POST", "/hello.txt")
+	assert.Contains(t, resp, "405 Method Not Allowed")
+	assert.Contains(t, resp, "Allow: GET, HEAD\r\n")
+}
+
+func TestDirectories(t *testing.T) {
+	h := FileServerFS(testFS())
+
+	// Test: index.html is served for its directory
+	resp := serve(t, h, "GET", "/docs/")
+	assert.Contains(t, resp, "Content-Type: text/html; charset=utf-8\r\n")
+	assert.True(t, strings.HasSuffix(resp, "<h1>docs</h1>"), resp)
+
+	// Test: A directory without its trailing slash is redirected, keeping the query
+	resp = serve(t, h, "GET", "/docs?x=1")
+	assert.Contains(t, resp, "301 Moved Permanently")
+	assert.Contains(t, resp, "Location: docs/?x=1\r\n")
+
+	// Test: The redirect of a directory escapes its name again
+	resp = serve(t, h, "GET", "/c%0d%0aSet-Cookie:%20p=1")
+	assert.Contains(t, resp, "301 Moved Permanently")
+	assert.Contains(t, resp, "Location: ./c%0D%0ASet-Cookie:%20p=1/\r\n")
+	assert.NotContains(t, resp, "\r\nSet-Cookie")
+	resp = serve(t, h, "GET", "/a%3Fb")
+	assert.Contains(t, resp, "Location: a%3Fb/\r\n")
+
+	// Test: No listing unless enabled
+	assert.Contains(t, serve(t, h, "GET", "/files/"), "404 Not Found")
+
+	// Test: Listing, escaped and sorted
+	resp = serve(t, FileServerFS(testFS(), WithDirectoryListing()), "GET", "/files/")
+	assert.Contains(t, resp, "200 OK")
+	assert.Contains(t, resp, `<li><a href="./%3Cscript%3E.txt">&lt;script&gt;.txt</a></li>`)
+	assert.Contains(t, resp, `<li><a href="./sub%20dir/">sub dir/</a></li>`)
+	assert.Less(t, strings.Index(resp, "a.txt"), strings.Index(resp, "sub dir"))
+}
+
+func TestPathSanitization(t *testing.T) {
+	root := t.TempDir()
+	public := filepath.Join(root, "public")
+	require.NoError(t, os.Mkdir(public, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "secret.txt"), []byte("secret"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(public, "page.txt"), []byte("page"), 0o644))
+	require.NoError(t, os.Symlink(filepath.Join(root, "secret.txt"), filepath.Join(public, "link.txt")))
+	require.NoError(t, os.Symlink(filepath.Join(public, "page.txt"), filepath.Join(public, "inside.txt")))
+	h := FileServer(public)
+
+	// Test: A regular file
+	assert.True(t, strings.HasSuffix(serve(t, h, "GET", "/page.txt"), "page"))
+
+	// Test: Dot segments never leave the root
+	for _, target := range []string{"/../secret.txt", "/a/../../secret.txt", "/%2e%2e/secret.txt", "/..%2fsecret.txt"} {
+		resp := serve(t, h, "GET", target)
+		assert.NotContains(t, resp, "\r\n\r\nsecret", target)
+		assert.Contains(t, resp, "404 Not Found", target)
+	}
+
+	// Test: A symlink out of the root is not followed, one inside it is
+	resp := serve(t, h, "GET", "/link.txt")
+	assert.Contains(t, resp, "404 Not Found")
+	assert.NotContains(t, resp, "secret")
+	assert.True(t, strings.HasSuffix(serve(t, h, "GET", "/inside.txt"), "page"))
+}
+
+func TestDetectContentType(t *testing.T) {
+	cases := map[string]string{
+		"":                               "text/plain; charset=utf-8",
+		"just some text":                 "text/plain; charset=utf-8",
+		"  <!DOCTYPE html><html></html>": "text/html; charset=utf-8",
+		"<p>paragraph</p>":               "text/html; charset=utf-8",
+		"<?xml version=\"1.0\"?>":        "text/xml; charset=utf-8",
+		"%PDF-1.7":                       "application/pdf",
+		"GIF89a...":                      "image/gif",
+		"\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom": "video/mp4",
+		"RIFF\x10\x00\x00\x00WEBPVP8 ":                     "image/webp",
+		"\x1F\x8B\x08\x00":                                 "application/x-gzip",
+		"\x00\x01\x02\x03":                                 "application/octet-stream",
+		"caf\xc3":                                          "text/plain; charset=utf-8",
+		"control \x01 byte":                                "application/octet-stream",
+	}
+	for data, want := range cases {
+		assert.Equal(t, want, DetectContentType([]byte(data)), "%q", data)
+	}
+}
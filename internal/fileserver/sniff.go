@@ -0,0 +1,10 @@
+package fileserver
+
+import "net/http"
+
+// DetectContentType guesses the media type of content from its first bytes following the
+// WHATWG MIME Sniffing Standard, at most 512 are looked at. Unknown binary data is
+// "application/octet-stream" and text is "text/plain; charset=utf-8"
+func DetectContentType(data []byte) string {
+	return http.DetectContentType(data)
+}
@@ -1,22 +1,52 @@
 package header
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"regexp"
+	"slices"
 	"strings"
 )
 
 const CRLF = "\r\n"
 
-type Header map[string]string
+var (
+	ErrMalformedFieldLine = errors.New("malformed field line")
+	ErrInvalidFieldName   = errors.New("invalid field name")
+	ErrInvalidFieldValue  = errors.New("invalid field value")
+)
+
+var tokenPattern = regexp.MustCompile(`^[A-Za-z0-9!#$%&'*+\-.\^_` + "`" + `|~]+$`)
+
+// ValidFieldName reports whether name is a token, the only form a field name can take
+func ValidFieldName(name string) bool {
+	return tokenPattern.MatchString(name)
+}
+
+// valueReplacer turns the characters that would end a field line early into spaces,
+// so a value copied from a request can't add field lines of its own
+var valueReplacer = strings.NewReplacer("\r", " ", "\n", " ", "\x00", " ")
+
+// Header holds the fields of a message. Names are case-insensitive, but the case
+// a field was first added with is kept and used when the header is written.
+// Every field line keeps its own value, in the order they were added
+type Header map[string]*field
+
+type field struct {
+	name   string
+	values []string
+	// position of the field in the header, it orders serialization
+	order int
+}
 
 func NewHeader() Header {
 	return Header{}
 }
 
 func (h Header) parseSingle(data []byte) (n int, done bool, err error) {
-	dataStr := string(data)
-	crlfIdx := strings.Index(dataStr, CRLF)
+	// only the line is copied, the rest of data may hold many more
+	crlfIdx := bytes.Index(data, []byte(CRLF))
 	if crlfIdx == -1 {
 		return 0, false, nil
 	}
@@ -24,22 +54,27 @@ func (h Header) parseSingle(data []byte) (n int, done bool, err error) {
 		return len(CRLF), true, nil
 	}
 
-	fieldLine := dataStr[:crlfIdx]
-	fieldLine = strings.Trim(fieldLine, " ")
+	fieldLine := string(data[:crlfIdx])
+	// a line starting with whitespace continues the previous one (obs-fold). Unfolding it
+	// could make a field nobody in front of us saw, it is refused (RFC 9112 section 5.2)
+	if fieldLine[0] == ' ' || fieldLine[0] == '\t' {
+		return 0, false, ErrMalformedFieldLine
+	}
 
 	colIdx := strings.Index(fieldLine, ":")
 	if colIdx == -1 {
-		return 0, false, fmt.Errorf("malformed field line")
+		return 0, false, ErrMalformedFieldLine
 	}
 	fieldName, fieldValue := fieldLine[:colIdx], fieldLine[colIdx+1:]
 
-	pattern := `^[A-Za-z0-9!#$%&'*+\-.\^_` + "`" + `|~]+$`
-	re := regexp.MustCompile(pattern)
-	if !re.MatchString(fieldName) {
-		return 0, false, fmt.Errorf("invalid field name")
+	if !ValidFieldName(fieldName) {
+		return 0, false, ErrInvalidFieldName
+	}
+	if strings.ContainsAny(fieldValue, "\x00\r\n") {
+		return 0, false, ErrInvalidFieldValue
 	}
 
-	h.Set(fieldName, strings.TrimSpace(fieldValue))
+	h.Add(fieldName, strings.Trim(fieldValue, " \t"))
 	return crlfIdx + len(CRLF), false, nil
 }
 
@@ -61,22 +96,42 @@ func (h Header) Parse(data []byte) (n int, done bool, err error) {
 	}
 }
 
+// Get returns the field value, repeated field lines are combined with ", " as RFC 9110
+// section 5.3 allows. Use Values for fields that can't be combined, like Set-Cookie
 func (h Header) Get(key string) string {
-	value, ok := h[strings.ToLower(key)]
+	f, ok := h[strings.ToLower(key)]
 	if !ok {
 		return ""
 	}
-	return value
+	return strings.Join(f.values, ", ")
+}
+
+// Has reports whether the field is present, even with an empty value
+func (h Header) Has(key string) bool {
+	_, ok := h[strings.ToLower(key)]
+	return ok
+}
+
+// Add appends a field line, keeping the ones already there. CR, LF and NUL in value become spaces
+func (h Header) Add(key string, value string) {
+	value = valueReplacer.Replace(value)
+	loweredKey := strings.ToLower(key)
+	if f, exists := h[loweredKey]; exists {
+		f.values = append(f.values, value)
+		return
+	}
+	h[loweredKey] = &field{name: key, values: []string{value}, order: h.nextOrder()}
 }
 
+// Set replaces every line of the field with value. A replaced field keeps its position.
+// CR, LF and NUL in value become spaces
 func (h Header) Set(key string, value string) {
 	loweredKey := strings.ToLower(key)
-	if _, exists := h[loweredKey]; exists {
-		// space between commas is optional
-		h[loweredKey] = fmt.Sprintf("%s, %s", h[loweredKey], value)
-	} else {
-		h[loweredKey] = fmt.Sprintf("%v", value)
+	if f, exists := h[loweredKey]; exists {
+		f.values = []string{valueReplacer.Replace(value)}
+		return
 	}
+	h.Add(key, value)
 }
 
 func (h Header) Del(key string) {
@@ -84,12 +139,125 @@ func (h Header) Del(key string) {
 	delete(h, loweredKey)
 }
 
-func (h Header) Replace(key string, value string) {
-	h.Del(key)
-	h.Set(key, value)
+// Values returns the value of every line of the field, in order. Values are not split
+// on commas, a Set-Cookie value with an Expires date would be cut in half
+func (h Header) Values(key string) []string {
+	f, ok := h[strings.ToLower(key)]
+	if !ok {
+		return nil
+	}
+	return f.values
 }
 
-func (h Header) Values(key string) []string {
-	v := h.Get(key)
-	return strings.Split(v, ", ")
+// HasToken reports whether the comma separated list in the field contains token,
+// ignoring case as required for connection options and codings
+func (h Header) HasToken(key string, token string) bool {
+	for _, line := range h.Values(key) {
+		for _, v := range strings.Split(line, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// connectionFields only make sense for a single HTTP/1 connection, HTTP/2 has its
+// own framing and a message can't carry them there (RFC 9113 section 8.2.2)
+var connectionFields = []string{"connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade"}
+
+// IsConnectionField reports whether name is a field specific to an HTTP/1 connection
+func IsConnectionField(name string) bool {
+	return slices.Contains(connectionFields, strings.ToLower(name))
+}
+
+// DelConnectionFields removes the fields specific to an HTTP/1 connection,
+// along with the ones Connection names
+func (h Header) DelConnectionFields() {
+	for _, line := range h.Values("connection") {
+		for _, name := range strings.Split(line, ",") {
+			h.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range connectionFields {
+		h.Del(name)
+	}
+}
+
+func (h Header) Clone() Header {
+	c := make(Header, len(h))
+	for k, f := range h {
+		c[k] = &field{name: f.name, values: slices.Clone(f.values), order: f.order}
+	}
+	return c
+}
+
+// Names returns the field names in the order they were added, with the case they were added with
+func (h Header) Names() []string {
+	fields := h.sorted()
+	names := make([]string, len(fields))
+	for i, f := range fields {
+		names[i] = f.name
+	}
+	return names
+}
+
+// Append appends the field lines to b in the order they were added, one line per value.
+// With canonical set, names are written in canonical form (see CanonicalKey) instead of the case they were added with.
+// Fields whose name isn't a token are left out, they can't be written safely
+func (h Header) Append(b []byte, canonical bool) []byte {
+	for _, f := range h.sorted() {
+		if !ValidFieldName(f.name) {
+			continue
+		}
+		name := f.name
+		if canonical {
+			name = CanonicalKey(name)
+		}
+		for _, v := range f.values {
+			b = fmt.Appendf(b, "%s: %s\r\n", name, v)
+		}
+	}
+	return b
+}
+
+func (h Header) sorted() []*field {
+	fields := make([]*field, 0, len(h))
+	for k, f := range h {
+		if k != orderKey {
+			fields = append(fields, f)
+		}
+	}
+	slices.SortFunc(fields, func(a, b *field) int {
+		return a.order - b.order
+	})
+	return fields
+}
+
+// orderKey holds the counter of the fields added so far. Keys are lowercased,
+// none can reach it
+const orderKey = "#Order"
+
+func (h Header) nextOrder() int {
+	counter, ok := h[orderKey]
+	if !ok {
+		counter = &field{}
+		h[orderKey] = counter
+	}
+	counter.order++
+	return counter.order
+}
+
+// CanonicalKey returns the canonical form of a field name, the first letter and
+// every letter after a hyphen upper case, the rest lower case. "content-type" becomes "Content-Type"
+func CanonicalKey(key string) string {
+	b := []byte(strings.ToLower(key))
+	upper := true
+	for i, c := range b {
+		if upper && c >= 'a' && c <= 'z' {
+			b[i] = c - ('a' - 'A')
+		}
+		upper = c == '-'
+	}
+	return string(b)
 }
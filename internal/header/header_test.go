@@ -1,6 +1,8 @@
 package header
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -92,4 +94,140 @@ func TestHeaderParse(t *testing.T) {
 	require.Error(t, err)
 	assert.Equal(t, 0, n)
 	assert.False(t, done)
+
+	// Test: A folded line is refused, it isn't taken for a field of its own
+	for _, fold := range []string{" Transfer-Encoding: chunked", "\tTransfer-Encoding: chunked"} {
+		header = NewHeader()
+		_, _, err = header.Parse([]byte("X-Foo: bar\r\n" + fold + "\r\n\r\n"))
+		require.ErrorIs(t, err, ErrMalformedFieldLine)
+		assert.False(t, header.Has("transfer-encoding"))
+	}
+
+	// Test: NUL, CR and LF can't be in a value
+	for _, value := range []string{"a\x00b", "a\rb", "a\nb"} {
+		header = NewHeader()
+		_, _, err = header.Parse([]byte("X-Foo: " + value + "\r\n\r\n"))
+		assert.ErrorIs(t, err, ErrInvalidFieldValue, "%q", value)
+	}
+
+	// Test: Tabs around a value are trimmed like spaces
+	header = NewHeader()
+	_, _, err = header.Parse([]byte("X-Foo:\t bar\t\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "bar", header.Get("x-foo"))
+}
+
+func TestHasToken(t *testing.T) {
+	header := NewHeader()
+	header.Add("Connection", "keep-alive")
+	header.Add("Connection", "Upgrade")
+	assert.True(t, header.HasToken("connection", "upgrade"))
+	assert.True(t, header.HasToken("Connection", "keep-alive"))
+	assert.False(t, header.HasToken("connection", "close"))
+}
+
+func TestMultipleValues(t *testing.T) {
+	// Test: Set-Cookie values are kept apart, commas included
+	header := NewHeader()
+	header.Add("Set-Cookie", "a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT")
+	header.Add("set-cookie", "b=2")
+	assert.Equal(t, []string{"a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT", "b=2"}, header.Values("Set-Cookie"))
+	assert.Nil(t, header.Values("missing"))
+
+	// Test: Set replaces every value but keeps the position of the field
+	header = NewHeader()
+	header.Set("content-type", "text/plain")
+	header.Add("X-Request-Id", "1")
+	header.Set("Content-Type", "text/html")
+	assert.Equal(t, []string{"content-type", "X-Request-Id"}, header.Names())
+	assert.Equal(t, "text/html", header.Get("Content-Type"))
+
+	// Test: Serialization follows insertion order, with original or canonical names
+	header = NewHeader()
+	header.Set("x-b", "1")
+	header.Add("set-cookie", "a=1")
+	header.Add("set-cookie", "b=2")
+	header.Set("X-A", "2")
+	assert.Equal(t, "x-b: 1\r\nset-cookie: a=1\r\nset-cookie: b=2\r\nX-A: 2\r\n", string(header.Append(nil, false)))
+	assert.Equal(t, "X-B: 1\r\nSet-Cookie: a=1\r\nSet-Cookie: b=2\r\nX-A: 2\r\n", string(header.Append(nil, true)))
+
+	// Test: A deleted field added again goes last
+	header.Del("x-b")
+	header.Set("X-B", "3")
+	assert.Equal(t, []string{"set-cookie", "X-A", "X-B"}, header.Names())
+
+	// Test: Parsing keeps every line and the client's casing
+	header = NewHeader()
+	_, done, err := header.Parse([]byte("Cookie: a=1\r\nCOOKIE: b=2\r\n\r\n"))
+	require.NoError(t, err)
+	assert.True(t, done)
+	assert.Equal(t, []string{"a=1", "b=2"}, header.Values("cookie"))
+	assert.Equal(t, []string{"Cookie"}, header.Names())
+
+	// Test: Clone doesn't share values
+	clone := header.Clone()
+	clone.Add("Cookie", "c=3")
+	assert.Len(t, header.Values("cookie"), 2)
+
+	// Test: A clone keeps counting after the fields it copied
+	clone.Add("X-New", "1")
+	assert.Equal(t, []string{"Cookie", "X-New"}, clone.Names())
+}
+
+func TestManyFields(t *testing.T) {
+	// Test: Adding a field doesn't look at the ones already there, a big block parses quickly
+	var block strings.Builder
+	for i := 0; i < 50000; i++ {
+		fmt.Fprintf(&block, "X-%d: v\r\n", i)
+	}
+	block.WriteString("\r\n")
+	header := NewHeader()
+	_, done, err := header.Parse([]byte(block.String()))
+	require.NoError(t, err)
+	assert.True(t, done)
+	names := header.Names()
+	require.Len(t, names, 50000)
+	assert.Equal(t, "X-0", names[0])
+	assert.Equal(t, "X-49999", names[49999])
+}
+
+func TestCanonicalKey(t *testing.T) {
+	assert.Equal(t, "Content-Type", CanonicalKey("content-type"))
+	assert.Equal(t, "X-Content-Sha256", CanonicalKey("X-CONTENT-SHA256"))
+	assert.Equal(t, "Www-Authenticate", CanonicalKey("www-authenticate"))
+}
+
+func TestFieldInjection(t *testing.T) {
+	// Test: CR, LF and NUL in a value can't start a new field line
+	header := NewHeader()
+	header.Set("Location", "/a\r\nSet-Cookie: p=1")
+	header.Add("X-Name", "x\ny\x00z")
+	assert.Equal(t, "Location: /a  Set-Cookie: p=1\r\nX-Name: x y z\r\n", string(header.Append(nil, false)))
+	header.Set("X-Name", "\r\n")
+	assert.Equal(t, "  ", header.Get("X-Name"))
+
+	// Test: A field whose name isn't a token is left out
+	header = NewHeader()
+	header.Set("X-Bad\r\nSet-Cookie", "1")
+	header.Set("X-Good", "2")
+	assert.Equal(t, "X-Good: 2\r\n", string(header.Append(nil, false)))
+	assert.False(t, ValidFieldName("a b"))
+	assert.True(t, ValidFieldName("X-Good"))
+}
+
+func TestConnectionFields(t *testing.T) {
+	// Test: The fields of an HTTP/1 connection are known in any case
+	assert.True(t, IsConnectionField("Transfer-Encoding"))
+	assert.True(t, IsConnectionField("keep-alive"))
+	assert.False(t, IsConnectionField("te"))
+	assert.False(t, IsConnectionField("content-length"))
+
+	// Test: They are removed with the fields Connection names
+	header := NewHeader()
+	header.Set("Connection", "close, X-Hop")
+	header.Set("Keep-Alive", "timeout=5")
+	header.Set("X-Hop", "1")
+	header.Set("Content-Type", "text/plain")
+	header.DelConnectionFields()
+	assert.Equal(t, []string{"Content-Type"}, header.Names())
 }
@@ -0,0 +1,150 @@
+package http2
+
+import (
+	"io"
+	"strings"
+
+	"github.com/nichol20/http-server/internal/header"
+	"github.com/nichol20/http-server/internal/http2/hpack"
+	"github.com/nichol20/http-server/internal/request"
+)
+
+// validFieldName reports whether name is a lowercase token, field names are never uppercase in HTTP/2
+func validFieldName(name string) bool {
+	return header.ValidFieldName(name) && strings.ToLower(name) == name
+}
+
+// validFieldValue rejects the characters that could split a field once it is forwarded
+// as HTTP/1, and whitespace around the value (RFC 9113 section 8.2.1)
+func validFieldValue(value string) bool {
+	if strings.ContainsAny(value, "\x00\r\n") {
+		return false
+	}
+	return value == strings.Trim(value, " \t")
+}
+
+// newRequest builds the request of a new stream from its field section. A malformed
+// section is a StreamError, one the server can answer is a *request.ParseError
+func (c *Conn) newRequest(st *stream, fields []hpack.HeaderField) (*request.Request, error) {
+	malformed := func(format string, args ...any) error {
+		return streamError(st.id, ErrCodeProtocol, "malformed request: "+format, args...)
+	}
+
+	pseudo := map[string]string{}
+	h := header.NewHeader()
+	var cookies []string
+	regular := 0
+	for _, f := range fields {
+		if strings.HasPrefix(f.Name, ":") {
+			if regular > 0 {
+				return nil, malformed("pseudo-header field %s after a regular one", f.Name)
+			}
+			switch f.Name {
+			case ":method", ":scheme", ":path", ":authority":
+			default:
+				return nil, malformed("unknown pseudo-header field %s", f.Name)
+			}
+			if _, ok := pseudo[f.Name]; ok {
+				return nil, malformed("repeated %s", f.Name)
+			}
+			pseudo[f.Name] = f.Value
+			continue
+		}
+		// checked before anything is kept, a huge block must not cost more than the limit
+		regular++
+		if c.limits.MaxHeaderCount > 0 && regular > c.limits.MaxHeaderCount {
+			return nil, request.NewParseError(request.ErrHeaderTooLarge)
+		}
+		if !validFieldName(f.Name) || !validFieldValue(f.Value) {
+			return nil, malformed("invalid field %q", f.Name)
+		}
+		// a request carrying them is malformed (RFC 9113 section 8.2.2)
+		if header.IsConnectionField(f.Name) || (f.Name == "te" && f.Value != "trailers") {
+			return nil, malformed("connection-specific field %s", f.Name)
+		}
+		// cookies may be split in crumbs for better compression (RFC 9113 section 8.2.3)
+		if f.Name == "cookie" {
+			cookies = append(cookies, f.Value)
+			continue
+		}
+		h.Add(f.Name, f.Value)
+	}
+	if len(cookies) > 0 {
+		h.Set("cookie", strings.Join(cookies, "; "))
+	}
+
+	method, path, authority := pseudo[":method"], pseudo[":path"], pseudo[":authority"]
+	target := path
+	if method == "CONNECT" {
+		// the target is the authority, there is nothing else to it (RFC 9113 section 8.5)
+		if _, ok := pseudo[":scheme"]; ok {
+			return nil, malformed("CONNECT with :scheme")
+		}
+		if _, ok := pseudo[":path"]; ok {
+			return nil, malformed("CONNECT with :path")
+		}
+		target = authority
+	} else if method == "" || pseudo[":scheme"] == "" || path == "" {
+		return nil, malformed("missing :method, :scheme or :path")
+	}
+	if authority != "" && h.Has("host") && h.Get("host") != authority {
+		return nil, malformed(":authority and Host disagree")
+	}
+	if c.limits.MaxRequestLineBytes > 0 && len(target) > c.limits.MaxRequestLineBytes {
+		return nil, request.NewParseError(request.ErrURITooLong)
+	}
+
+	if h.Has("content-length") {
+		cl, err := request.ParseContentLength(h.Get("content-length"))
+		if err != nil {
+			return nil, request.NewParseError(err)
+		}
+		if st.remoteClosed && cl != 0 {
+			return nil, malformed("content-length %d without a body", cl)
+		}
+		if c.limits.MaxBodyBytes > 0 && cl > c.limits.MaxBodyBytes {
+			return nil, request.NewParseError(request.ErrBodyTooLarge)
+		}
+		st.contentLength = cl
+	}
+
+	// a typed nil would pass for a body, so the interface stays nil without one
+	var body io.ReadCloser
+	if !st.remoteClosed {
+		st.body = &requestBody{st: st, max: c.limits.MaxBodyBytes}
+		body = st.body
+	}
+	req, err := request.NewRequest(method, target, "2.0", authority, h, body)
+	if err != nil {
+		return nil, err
+	}
+	req.TLS = c.opts.TLS
+	if st.body != nil {
+		st.body.req = req
+	}
+	return req, nil
+}
+
+// processTrailer ends the body of a stream with the fields that follow it
+func (c *Conn) processTrailer(st *stream, fields []hpack.HeaderField, endStream bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if st.remoteClosed {
+		return streamError(st.id, ErrCodeStreamClosed, "HEADERS after the end of the stream")
+	}
+	if !endStream {
+		return streamError(st.id, ErrCodeProtocol, "trailer without END_STREAM")
+	}
+	trailer := header.NewHeader()
+	for _, f := range fields {
+		if strings.HasPrefix(f.Name, ":") || !validFieldName(f.Name) || !validFieldValue(f.Value) {
+			return streamError(st.id, ErrCodeProtocol, "invalid trailer field %q", f.Name)
+		}
+		trailer.Add(f.Name, f.Value)
+	}
+	request.FilterTrailer(trailer)
+	if st.body != nil {
+		st.body.trailer = trailer
+	}
+	return c.endRemoteLocked(st)
+}
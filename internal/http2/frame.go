@@ -0,0 +1,440 @@
+package http2
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ClientPreface starts every HTTP/2 connection, before the client's SETTINGS (RFC 9113 section 3.4)
+const ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+const (
+	frameHeaderLen = 9
+	// the largest frame a peer may send until it is told otherwise, and the smallest limit allowed
+	defaultMaxFrameSize = 1 << 14
+	maxFrameSizeLimit   = 1<<24 - 1
+	defaultWindowSize   = 65535
+	maxWindowSize       = 1<<31 - 1
+)
+
+type FrameType uint8
+
+const (
+	FrameData         FrameType = 0x0
+	FrameHeaders      FrameType = 0x1
+	FramePriority     FrameType = 0x2
+	FrameRSTStream    FrameType = 0x3
+	FrameSettings     FrameType = 0x4
+	FramePushPromise  FrameType = 0x5
+	FramePing         FrameType = 0x6
+	FrameGoAway       FrameType = 0x7
+	FrameWindowUpdate FrameType = 0x8
+	FrameContinuation FrameType = 0x9
+)
+
+var frameNames = map[FrameType]string{
+	FrameData:         "DATA",
+	FrameHeaders:      "HEADERS",
+	FramePriority:     "PRIORITY",
+	FrameRSTStream:    "RST_STREAM",
+	FrameSettings:     "SETTINGS",
+	FramePushPromise:  "PUSH_PROMISE",
+	FramePing:         "PING",
+	FrameGoAway:       "GOAWAY",
+	FrameWindowUpdate: "WINDOW_UPDATE",
+	FrameContinuation: "CONTINUATION",
+}
+
+func (t FrameType) String() string {
+	if name, ok := frameNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN_FRAME_TYPE_%d", uint8(t))
+}
+
+type Flags uint8
+
+const (
+	FlagEndStream  Flags = 0x1
+	FlagAck        Flags = 0x1
+	FlagEndHeaders Flags = 0x4
+	FlagPadded     Flags = 0x8
+	FlagPriority   Flags = 0x20
+)
+
+func (f Flags) Has(flag Flags) bool {
+	return f&flag == flag
+}
+
+// ErrCode is the reason given in RST_STREAM and GOAWAY frames (RFC 9113 section 7)
+type ErrCode uint32
+
+const (
+	ErrCodeNo                 ErrCode = 0x0
+	ErrCodeProtocol           ErrCode = 0x1
+	ErrCodeInternal           ErrCode = 0x2
+	ErrCodeFlowControl        ErrCode = 0x3
+	ErrCodeSettingsTimeout    ErrCode = 0x4
+	ErrCodeStreamClosed       ErrCode = 0x5
+	ErrCodeFrameSize          ErrCode = 0x6
+	ErrCodeRefusedStream      ErrCode = 0x7
+	ErrCodeCancel             ErrCode = 0x8
+	ErrCodeCompression        ErrCode = 0x9
+	ErrCodeConnect            ErrCode = 0xa
+	ErrCodeEnhanceYourCalm    ErrCode = 0xb
+	ErrCodeInadequateSecurity ErrCode = 0xc
+	ErrCodeHTTP11Required     ErrCode = 0xd
+)
+
+var errCodeNames = map[ErrCode]string{
+	ErrCodeNo:                 "NO_ERROR",
+	ErrCodeProtocol:           "PROTOCOL_ERROR",
+	ErrCodeInternal:           "INTERNAL_ERROR",
+	ErrCodeFlowControl:        "FLOW_CONTROL_ERROR",
+	ErrCodeSettingsTimeout:    "SETTINGS_TIMEOUT",
+	ErrCodeStreamClosed:       "STREAM_CLOSED",
+	ErrCodeFrameSize:          "FRAME_SIZE_ERROR",
+	ErrCodeRefusedStream:      "REFUSED_STREAM",
+	ErrCodeCancel:             "CANCEL",
+	ErrCodeCompression:        "COMPRESSION_ERROR",
+	ErrCodeConnect:            "CONNECT_ERROR",
+	ErrCodeEnhanceYourCalm:    "ENHANCE_YOUR_CALM",
+	ErrCodeInadequateSecurity: "INADEQUATE_SECURITY",
+	ErrCodeHTTP11Required:     "HTTP_1_1_REQUIRED",
+}
+
+func (c ErrCode) String() string {
+	if name, ok := errCodeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN_ERROR_CODE_%d", uint32(c))
+}
+
+// ConnectionError ends the whole connection with a GOAWAY
+type ConnectionError struct {
+	Code   ErrCode
+	Reason string
+}
+
+func (e ConnectionError) Error() string {
+	return fmt.Sprintf("http2: connection error %v: %s", e.Code, e.Reason)
+}
+
+// StreamError ends a single stream with a RST_STREAM, the connection goes on
+type StreamError struct {
+	StreamID uint32
+	Code     ErrCode
+	Reason   string
+}
+
+func (e StreamError) Error() string {
+	return fmt.Sprintf("http2: stream %d error %v: %s", e.StreamID, e.Code, e.Reason)
+}
+
+func connError(code ErrCode, format string, args ...any) error {
+	return ConnectionError{Code: code, Reason: fmt.Sprintf(format, args...)}
+}
+
+func streamError(id uint32, code ErrCode, format string, args ...any) error {
+	return StreamError{StreamID: id, Code: code, Reason: fmt.Sprintf(format, args...)}
+}
+
+type SettingID uint16
+
+const (
+	SettingHeaderTableSize      SettingID = 0x1
+	SettingEnablePush           SettingID = 0x2
+	SettingMaxConcurrentStreams SettingID = 0x3
+	SettingInitialWindowSize    SettingID = 0x4
+	SettingMaxFrameSize         SettingID = 0x5
+	SettingMaxHeaderListSize    SettingID = 0x6
+)
+
+type Setting struct {
+	ID  SettingID
+	Val uint32
+}
+
+// Valid checks the values RFC 9113 section 6.5.2 restricts
+func (s Setting) Valid() error {
+	switch s.ID {
+	case SettingEnablePush:
+		if s.Val > 1 {
+			return connError(ErrCodeProtocol, "invalid SETTINGS_ENABLE_PUSH %d", s.Val)
+		}
+	case SettingInitialWindowSize:
+		if s.Val > maxWindowSize {
+			return connError(ErrCodeFlowControl, "SETTINGS_INITIAL_WINDOW_SIZE %d too large", s.Val)
+		}
+	case SettingMaxFrameSize:
+		if s.Val < defaultMaxFrameSize || s.Val > maxFrameSizeLimit {
+			return connError(ErrCodeProtocol, "invalid SETTINGS_MAX_FRAME_SIZE %d", s.Val)
+		}
+	}
+	return nil
+}
+
+// ParseSettings parses the payload of a SETTINGS frame, which is also the value of HTTP2-Settings
+func ParseSettings(p []byte) ([]Setting, error) {
+	if len(p)%6 != 0 {
+		return nil, connError(ErrCodeFrameSize, "SETTINGS payload of %d bytes", len(p))
+	}
+	settings := make([]Setting, 0, len(p)/6)
+	for ; len(p) > 0; p = p[6:] {
+		s := Setting{ID: SettingID(binary.BigEndian.Uint16(p)), Val: binary.BigEndian.Uint32(p[2:])}
+		if err := s.Valid(); err != nil {
+			return nil, err
+		}
+		settings = append(settings, s)
+	}
+	return settings, nil
+}
+
+type FrameHeader struct {
+	Length   uint32
+	Type     FrameType
+	Flags    Flags
+	StreamID uint32
+}
+
+// Frame is a frame as read. Data is the payload without the padding and the priority
+// fields of DATA and HEADERS frames, it is only valid until the next ReadFrame
+type Frame struct {
+	FrameHeader
+	Data []byte
+}
+
+// Settings returns the settings of a SETTINGS frame
+func (f *Frame) Settings() ([]Setting, error) {
+	return ParseSettings(f.Data)
+}
+
+// Increment returns the window size increment of a WINDOW_UPDATE frame
+func (f *Frame) Increment() uint32 {
+	return binary.BigEndian.Uint32(f.Data) & maxWindowSize
+}
+
+// ErrCode returns the error code of a RST_STREAM or GOAWAY frame
+func (f *Frame) ErrCode() ErrCode {
+	if f.Type == FrameGoAway {
+		return ErrCode(binary.BigEndian.Uint32(f.Data[4:]))
+	}
+	return ErrCode(binary.BigEndian.Uint32(f.Data))
+}
+
+// LastStreamID returns the last stream the sender of a GOAWAY frame processed
+func (f *Frame) LastStreamID() uint32 {
+	return binary.BigEndian.Uint32(f.Data) & maxWindowSize
+}
+
+// Framer reads and writes frames. Reads and writes may happen at the same time,
+// but neither of them concurrently with itself
+type Framer struct {
+	r io.Reader
+	w *bufio.Writer
+	// MaxReadSize is the largest frame payload accepted, our SETTINGS_MAX_FRAME_SIZE
+	MaxReadSize uint32
+	header      [frameHeaderLen]byte
+	readBuf     []byte
+	wbuf        []byte
+}
+
+func NewFramer(w io.Writer, r io.Reader) *Framer {
+	return &Framer{
+		r:           r,
+		w:           bufio.NewWriterSize(w, 16<<10),
+		MaxReadSize: defaultMaxFrameSize,
+	}
+}
+
+// ReadFrame reads the next frame and checks its layout. Malformed frames are a
+// ConnectionError, or a StreamError when only their stream is affected
+func (fr *Framer) ReadFrame() (*Frame, error) {
+	if _, err := io.ReadFull(fr.r, fr.header[:]); err != nil {
+		return nil, err
+	}
+	h := FrameHeader{
+		Length:   uint32(fr.header[0])<<16 | uint32(fr.header[1])<<8 | uint32(fr.header[2]),
+		Type:     FrameType(fr.header[3]),
+		Flags:    Flags(fr.header[4]),
+		StreamID: binary.BigEndian.Uint32(fr.header[5:]) & maxWindowSize,
+	}
+	if h.Length > fr.MaxReadSize {
+		return nil, connError(ErrCodeFrameSize, "%v frame of %d bytes over the limit of %d", h.Type, h.Length, fr.MaxReadSize)
+	}
+	if cap(fr.readBuf) < int(h.Length) {
+		fr.readBuf = make([]byte, h.Length)
+	}
+	payload := fr.readBuf[:h.Length]
+	if _, err := io.ReadFull(fr.r, payload); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	f := &Frame{FrameHeader: h, Data: payload}
+	return f, f.check()
+}
+
+// check validates the layout of the frame and strips padding and priority fields
+func (f *Frame) check() error {
+	onStream := f.StreamID != 0
+	switch f.Type {
+	case FrameData, FrameHeaders, FrameContinuation, FramePriority, FrameRSTStream:
+		if !onStream {
+			return connError(ErrCodeProtocol, "%v frame on stream 0", f.Type)
+		}
+	case FrameSettings, FramePing, FrameGoAway:
+		if onStream {
+			return connError(ErrCodeProtocol, "%v frame on stream %d", f.Type, f.StreamID)
+		}
+	}
+
+	switch f.Type {
+	case FrameData, FrameHeaders:
+		if f.Flags.Has(FlagPadded) {
+			if len(f.Data) == 0 || int(f.Data[0]) >= len(f.Data) {
+				return connError(ErrCodeProtocol, "%v frame padding longer than its payload", f.Type)
+			}
+			f.Data = f.Data[1 : len(f.Data)-int(f.Data[0])]
+		}
+		if f.Type == FrameHeaders && f.Flags.Has(FlagPriority) {
+			// priorities are deprecated (RFC 9113 section 5.3.2), they are ignored
+			if len(f.Data) < 5 {
+				return connError(ErrCodeFrameSize, "HEADERS frame too short for its priority")
+			}
+			f.Data = f.Data[5:]
+		}
+	case FramePriority:
+		if len(f.Data) != 5 {
+			return streamError(f.StreamID, ErrCodeFrameSize, "PRIORITY frame of %d bytes", len(f.Data))
+		}
+	case FrameRSTStream:
+		if len(f.Data) != 4 {
+			return connError(ErrCodeFrameSize, "RST_STREAM frame of %d bytes", len(f.Data))
+		}
+	case FrameSettings:
+		if f.Flags.Has(FlagAck) && len(f.Data) != 0 {
+			return connError(ErrCodeFrameSize, "SETTINGS acknowledgment with a payload")
+		}
+		if len(f.Data)%6 != 0 {
+			return connError(ErrCodeFrameSize, "SETTINGS frame of %d bytes", len(f.Data))
+		}
+	case FramePing:
+		if len(f.Data) != 8 {
+			return connError(ErrCodeFrameSize, "PING frame of %d bytes", len(f.Data))
+		}
+	case FrameGoAway:
+		if len(f.Data) < 8 {
+			return connError(ErrCodeFrameSize, "GOAWAY frame of %d bytes", len(f.Data))
+		}
+	case FrameWindowUpdate:
+		if len(f.Data) != 4 {
+			return connError(ErrCodeFrameSize, "WINDOW_UPDATE frame of %d bytes", len(f.Data))
+		}
+	}
+	return nil
+}
+
+// startFrame begins a frame in the write buffer, its length is filled by endFrame
+func (fr *Framer) startFrame(t FrameType, flags Flags, streamID uint32) {
+	fr.wbuf = append(fr.wbuf[:0], 0, 0, 0, byte(t), byte(flags), 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(fr.wbuf[5:], streamID&maxWindowSize)
+}
+
+func (fr *Framer) endFrame() error {
+	n := len(fr.wbuf) - frameHeaderLen
+	if n > maxFrameSizeLimit {
+		return fmt.Errorf("http2: frame payload of %d bytes too large", n)
+	}
+	fr.wbuf[0], fr.wbuf[1], fr.wbuf[2] = byte(n>>16), byte(n>>8), byte(n)
+	_, err := fr.w.Write(fr.wbuf)
+	return err
+}
+
+// WriteData writes a DATA frame, p has to fit the peer's maximum frame size
+func (fr *Framer) WriteData(streamID uint32, endStream bool, p []byte) error {
+	var flags Flags
+	if endStream {
+		flags |= FlagEndStream
+	}
+	fr.startFrame(FrameData, flags, streamID)
+	fr.wbuf = append(fr.wbuf, p...)
+	return fr.endFrame()
+}
+
+// WriteHeaders writes a field block in a HEADERS frame followed by as many
+// CONTINUATION frames as maxFrameSize requires
+func (fr *Framer) WriteHeaders(streamID uint32, endStream bool, block []byte, maxFrameSize uint32) error {
+	t := FrameHeaders
+	for first := true; first || len(block) > 0; first = false {
+		chunk := block[:min(len(block), int(maxFrameSize))]
+		block = block[len(chunk):]
+		var flags Flags
+		if first && endStream {
+			flags |= FlagEndStream
+		}
+		if len(block) == 0 {
+			flags |= FlagEndHeaders
+		}
+		fr.startFrame(t, flags, streamID)
+		fr.wbuf = append(fr.wbuf, chunk...)
+		if err := fr.endFrame(); err != nil {
+			return err
+		}
+		t = FrameContinuation
+	}
+	return nil
+}
+
+func (fr *Framer) WriteSettings(settings ...Setting) error {
+	fr.startFrame(FrameSettings, 0, 0)
+	for _, s := range settings {
+		fr.wbuf = binary.BigEndian.AppendUint16(fr.wbuf, uint16(s.ID))
+		fr.wbuf = binary.BigEndian.AppendUint32(fr.wbuf, s.Val)
+	}
+	return fr.endFrame()
+}
+
+func (fr *Framer) WriteSettingsAck() error {
+	fr.startFrame(FrameSettings, FlagAck, 0)
+	return fr.endFrame()
+}
+
+func (fr *Framer) WritePing(ack bool, data [8]byte) error {
+	var flags Flags
+	if ack {
+		flags |= FlagAck
+	}
+	fr.startFrame(FramePing, flags, 0)
+	fr.wbuf = append(fr.wbuf, data[:]...)
+	return fr.endFrame()
+}
+
+func (fr *Framer) WriteWindowUpdate(streamID uint32, increment uint32) error {
+	fr.startFrame(FrameWindowUpdate, 0, streamID)
+	fr.wbuf = binary.BigEndian.AppendUint32(fr.wbuf, increment&maxWindowSize)
+	return fr.endFrame()
+}
+
+func (fr *Framer) WriteRSTStream(streamID uint32, code ErrCode) error {
+	fr.startFrame(FrameRSTStream, 0, streamID)
+	fr.wbuf = binary.BigEndian.AppendUint32(fr.wbuf, uint32(code))
+	return fr.endFrame()
+}
+
+func (fr *Framer) WriteGoAway(lastStreamID uint32, code ErrCode, debugData []byte) error {
+	fr.startFrame(FrameGoAway, 0, 0)
+	fr.wbuf = binary.BigEndian.AppendUint32(fr.wbuf, lastStreamID&maxWindowSize)
+	fr.wbuf = binary.BigEndian.AppendUint32(fr.wbuf, uint32(code))
+	fr.wbuf = append(fr.wbuf, debugData...)
+	return fr.endFrame()
+}
+
+// Flush sends the frames written so far
+func (fr *Framer) Flush() error {
+	return fr.w.Flush()
+}
@@ -0,0 +1,103 @@
+package http2
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFramer(t *testing.T) {
+	var buf bytes.Buffer
+	fr := NewFramer(&buf, &buf)
+
+	// Test: Written frames read back the same
+	require.NoError(t, fr.WriteData(1, true, []byte("hello")))
+	require.NoError(t, fr.WriteSettings(Setting{ID: SettingInitialWindowSize, Val: 1024}))
+	require.NoError(t, fr.WriteWindowUpdate(3, 100))
+	require.NoError(t, fr.WriteRSTStream(5, ErrCodeCancel))
+	require.NoError(t, fr.WriteGoAway(7, ErrCodeNo, []byte("bye")))
+	require.NoError(t, fr.Flush())
+
+	f, err := fr.ReadFrame()
+	require.NoError(t, err)
+	assert.Equal(t, FrameData, f.Type)
+	assert.Equal(t, uint32(1), f.StreamID)
+	assert.True(t, f.Flags.Has(FlagEndStream))
+	assert.Equal(t, "hello", string(f.Data))
+
+	f, err = fr.ReadFrame()
+	require.NoError(t, err)
+	settings, err := f.Settings()
+	require.NoError(t, err)
+	assert.Equal(t, []Setting{{ID: SettingInitialWindowSize, Val: 1024}}, settings)
+
+	f, err = fr.ReadFrame()
+	require.NoError(t, err)
+	assert.Equal(t, uint32(100), f.Increment())
+
+	f, err = fr.ReadFrame()
+	require.NoError(t, err)
+	assert.Equal(t, ErrCodeCancel, f.ErrCode())
+
+	f, err = fr.ReadFrame()
+	require.NoError(t, err)
+	assert.Equal(t, uint32(7), f.LastStreamID())
+	assert.Equal(t, ErrCodeNo, f.ErrCode())
+
+	// Test: A field block larger than a frame continues in CONTINUATION frames
+	block := bytes.Repeat([]byte{0x82}, 25)
+	require.NoError(t, fr.WriteHeaders(1, true, block, 10))
+	require.NoError(t, fr.Flush())
+	var got []byte
+	for _, want := range []FrameType{FrameHeaders, FrameContinuation, FrameContinuation} {
+		f, err = fr.ReadFrame()
+		require.NoError(t, err)
+		assert.Equal(t, want, f.Type)
+		got = append(got, f.Data...)
+	}
+	assert.True(t, f.Flags.Has(FlagEndHeaders))
+	assert.Equal(t, block, got)
+
+	// Test: Padding and priority fields are stripped
+	buf.Write([]byte{0, 0, 11, byte(FrameHeaders), byte(FlagPadded | FlagPriority | FlagEndHeaders), 0, 0, 0, 1,
+		2, 0, 0, 0, 0, 16, 0x82, 0x84, 0x86, 0, 0})
+	f, err = fr.ReadFrame()
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x82, 0x84, 0x86}, f.Data)
+}
+
+func TestFramerErrors(t *testing.T) {
+	read := func(raw ...byte) error {
+		_, err := NewFramer(nil, bytes.NewReader(raw)).ReadFrame()
+		return err
+	}
+	var ce ConnectionError
+	var se StreamError
+
+	// Test: DATA on stream 0 is a connection error
+	require.True(t, errors.As(read(0, 0, 1, byte(FrameData), 0, 0, 0, 0, 0, 'a'), &ce))
+	assert.Equal(t, ErrCodeProtocol, ce.Code)
+
+	// Test: A frame over the maximum size
+	require.True(t, errors.As(read(0, 0x40, 1, byte(FrameData), 0, 0, 0, 0, 1), &ce))
+	assert.Equal(t, ErrCodeFrameSize, ce.Code)
+
+	// Test: Padding longer than the payload
+	require.True(t, errors.As(read(0, 0, 2, byte(FrameData), byte(FlagPadded), 0, 0, 0, 1, 5, 'a'), &ce))
+	assert.Equal(t, ErrCodeProtocol, ce.Code)
+
+	// Test: A PRIORITY frame of the wrong size only affects its stream
+	require.True(t, errors.As(read(0, 0, 1, byte(FramePriority), 0, 0, 0, 0, 3, 0), &se))
+	assert.Equal(t, uint32(3), se.StreamID)
+	assert.Equal(t, ErrCodeFrameSize, se.Code)
+
+	// Test: Invalid settings values
+	_, err := ParseSettings([]byte{0, byte(SettingEnablePush), 0, 0, 0, 2})
+	assert.True(t, errors.As(err, &ce))
+	_, err = ParseSettings([]byte{0, byte(SettingInitialWindowSize), 0x80, 0, 0, 0})
+	require.True(t, errors.As(err, &ce))
+	assert.Equal(t, ErrCodeFlowControl, ce.Code)
+}
@@ -0,0 +1,157 @@
+package hpack
+
+import "fmt"
+
+// Decoder decodes the field blocks of one direction of a connection, in the order they were sent
+type Decoder struct {
+	table table
+	// maxTableSize is the largest the peer may make the table, the SETTINGS_HEADER_TABLE_SIZE we sent
+	maxTableSize uint32
+	maxStringLen int
+	maxListSize  uint32
+}
+
+// NewDecoder returns a Decoder for a peer told it may use maxTableSize bytes of dynamic table
+func NewDecoder(maxTableSize uint32) *Decoder {
+	return &Decoder{
+		table:        table{maxSize: maxTableSize},
+		maxTableSize: maxTableSize,
+	}
+}
+
+// SetMaxStringLength limits the length of a decoded name or value, 0 means no limit
+func (d *Decoder) SetMaxStringLength(n int) {
+	d.maxStringLen = n
+}
+
+// SetMaxHeaderListSize limits the size of a decoded field section, counted like
+// SETTINGS_MAX_HEADER_LIST_SIZE. 0 means no limit
+func (d *Decoder) SetMaxHeaderListSize(n uint32) {
+	d.maxListSize = n
+}
+
+// Decode decodes a complete field block. A block over the list size is still decoded to keep
+// the dynamic table in sync, its fields are dropped and ErrListSize is returned. Any other
+// error is a DecodingError, after which the decoder can't be used
+func (d *Decoder) Decode(block []byte) ([]HeaderField, error) {
+	var fields []HeaderField
+	var listSize uint32
+	tooLarge := false
+	for p := block; len(p) > 0; {
+		f, rest, ok, err := d.decodeField(p, len(fields) > 0 || listSize > 0)
+		if err != nil {
+			return nil, DecodingError{Err: err}
+		}
+		p = rest
+		if !ok {
+			continue
+		}
+		listSize += f.Size()
+		if d.maxListSize != 0 && listSize > d.maxListSize {
+			tooLarge, fields = true, nil
+		}
+		if !tooLarge {
+			fields = append(fields, f)
+		}
+	}
+	if tooLarge {
+		return nil, ErrListSize
+	}
+	return fields, nil
+}
+
+// decodeField decodes the representation at the start of p. It reports false for a dynamic table
+// size update, which is only allowed before the first field
+func (d *Decoder) decodeField(p []byte, afterField bool) (HeaderField, []byte, bool, error) {
+	b := p[0]
+	switch {
+	case b&0x80 != 0:
+		// indexed field (RFC 7541 section 6.1)
+		i, rest, err := readInt(p, 7)
+		if err != nil {
+			return HeaderField{}, nil, false, err
+		}
+		f, ok := d.table.get(i)
+		if !ok {
+			return HeaderField{}, nil, false, fmt.Errorf("invalid index %d", i)
+		}
+		return f, rest, true, nil
+	case b&0xc0 == 0x40:
+		// literal with incremental indexing (section 6.2.1)
+		f, rest, err := d.decodeLiteral(p, 6)
+		if err != nil {
+			return HeaderField{}, nil, false, err
+		}
+		d.table.add(f)
+		return f, rest, true, nil
+	case b&0xe0 == 0x20:
+		// dynamic table size update (section 6.3)
+		if afterField {
+			return HeaderField{}, nil, false, fmt.Errorf("dynamic table size update after a field")
+		}
+		n, rest, err := readInt(p, 5)
+		if err != nil {
+			return HeaderField{}, nil, false, err
+		}
+		if n > uint64(d.maxTableSize) {
+			return HeaderField{}, nil, false, fmt.Errorf("dynamic table size %d over the limit of %d", n, d.maxTableSize)
+		}
+		d.table.setMaxSize(uint32(n))
+		return HeaderField{}, rest, false, nil
+	default:
+		// literal without indexing (section 6.2.2) or never indexed (section 6.2.3)
+		f, rest, err := d.decodeLiteral(p, 4)
+		f.Sensitive = b&0xf0 == 0x10
+		return f, rest, err == nil, err
+	}
+}
+
+// decodeLiteral decodes a literal field whose name index has an n bit prefix
+func (d *Decoder) decodeLiteral(p []byte, n uint) (HeaderField, []byte, error) {
+	var f HeaderField
+	i, p, err := readInt(p, n)
+	if err != nil {
+		return f, nil, err
+	}
+	if i == 0 {
+		if f.Name, p, err = d.readString(p); err != nil {
+			return f, nil, err
+		}
+	} else {
+		named, ok := d.table.get(i)
+		if !ok {
+			return f, nil, fmt.Errorf("invalid index %d", i)
+		}
+		f.Name = named.Name
+	}
+	f.Value, p, err = d.readString(p)
+	return f, p, err
+}
+
+// readString reads a string literal (RFC 7541 section 5.2)
+func (d *Decoder) readString(p []byte) (string, []byte, error) {
+	if len(p) == 0 {
+		return "", nil, errTruncated
+	}
+	huffman := p[0]&0x80 != 0
+	n, p, err := readInt(p, 7)
+	if err != nil {
+		return "", nil, err
+	}
+	if n > uint64(len(p)) {
+		return "", nil, errTruncated
+	}
+	raw := p[:n]
+	p = p[n:]
+	if !huffman {
+		if d.maxStringLen != 0 && len(raw) > d.maxStringLen {
+			return "", nil, ErrStringLength
+		}
+		return string(raw), p, nil
+	}
+	s, err := HuffmanDecode(nil, raw, d.maxStringLen)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(s), p, nil
+}
@@ -0,0 +1,83 @@
+package hpack
+
+// unindexed are fields whose values rarely repeat, indexing them only evicts useful entries
+var unindexed = map[string]bool{
+	":path":          true,
+	"content-length": true,
+	"content-range":  true,
+	"etag":           true,
+	"last-modified":  true,
+	"location":       true,
+	"set-cookie":     true,
+}
+
+// Encoder encodes the field blocks of one direction of a connection, in the order they are sent
+type Encoder struct {
+	table table
+	// the table size updates to signal at the start of the next block, the smallest
+	// one since the last block and the current one (RFC 7541 section 4.2)
+	pendingUpdate bool
+	minSize       uint32
+}
+
+// NewEncoder returns an Encoder with a dynamic table of DefaultTableSize bytes
+func NewEncoder() *Encoder {
+	return &Encoder{table: table{maxSize: DefaultTableSize}}
+}
+
+// SetMaxDynamicTableSize applies the SETTINGS_HEADER_TABLE_SIZE of the peer. The table never
+// grows past DefaultTableSize, a peer may allow more than it is worth keeping
+func (e *Encoder) SetMaxDynamicTableSize(n uint32) {
+	n = min(n, DefaultTableSize)
+	if n == e.table.maxSize {
+		return
+	}
+	if !e.pendingUpdate || n < e.minSize {
+		e.minSize = n
+	}
+	e.pendingUpdate = true
+	e.table.setMaxSize(n)
+}
+
+// AppendFields appends the field block of fields to dst. Names must be lowercase already
+func (e *Encoder) AppendFields(dst []byte, fields []HeaderField) []byte {
+	if e.pendingUpdate {
+		if e.minSize < e.table.maxSize {
+			dst = appendInt(dst, 0x20, 5, uint64(e.minSize))
+		}
+		dst = appendInt(dst, 0x20, 5, uint64(e.table.maxSize))
+		e.pendingUpdate = false
+	}
+	for _, f := range fields {
+		dst = e.appendField(dst, f)
+	}
+	return dst
+}
+
+func (e *Encoder) appendField(dst []byte, f HeaderField) []byte {
+	i, nameOnly := e.table.search(f)
+	if i != 0 && !nameOnly && !f.Sensitive {
+		return appendInt(dst, 0x80, 7, i)
+	}
+
+	var first byte
+	var n uint
+	indexed := false
+	switch {
+	case f.Sensitive:
+		first, n = 0x10, 4
+	case unindexed[f.Name] || f.Size() > e.table.maxSize:
+		first, n = 0x00, 4
+	default:
+		first, n, indexed = 0x40, 6, true
+	}
+	dst = appendInt(dst, first, n, i)
+	if i == 0 {
+		dst = appendString(dst, f.Name)
+	}
+	dst = appendString(dst, f.Value)
+	if indexed {
+		e.table.add(f)
+	}
+	return dst
+}
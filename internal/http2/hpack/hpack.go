@@ -0,0 +1,181 @@
+// Package hpack implements HPACK (RFC 7541), the compression of HTTP/2 field sections
+package hpack
+
+import (
+	"errors"
+	"fmt"
+)
+
+// DefaultTableSize is the size of the dynamic table until a SETTINGS_HEADER_TABLE_SIZE changes it
+const DefaultTableSize = 4096
+
+var (
+	ErrStringLength = errors.New("hpack: string too long")
+	ErrListSize     = errors.New("hpack: field section too large")
+	errTruncated    = errors.New("hpack: truncated field block")
+	errIntOverflow  = errors.New("hpack: integer overflow")
+)
+
+// HeaderField is a field line. Sensitive fields are never added to a dynamic table,
+// by this encoder or the ones forwarding them
+type HeaderField struct {
+	Name      string
+	Value     string
+	Sensitive bool
+}
+
+// Size is the size of the field in a dynamic table (RFC 7541 section 4.1)
+func (f HeaderField) Size() uint32 {
+	return uint32(len(f.Name) + len(f.Value) + 32)
+}
+
+// DecodingError is a field block that can't be decoded. The dynamic table is out of sync with
+// the peer's after it, so it is a COMPRESSION_ERROR of the whole connection
+type DecodingError struct {
+	Err error
+}
+
+func (e DecodingError) Error() string {
+	return fmt.Sprintf("hpack: decoding error: %v", e.Err)
+}
+
+func (e DecodingError) Unwrap() error {
+	return e.Err
+}
+
+// table is a dynamic table, its newest entry comes first
+type table struct {
+	// entries are kept oldest first, so adding one is an append
+	entries []HeaderField
+	size    uint32
+	maxSize uint32
+}
+
+func (t *table) len() int {
+	return len(t.entries)
+}
+
+// get returns the entry at index i of the combined index space, static table first
+func (t *table) get(i uint64) (HeaderField, bool) {
+	if i == 0 {
+		return HeaderField{}, false
+	}
+	if i <= uint64(len(staticTable)) {
+		return staticTable[i-1], true
+	}
+	i -= uint64(len(staticTable))
+	if i > uint64(t.len()) {
+		return HeaderField{}, false
+	}
+	return t.entries[t.len()-int(i)], true
+}
+
+func (t *table) add(f HeaderField) {
+	f.Sensitive = false
+	t.entries = append(t.entries, f)
+	t.size += f.Size()
+	t.evict()
+}
+
+func (t *table) setMaxSize(n uint32) {
+	t.maxSize = n
+	t.evict()
+}
+
+// evict drops the oldest entries until the table fits. An entry larger than the
+// whole table empties it (RFC 7541 section 4.4)
+func (t *table) evict() {
+	n := 0
+	for t.size > t.maxSize && n < t.len() {
+		t.size -= t.entries[n].Size()
+		n++
+	}
+	if n > 0 {
+		copy(t.entries, t.entries[n:])
+		clear(t.entries[t.len()-n:])
+		t.entries = t.entries[:t.len()-n]
+	}
+}
+
+// search finds the index of f, or of an entry with its name when nameOnly
+func (t *table) search(f HeaderField) (i uint64, nameOnly bool) {
+	for j, e := range staticTable {
+		if e.Name != f.Name {
+			continue
+		}
+		if e.Value == f.Value {
+			return uint64(j + 1), false
+		}
+		if i == 0 {
+			i, nameOnly = uint64(j+1), true
+		}
+	}
+	for j := t.len() - 1; j >= 0; j-- {
+		e := t.entries[j]
+		if e.Name != f.Name {
+			continue
+		}
+		index := uint64(len(staticTable) + t.len() - j)
+		if e.Value == f.Value {
+			return index, false
+		}
+		if i == 0 {
+			i, nameOnly = index, true
+		}
+	}
+	return i, nameOnly
+}
+
+// appendInt appends i with an n bit prefix, the other bits of the first byte are in first
+// (RFC 7541 section 5.1)
+func appendInt(dst []byte, first byte, n uint, i uint64) []byte {
+	max := uint64(1)<<n - 1
+	if i < max {
+		return append(dst, first|byte(i))
+	}
+	dst = append(dst, first|byte(max))
+	i -= max
+	for i >= 128 {
+		dst = append(dst, byte(i&0x7f|0x80))
+		i >>= 7
+	}
+	return append(dst, byte(i))
+}
+
+// readInt reads an integer with an n bit prefix, returning the rest of p
+func readInt(p []byte, n uint) (uint64, []byte, error) {
+	if len(p) == 0 {
+		return 0, p, errTruncated
+	}
+	max := uint64(1)<<n - 1
+	i := uint64(p[0]) & max
+	p = p[1:]
+	if i < max {
+		return i, p, nil
+	}
+	var shift uint
+	for len(p) > 0 {
+		b := p[0]
+		p = p[1:]
+		// no field needs more than 32 bits
+		if shift > 28 {
+			return 0, p, errIntOverflow
+		}
+		i += uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return i, p, nil
+		}
+		shift += 7
+	}
+	return 0, p, errTruncated
+}
+
+// appendString appends s as a string literal, Huffman encoded when that is shorter
+func appendString(dst []byte, s string) []byte {
+	if n := HuffmanEncodedLen(s); n < len(s) {
+		dst = appendInt(dst, 0x80, 7, uint64(n))
+		return AppendHuffman(dst, s)
+	}
+	dst = appendInt(dst, 0, 7, uint64(len(s)))
+	return append(dst, s...)
+}
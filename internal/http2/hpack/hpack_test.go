@@ -0,0 +1,205 @@
+package hpack
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	require.NoError(t, err)
+	return b
+}
+
+func fields(pairs ...string) []HeaderField {
+	var fs []HeaderField
+	for i := 0; i < len(pairs); i += 2 {
+		fs = append(fs, HeaderField{Name: pairs[i], Value: pairs[i+1]})
+	}
+	return fs
+}
+
+func TestInt(t *testing.T) {
+	// Test: The examples of RFC 7541 appendix C.1
+	assert.Equal(t, []byte{0x0a}, appendInt(nil, 0, 5, 10))
+	assert.Equal(t, []byte{0x1f, 0x9a, 0x0a}, appendInt(nil, 0, 5, 1337))
+	assert.Equal(t, []byte{0x2a}, appendInt(nil, 0, 8, 42))
+
+	i, rest, err := readInt([]byte{0x1f, 0x9a, 0x0a, 0xff}, 5)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1337), i)
+	assert.Equal(t, []byte{0xff}, rest)
+
+	// Test: Truncated and overlong integers fail
+	_, _, err = readInt([]byte{0x1f, 0x9a}, 5)
+	assert.Error(t, err)
+	_, _, err = readInt([]byte{0x1f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, 5)
+	assert.Error(t, err)
+}
+
+func TestHuffman(t *testing.T) {
+	// Test: A string of RFC 7541 appendix C.4.1
+	enc := AppendHuffman(nil, "www.example.com")
+	assert.Equal(t, unhex(t, "f1e3 c2e5 f23a 6ba0 ab90 f4ff"), enc)
+	assert.Equal(t, len(enc), HuffmanEncodedLen("www.example.com"))
+	dec, err := HuffmanDecode(nil, enc, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "www.example.com", string(dec))
+
+	// Test: Every octet survives a round trip
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	dec, err = HuffmanDecode(nil, AppendHuffman(nil, string(all)), 0)
+	require.NoError(t, err)
+	assert.Equal(t, all, dec)
+
+	// Test: Padding of a byte or more, or not made of ones, is invalid
+	_, err = HuffmanDecode(nil, append(enc, 0xff), 0)
+	assert.ErrorIs(t, err, ErrInvalidHuffman)
+	_, err = HuffmanDecode(nil, []byte{0x06}, 0) // "0" padded with 110
+	assert.ErrorIs(t, err, ErrInvalidHuffman)
+
+	// Test: EOS can't appear
+	_, err = HuffmanDecode(nil, []byte{0xff, 0xff, 0xff, 0xff}, 0)
+	assert.ErrorIs(t, err, ErrInvalidHuffman)
+
+	// Test: The length limit applies to the decoded string
+	_, err = HuffmanDecode(nil, enc, 10)
+	assert.ErrorIs(t, err, ErrStringLength)
+}
+
+func TestDecodeRequests(t *testing.T) {
+	// Test: The requests of RFC 7541 appendix C.3 and C.4 share a dynamic table, with and without Huffman
+	for _, blocks := range [][]string{
+		{
+			"8286 8441 0f77 7777 2e65 7861 6d70 6c65 2e63 6f6d",
+			"8286 84be 5808 6e6f 2d63 6163 6865",
+			"8287 85bf 400a 6375 7374 6f6d 2d6b 6579 0c63 7573 746f 6d2d 7661 6c75 65",
+		},
+		{
+			"8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff",
+			"8286 84be 5886 a8eb 1064 9cbf",
+			"8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf",
+		},
+	} {
+		d := NewDecoder(DefaultTableSize)
+		got, err := d.Decode(unhex(t, blocks[0]))
+		require.NoError(t, err)
+		assert.Equal(t, fields(":method", "GET", ":scheme", "http", ":path", "/", ":authority", "www.example.com"), got)
+		assert.Equal(t, uint32(57), d.table.size)
+
+		got, err = d.Decode(unhex(t, blocks[1]))
+		require.NoError(t, err)
+		assert.Equal(t, fields(":method", "GET", ":scheme", "http", ":path", "/", ":authority", "www.example.com", "cache-control", "no-cache"), got)
+		assert.Equal(t, uint32(110), d.table.size)
+
+		got, err = d.Decode(unhex(t, blocks[2]))
+		require.NoError(t, err)
+		assert.Equal(t, fields(":method", "GET", ":scheme", "https", ":path", "/index.html", ":authority", "www.example.com", "custom-key", "custom-value"), got)
+		assert.Equal(t, uint32(164), d.table.size)
+	}
+}
+
+func TestDecodeResponses(t *testing.T) {
+	// Test: The responses of RFC 7541 appendix C.6 evict entries from a 256 byte table
+	d := NewDecoder(256)
+	got, err := d.Decode(unhex(t, "4882 6402 5885 aec3 771a 4b61 96d0 7abe 9410 54d4 44a8 2005 9504 0b81 66e0 82a6 2d1b ff6e 919d 29ad 1718 63c7 8f0b 97c8 e9ae 82ae 43d3"))
+	require.NoError(t, err)
+	assert.Equal(t, fields(":status", "302", "cache-control", "private", "date", "Mon, 21 Oct 2013 20:13:21 GMT", "location", "https://www.example.com"), got)
+	assert.Equal(t, uint32(222), d.table.size)
+
+	got, err = d.Decode(unhex(t, "4883 640e ffc1 c0bf"))
+	require.NoError(t, err)
+	assert.Equal(t, fields(":status", "307", "cache-control", "private", "date", "Mon, 21 Oct 2013 20:13:21 GMT", "location", "https://www.example.com"), got)
+	assert.Equal(t, uint32(222), d.table.size)
+
+	got, err = d.Decode(unhex(t, "88c1 6196 d07a be94 1054 d444 a820 0595 040b 8166 e084 a62d 1bff c05a 839b d9ab 77ad 94e7 821d d7f2 e6c7 b335 dfdf cd5b 3960 d5af 2708 7f36 72c1 ab27 0fb5 291f 9587 3160 65c0 03ed 4ee5 b106 3d50 07"))
+	require.NoError(t, err)
+	assert.Equal(t, fields(":status", "200", "cache-control", "private", "date", "Mon, 21 Oct 2013 20:13:22 GMT", "location", "https://www.example.com",
+		"content-encoding", "gzip", "set-cookie", "foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1"), got)
+	assert.Equal(t, uint32(215), d.table.size)
+	assert.Equal(t, 3, d.table.len())
+}
+
+func TestDecodeErrors(t *testing.T) {
+	// Test: Index 0 and indexes past the tables are errors
+	for _, block := range []string{"80", "be", "7e00"} {
+		_, err := NewDecoder(DefaultTableSize).Decode(unhex(t, block))
+		assert.ErrorAs(t, err, &DecodingError{}, block)
+	}
+
+	// Test: Truncated literals are errors
+	_, err := NewDecoder(DefaultTableSize).Decode(unhex(t, "400a 6375"))
+	assert.ErrorAs(t, err, &DecodingError{})
+
+	// Test: A table size update must come first and stay under the announced limit
+	_, err = NewDecoder(DefaultTableSize).Decode(unhex(t, "823f e11f"))
+	assert.ErrorAs(t, err, &DecodingError{})
+	_, err = NewDecoder(100).Decode(unhex(t, "3f e11f"))
+	assert.ErrorAs(t, err, &DecodingError{})
+	d := NewDecoder(DefaultTableSize)
+	got, err := d.Decode(unhex(t, "20 82"))
+	require.NoError(t, err)
+	assert.Equal(t, fields(":method", "GET"), got)
+	assert.Equal(t, uint32(0), d.table.maxSize)
+
+	// Test: A section over the list size is dropped but still fills the table
+	d = NewDecoder(DefaultTableSize)
+	d.SetMaxHeaderListSize(40)
+	_, err = d.Decode(unhex(t, "400a 6375 7374 6f6d 2d6b 6579 0c63 7573 746f 6d2d 7661 6c75 65"))
+	assert.ErrorIs(t, err, ErrListSize)
+	assert.Equal(t, 1, d.table.len())
+
+	// Test: Strings over the length limit are errors
+	d = NewDecoder(DefaultTableSize)
+	d.SetMaxStringLength(5)
+	_, err = d.Decode(unhex(t, "400a 6375 7374 6f6d 2d6b 6579 0c63 7573 746f 6d2d 7661 6c75 65"))
+	assert.ErrorIs(t, err, ErrStringLength)
+}
+
+func TestEncoder(t *testing.T) {
+	e := NewEncoder()
+	d := NewDecoder(DefaultTableSize)
+	sections := [][]HeaderField{
+		fields(":status", "200", "content-type", "text/html", "server", "nichol20", "content-length", "1234"),
+		fields(":status", "200", "content-type", "text/html", "server", "nichol20", "content-length", "99"),
+		{{Name: ":status", Value: "404"}, {Name: "authorization", Value: "secret", Sensitive: true}},
+	}
+
+	// Test: Every section decodes to what was encoded
+	var sizes []int
+	for _, section := range sections {
+		block := e.AppendFields(nil, section)
+		sizes = append(sizes, len(block))
+		got, err := d.Decode(block)
+		require.NoError(t, err)
+		assert.Equal(t, section, got)
+	}
+
+	// Test: Repeated fields come from the dynamic table
+	assert.Less(t, sizes[1], sizes[0]/2)
+
+	// Test: Sensitive fields and volatile ones stay out of it
+	for _, f := range e.table.entries {
+		assert.NotEqual(t, "authorization", f.Name)
+		assert.NotEqual(t, "content-length", f.Name)
+	}
+
+	// Test: A smaller table is announced at the start of the next block, and the peer follows
+	e.SetMaxDynamicTableSize(0)
+	e.SetMaxDynamicTableSize(64)
+	block := e.AppendFields(nil, sections[0])
+	assert.Equal(t, []byte{0x20, 0x3f, 0x21}, block[:3])
+	got, err := d.Decode(block)
+	require.NoError(t, err)
+	assert.Equal(t, sections[0], got)
+	assert.Equal(t, uint32(64), d.table.maxSize)
+	assert.Equal(t, d.table.entries, e.table.entries)
+}
@@ -0,0 +1,97 @@
+package hpack
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrInvalidHuffman = errors.New("hpack: invalid Huffman encoded string")
+
+// huffmanNode is a node of the decoding tree, a leaf when it has no children
+type huffmanNode struct {
+	children [2]*huffmanNode
+	sym      byte
+}
+
+var (
+	huffmanOnce sync.Once
+	huffmanRoot *huffmanNode
+)
+
+func huffmanTree() *huffmanNode {
+	huffmanOnce.Do(func() {
+		huffmanRoot = &huffmanNode{}
+		for sym, code := range huffmanCodes {
+			n := huffmanRoot
+			for i := int(huffmanCodeLens[sym]) - 1; i >= 0; i-- {
+				bit := code >> i & 1
+				if n.children[bit] == nil {
+					n.children[bit] = &huffmanNode{}
+				}
+				n = n.children[bit]
+			}
+			n.sym = byte(sym)
+		}
+	})
+	return huffmanRoot
+}
+
+// HuffmanEncodedLen is the length of s once Huffman encoded
+func HuffmanEncodedLen(s string) int {
+	bits := 0
+	for i := 0; i < len(s); i++ {
+		bits += int(huffmanCodeLens[s[i]])
+	}
+	return (bits + 7) / 8
+}
+
+// AppendHuffman appends s Huffman encoded to dst, padded with the most significant bits of EOS
+func AppendHuffman(dst []byte, s string) []byte {
+	var cur uint64
+	var bits uint
+	for i := 0; i < len(s); i++ {
+		cur = cur<<huffmanCodeLens[s[i]] | uint64(huffmanCodes[s[i]])
+		bits += uint(huffmanCodeLens[s[i]])
+		for bits >= 8 {
+			bits -= 8
+			dst = append(dst, byte(cur>>bits))
+		}
+	}
+	if bits > 0 {
+		dst = append(dst, byte(cur<<(8-bits))|0xff>>bits)
+	}
+	return dst
+}
+
+// HuffmanDecode decodes a Huffman encoded string. It fails past maxLen bytes when maxLen is not 0.
+// The padding has to be shorter than a byte and all ones, and EOS can't appear (RFC 7541 section 5.2)
+func HuffmanDecode(dst []byte, src []byte, maxLen int) ([]byte, error) {
+	root := huffmanTree()
+	n := root
+	// bits read since the last symbol, and whether they were all ones
+	pad, ones := 0, true
+	for _, b := range src {
+		for i := 7; i >= 0; i-- {
+			bit := b >> i & 1
+			n = n.children[bit]
+			if n == nil {
+				// only EOS leads out of the tree
+				return dst, ErrInvalidHuffman
+			}
+			pad++
+			ones = ones && bit == 1
+			if n.children[0] != nil || n.children[1] != nil {
+				continue
+			}
+			if maxLen != 0 && len(dst) == maxLen {
+				return dst, ErrStringLength
+			}
+			dst = append(dst, n.sym)
+			n, pad, ones = root, 0, true
+		}
+	}
+	if pad > 7 || !ones {
+		return dst, ErrInvalidHuffman
+	}
+	return dst, nil
+}
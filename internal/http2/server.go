@@ -0,0 +1,822 @@
+// Package http2 serves HTTP/2 connections (RFC 9113). Each stream is a request handed to a
+// Handler with a response.Writer, the same way HTTP/1.1 requests are
+package http2
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/nichol20/http-server/internal/http2/hpack"
+	"github.com/nichol20/http-server/internal/request"
+	"github.com/nichol20/http-server/internal/response"
+)
+
+// DefaultMaxConcurrentStreams is how many streams a client may have open at once by default
+const DefaultMaxConcurrentStreams = 100
+
+const (
+	// the receive windows we give clients, larger than the default 64KB so an upload
+	// isn't held back by round trips
+	streamWindowSize = 256 << 10
+	connWindowSize   = 1 << 20
+	// largest compressed field block accepted when MaxHeaderBytes is disabled
+	maxHeaderBlockBytes = 16 << 20
+)
+
+var (
+	errConnClosed    = errors.New("http2: connection closed")
+	errStreamReset   = errors.New("http2: stream reset")
+	errStreamEnded   = errors.New("http2: stream already ended")
+	errWindowTimeout = errors.New("http2: timed out waiting for the flow control window")
+)
+
+// Server holds the configuration shared by HTTP/2 connections
+type Server struct {
+	// Handler serves the request of each stream on its own goroutine. The response must be
+	// finished with Writer.Finish, a stream whose response didn't end is reset
+	Handler request.Handler
+	// ErrorHandler answers a request that can't be served, like one with an invalid :path.
+	// err is a *request.ParseError. Defaults to a plain text body with its message
+	ErrorHandler func(w *response.Writer, statusCode response.StatusCode, err error)
+	// MaxConcurrentStreams limits the streams a client may have open at once,
+	// DefaultMaxConcurrentStreams when zero
+	MaxConcurrentStreams uint32
+	// Limits bounds the request of each stream, MaxRequestLineBytes applies to the :path.
+	// Zero fields use their defaults, see request.Limits
+	Limits request.Limits
+	// IdleTimeout closes a connection without streams for that long. Zero or negative means no timeout
+	IdleTimeout time.Duration
+	// WriteTimeout bounds every write to the connection and every wait for the client to open
+	// its flow control windows, a client that stops reading can't hold the streams forever.
+	// Zero or negative means no timeout
+	WriteTimeout time.Duration
+	// Logger receives the panics of handlers. Defaults to log.Default()
+	Logger *log.Logger
+}
+
+// ConnOptions describes how a connection came to speak HTTP/2
+type ConnOptions struct {
+	// Reader reads the connection, with whatever was read from it already. The connection when nil
+	Reader io.Reader
+	// TLS is the state of a TLS connection, requests get it in Request.TLS
+	TLS *tls.ConnectionState
+	// Upgrade is the HTTP/1.1 request of an "Upgrade: h2c", it is served as stream 1.
+	// Its body must have been read
+	Upgrade *request.Request
+	// Settings is the payload of the HTTP2-Settings field of the upgrade request
+	Settings []byte
+	// StateChanged is called when the connection goes idle, without any stream or handler,
+	// and when it stops being idle
+	StateChanged func(idle bool)
+}
+
+// Conn is a single HTTP/2 connection
+type Conn struct {
+	srv        *Server
+	nc         net.Conn
+	opts       ConnOptions
+	fr         *Framer
+	limits     request.Limits
+	maxStreams uint32
+
+	// wmu serializes frame writes. The encoder is only used under it, its
+	// dynamic table depends on the order the blocks are sent in
+	wmu      sync.Mutex
+	enc      *hpack.Encoder
+	hbuf     []byte
+	writeErr error
+
+	mu sync.Mutex
+	// cond is broadcast whenever a body gets data or a stream ends
+	cond *sync.Cond
+	// done is closed with the connection and windowGrew is replaced every time a send
+	// window grows. reserve waits on channels so its wait can time out
+	done       chan struct{}
+	windowGrew chan struct{}
+	streams    map[uint32]*stream
+	// handlers still running, a stream may be closed before its handler returned
+	running      int
+	idle         bool
+	lastStreamID uint32
+	// flow control of what we send, and of what the client may still send
+	sendWindow        int64
+	peerInitialWindow int64
+	peerMaxFrameSize  uint32
+	recvWindow        int64
+	recvUnacked       int64
+	goAwaySent        bool
+	closed            bool
+	// the GOAWAY of a Shutdown can't come before our SETTINGS, it waits for Serve to send them
+	started      bool
+	shutdownSoon bool
+
+	// owned by the read loop
+	dec          *hpack.Decoder
+	sawSettings  bool
+	headerStream uint32
+	headerEnd    bool
+	headerBlock  []byte
+}
+
+// NewConn prepares nc to be served as an HTTP/2 connection, see Conn.Serve
+func (s *Server) NewConn(nc net.Conn, opts ConnOptions) *Conn {
+	if opts.Reader == nil {
+		opts.Reader = nc
+	}
+	c := &Conn{
+		srv:               s,
+		nc:                nc,
+		opts:              opts,
+		fr:                NewFramer(nc, opts.Reader),
+		limits:            s.Limits.WithDefaults(),
+		maxStreams:        s.MaxConcurrentStreams,
+		enc:               hpack.NewEncoder(),
+		streams:           map[uint32]*stream{},
+		idle:              true,
+		sendWindow:        defaultWindowSize,
+		peerInitialWindow: defaultWindowSize,
+		peerMaxFrameSize:  defaultMaxFrameSize,
+		recvWindow:        connWindowSize,
+		done:              make(chan struct{}),
+		windowGrew:        make(chan struct{}),
+		dec:               hpack.NewDecoder(hpack.DefaultTableSize),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	if c.maxStreams == 0 {
+		c.maxStreams = DefaultMaxConcurrentStreams
+	}
+	if c.limits.MaxHeaderBytes > 0 {
+		c.dec.SetMaxHeaderListSize(uint32(c.limits.MaxHeaderBytes))
+		c.dec.SetMaxStringLength(c.limits.MaxHeaderBytes)
+	}
+	return c
+}
+
+func (c *Conn) logf(format string, args ...any) {
+	logger := c.srv.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
+	logger.Printf(format, args...)
+}
+
+// Serve reads the frames of the connection until it closes. It returns the error that
+// ended the connection, nil when the client closed it or it stayed idle for too long
+func (c *Conn) Serve() error {
+	defer c.close()
+
+	settings := []Setting{
+		{ID: SettingMaxConcurrentStreams, Val: c.maxStreams},
+		{ID: SettingInitialWindowSize, Val: streamWindowSize},
+	}
+	if c.limits.MaxHeaderBytes > 0 {
+		settings = append(settings, Setting{ID: SettingMaxHeaderListSize, Val: uint32(c.limits.MaxHeaderBytes)})
+	}
+	err := c.writeFrames(true, func(fr *Framer) error {
+		if err := fr.WriteSettings(settings...); err != nil {
+			return err
+		}
+		return fr.WriteWindowUpdate(0, connWindowSize-defaultWindowSize)
+	})
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.started = true
+	shutdown := c.shutdownSoon
+	c.mu.Unlock()
+	if shutdown {
+		c.Shutdown()
+	}
+
+	c.setIdleDeadline()
+	preface := make([]byte, len(ClientPreface))
+	if _, err := io.ReadFull(c.opts.Reader, preface); err != nil {
+		return err
+	}
+	if string(preface) != ClientPreface {
+		err := connError(ErrCodeProtocol, "invalid connection preface")
+		c.goAway(ErrCodeProtocol)
+		return err
+	}
+	if c.opts.Upgrade != nil {
+		if err := c.serveUpgrade(); err != nil {
+			c.goAway(ErrCodeProtocol)
+			return err
+		}
+	}
+
+	for {
+		f, err := c.fr.ReadFrame()
+		if err == nil {
+			err = c.processFrame(f)
+		}
+		if err == nil {
+			continue
+		}
+		var se StreamError
+		if errors.As(err, &se) {
+			c.resetStream(se.StreamID, se.Code)
+			continue
+		}
+		var ce ConnectionError
+		if errors.As(err, &ce) {
+			c.goAway(ce.Code)
+			return err
+		}
+		// the connection stayed idle too long, timeouts are only set while it has no stream
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			c.goAway(ErrCodeNo)
+			return nil
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		return err
+	}
+}
+
+// Shutdown tells the client with a GOAWAY that no new stream will be served.
+// The connection closes once the streams it has are done
+func (c *Conn) Shutdown() {
+	c.mu.Lock()
+	if !c.started {
+		c.shutdownSoon = true
+		c.mu.Unlock()
+		return
+	}
+	c.mu.Unlock()
+	c.goAway(ErrCodeNo)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.idle {
+		c.nc.Close()
+	}
+}
+
+// goAway sends a GOAWAY with the last stream that will be served. New streams are ignored after it
+func (c *Conn) goAway(code ErrCode) {
+	c.mu.Lock()
+	if c.goAwaySent && code == ErrCodeNo {
+		c.mu.Unlock()
+		return
+	}
+	c.goAwaySent = true
+	lastStreamID := c.lastStreamID
+	c.mu.Unlock()
+	c.writeFrames(true, func(fr *Framer) error {
+		return fr.WriteGoAway(lastStreamID, code, nil)
+	})
+}
+
+// close ends every stream still open, their handlers fail on their next read or write
+func (c *Conn) close() {
+	c.mu.Lock()
+	if !c.closed {
+		close(c.done)
+	}
+	c.closed = true
+	for _, st := range c.streams {
+		st.failBody(io.ErrUnexpectedEOF)
+	}
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	c.nc.Close()
+}
+
+// writeFrames writes frames with the write lock held, flushing them when asked
+func (c *Conn) writeFrames(flush bool, write func(fr *Framer) error) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.writeErr != nil {
+		return c.writeErr
+	}
+	if c.srv.WriteTimeout > 0 {
+		c.nc.SetWriteDeadline(time.Now().Add(c.srv.WriteTimeout))
+	}
+	err := write(c.fr)
+	if err == nil && flush {
+		err = c.fr.Flush()
+	}
+	if err != nil {
+		// a connection that failed a write is of no use, reading it stops too
+		c.writeErr = err
+		c.nc.Close()
+	}
+	return err
+}
+
+func (c *Conn) flush() error {
+	return c.writeFrames(true, func(*Framer) error { return nil })
+}
+
+// setIdleDeadline sets the read deadline of IdleTimeout, or clears it when the connection is busy
+func (c *Conn) setIdleDeadline() {
+	if c.srv.IdleTimeout <= 0 {
+		return
+	}
+	if c.idle {
+		c.nc.SetReadDeadline(time.Now().Add(c.srv.IdleTimeout))
+	} else {
+		c.nc.SetReadDeadline(time.Time{})
+	}
+}
+
+// updateIdleLocked tracks whether the connection is idle, closing it when it was shutting down
+func (c *Conn) updateIdleLocked() {
+	idle := len(c.streams) == 0 && c.running == 0
+	if idle == c.idle || c.closed {
+		return
+	}
+	c.idle = idle
+	c.setIdleDeadline()
+	if c.opts.StateChanged != nil {
+		c.opts.StateChanged(idle)
+	}
+	if idle && c.goAwaySent {
+		c.nc.Close()
+	}
+}
+
+func (c *Conn) processFrame(f *Frame) error {
+	// a field block is a single unit, nothing may come between its frames
+	if c.headerStream != 0 && (f.Type != FrameContinuation || f.StreamID != c.headerStream) {
+		return connError(ErrCodeProtocol, "%v frame in the middle of a field block", f.Type)
+	}
+	if !c.sawSettings {
+		if f.Type != FrameSettings || f.Flags.Has(FlagAck) {
+			return connError(ErrCodeProtocol, "connection preface without SETTINGS")
+		}
+		c.sawSettings = true
+	}
+
+	switch f.Type {
+	case FrameData:
+		return c.processData(f)
+	case FrameHeaders:
+		return c.processHeaders(f)
+	case FrameContinuation:
+		return c.processContinuation(f)
+	case FramePriority:
+		// priorities are deprecated (RFC 9113 section 5.3.2)
+		return nil
+	case FrameRSTStream:
+		return c.processRSTStream(f)
+	case FrameSettings:
+		return c.processSettings(f)
+	case FramePushPromise:
+		return connError(ErrCodeProtocol, "PUSH_PROMISE from a client")
+	case FramePing:
+		if f.Flags.Has(FlagAck) {
+			return nil
+		}
+		data := [8]byte(f.Data)
+		return c.writeFrames(true, func(fr *Framer) error {
+			return fr.WritePing(true, data)
+		})
+	case FrameGoAway:
+		// the client won't open streams anymore, the ones it has are still served
+		return nil
+	case FrameWindowUpdate:
+		return c.processWindowUpdate(f)
+	}
+	// unknown frame types are ignored (RFC 9113 section 4.1)
+	return nil
+}
+
+func (c *Conn) processSettings(f *Frame) error {
+	if f.Flags.Has(FlagAck) {
+		return nil
+	}
+	settings, err := f.Settings()
+	if err != nil {
+		return err
+	}
+	if err := c.applySettings(settings); err != nil {
+		return err
+	}
+	return c.writeFrames(true, func(fr *Framer) error {
+		return fr.WriteSettingsAck()
+	})
+}
+
+func (c *Conn) applySettings(settings []Setting) error {
+	for _, s := range settings {
+		switch s.ID {
+		case SettingHeaderTableSize:
+			c.wmu.Lock()
+			c.enc.SetMaxDynamicTableSize(s.Val)
+			c.wmu.Unlock()
+		case SettingInitialWindowSize:
+			// the change applies to the windows of every open stream (RFC 9113 section 6.9.2)
+			c.mu.Lock()
+			delta := int64(s.Val) - c.peerInitialWindow
+			c.peerInitialWindow = int64(s.Val)
+			for _, st := range c.streams {
+				st.sendWindow += delta
+				if st.sendWindow > maxWindowSize {
+					c.mu.Unlock()
+					return connError(ErrCodeFlowControl, "window of stream %d over the limit", st.id)
+				}
+			}
+			c.windowGrewLocked()
+			c.mu.Unlock()
+		case SettingMaxFrameSize:
+			c.mu.Lock()
+			c.peerMaxFrameSize = s.Val
+			c.mu.Unlock()
+		}
+	}
+	return nil
+}
+
+func (c *Conn) processWindowUpdate(f *Frame) error {
+	inc := int64(f.Increment())
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if f.StreamID == 0 {
+		if inc == 0 {
+			return connError(ErrCodeProtocol, "WINDOW_UPDATE of 0 on the connection")
+		}
+		c.sendWindow += inc
+		if c.sendWindow > maxWindowSize {
+			return connError(ErrCodeFlowControl, "connection window over the limit")
+		}
+		c.windowGrewLocked()
+		return nil
+	}
+
+	st := c.streams[f.StreamID]
+	if st == nil {
+		if f.StreamID > c.lastStreamID {
+			return connError(ErrCodeProtocol, "WINDOW_UPDATE on idle stream %d", f.StreamID)
+		}
+		// the stream is closed, the update came too late to matter
+		return nil
+	}
+	if inc == 0 {
+		return streamError(st.id, ErrCodeProtocol, "WINDOW_UPDATE of 0")
+	}
+	st.sendWindow += inc
+	if st.sendWindow > maxWindowSize {
+		return streamError(st.id, ErrCodeFlowControl, "stream window over the limit")
+	}
+	c.windowGrewLocked()
+	return nil
+}
+
+// windowGrewLocked wakes the writers waiting in reserve
+func (c *Conn) windowGrewLocked() {
+	close(c.windowGrew)
+	c.windowGrew = make(chan struct{})
+}
+
+func (c *Conn) processRSTStream(f *Frame) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if f.StreamID > c.lastStreamID {
+		return connError(ErrCodeProtocol, "RST_STREAM on idle stream %d", f.StreamID)
+	}
+	if st := c.streams[f.StreamID]; st != nil {
+		c.resetLocked(st)
+	}
+	return nil
+}
+
+// resetStream ends a stream with a RST_STREAM
+func (c *Conn) resetStream(id uint32, code ErrCode) {
+	c.mu.Lock()
+	if st := c.streams[id]; st != nil {
+		c.resetLocked(st)
+	}
+	c.mu.Unlock()
+	c.writeFrames(true, func(fr *Framer) error {
+		return fr.WriteRSTStream(id, code)
+	})
+}
+
+// resetLocked closes both sides of a stream at once. What its body held is given back
+// to the connection window, nobody will read it
+func (c *Conn) resetLocked(st *stream) {
+	st.reset = true
+	st.localClosed, st.remoteClosed = true, true
+	if st.body != nil {
+		c.giveBackLocked(nil, int64(st.body.buf.Len()))
+		st.body.buf.Reset()
+	}
+	st.failBody(errStreamReset)
+	c.closeStreamLocked(st)
+}
+
+// closeStreamLocked forgets a stream once both its sides are closed
+func (c *Conn) closeStreamLocked(st *stream) {
+	delete(c.streams, st.id)
+	select {
+	case <-st.done:
+	default:
+		close(st.done)
+	}
+	c.cond.Broadcast()
+	c.updateIdleLocked()
+}
+
+func (c *Conn) processHeaders(f *Frame) error {
+	if f.StreamID%2 == 0 {
+		return connError(ErrCodeProtocol, "HEADERS on even stream %d", f.StreamID)
+	}
+	c.headerStream = f.StreamID
+	c.headerEnd = f.Flags.Has(FlagEndStream)
+	c.headerBlock = append(c.headerBlock[:0], f.Data...)
+	if f.Flags.Has(FlagEndHeaders) {
+		return c.endHeaders()
+	}
+	return c.checkHeaderBlock()
+}
+
+func (c *Conn) processContinuation(f *Frame) error {
+	if c.headerStream == 0 {
+		return connError(ErrCodeProtocol, "CONTINUATION without HEADERS")
+	}
+	c.headerBlock = append(c.headerBlock, f.Data...)
+	if f.Flags.Has(FlagEndHeaders) {
+		return c.endHeaders()
+	}
+	return c.checkHeaderBlock()
+}
+
+// checkHeaderBlock stops a client from piling up CONTINUATION frames
+func (c *Conn) checkHeaderBlock() error {
+	limit := maxHeaderBlockBytes
+	if c.limits.MaxHeaderBytes > 0 {
+		limit = min(limit, 2*c.limits.MaxHeaderBytes)
+	}
+	if len(c.headerBlock) > limit {
+		return connError(ErrCodeEnhanceYourCalm, "field block over %d bytes", limit)
+	}
+	return nil
+}
+
+// endHeaders decodes a complete field block, which opens a stream or holds the trailer of one
+func (c *Conn) endHeaders() error {
+	id, endStream := c.headerStream, c.headerEnd
+	c.headerStream = 0
+	// the block is decoded even when it won't be used, the dynamic table must follow the client's
+	fields, err := c.dec.Decode(c.headerBlock)
+	tooLarge := errors.Is(err, hpack.ErrListSize)
+	if err != nil && !tooLarge {
+		return connError(ErrCodeCompression, "%v", err)
+	}
+
+	c.mu.Lock()
+	st := c.streams[id]
+	if st != nil {
+		c.mu.Unlock()
+		if tooLarge {
+			return streamError(id, ErrCodeProtocol, "trailer too large")
+		}
+		return c.processTrailer(st, fields, endStream)
+	}
+	if id <= c.lastStreamID {
+		c.mu.Unlock()
+		return streamError(id, ErrCodeStreamClosed, "HEADERS on closed stream")
+	}
+	c.lastStreamID = id
+	// streams opened after a GOAWAY are ignored, the client retries them elsewhere
+	if c.goAwaySent {
+		c.mu.Unlock()
+		return nil
+	}
+	if len(c.streams) >= int(c.maxStreams) {
+		c.mu.Unlock()
+		return streamError(id, ErrCodeRefusedStream, "too many concurrent streams")
+	}
+	st = &stream{
+		c:             c,
+		id:            id,
+		sendWindow:    c.peerInitialWindow,
+		recvWindow:    streamWindowSize,
+		remoteClosed:  endStream,
+		contentLength: -1,
+		done:          make(chan struct{}),
+	}
+	c.mu.Unlock()
+
+	var req *request.Request
+	if tooLarge {
+		err = request.NewParseError(request.ErrHeaderTooLarge)
+	} else {
+		req, err = c.newRequest(st, fields)
+	}
+	var parseErr *request.ParseError
+	if err != nil && !errors.As(err, &parseErr) {
+		return err
+	}
+
+	c.mu.Lock()
+	c.streams[id] = st
+	c.running++
+	c.updateIdleLocked()
+	c.mu.Unlock()
+
+	w := response.NewStreamWriter(st)
+	if parseErr != nil {
+		go c.runError(st, w, parseErr)
+		return nil
+	}
+	w.SetMethod(req.RequestLine.Method)
+	if st.body != nil && req.ExpectsContinue() {
+		st.body.onRead = func() error {
+			if w.StatusWritten() {
+				return nil
+			}
+			return w.WriteInterim(100, nil)
+		}
+	}
+	go c.runHandler(st, w, req)
+	return nil
+}
+
+func (c *Conn) processData(f *Frame) error {
+	// padding counts for flow control too
+	n := int64(f.Length)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n > c.recvWindow {
+		return connError(ErrCodeFlowControl, "DATA beyond the connection window")
+	}
+	c.recvWindow -= n
+
+	st := c.streams[f.StreamID]
+	if st == nil || st.remoteClosed {
+		c.giveBackLocked(nil, n)
+		if f.StreamID > c.lastStreamID {
+			return connError(ErrCodeProtocol, "DATA on idle stream %d", f.StreamID)
+		}
+		return streamError(f.StreamID, ErrCodeStreamClosed, "DATA on closed stream")
+	}
+	if n > st.recvWindow {
+		c.giveBackLocked(nil, n)
+		return streamError(st.id, ErrCodeFlowControl, "DATA beyond the stream window")
+	}
+	st.recvWindow -= n
+
+	st.received += int64(len(f.Data))
+	if st.contentLength >= 0 && st.received > st.contentLength {
+		c.giveBackLocked(nil, n)
+		return streamError(st.id, ErrCodeProtocol, "body longer than its content-length")
+	}
+	// the body of a request that got an error response has no reader
+	if st.body == nil {
+		c.giveBackLocked(nil, n)
+	} else if err := st.body.push(f.Data); err != nil {
+		// nobody will read it, the connection window gets it back at once
+		c.giveBackLocked(nil, n)
+	} else {
+		// the padding is consumed right away, from both windows
+		c.giveBackLocked(st, n-int64(len(f.Data)))
+	}
+	if f.Flags.Has(FlagEndStream) {
+		return c.endRemoteLocked(st)
+	}
+	return nil
+}
+
+// endRemoteLocked closes the client side of a stream, ending its body
+func (c *Conn) endRemoteLocked(st *stream) error {
+	if st.contentLength >= 0 && st.received != st.contentLength {
+		return streamError(st.id, ErrCodeProtocol, "body shorter than its content-length")
+	}
+	st.remoteClosed = true
+	st.failBody(io.EOF)
+	if st.localClosed {
+		c.closeStreamLocked(st)
+	}
+	return nil
+}
+
+// giveBackLocked counts n bytes as consumed by st, or by the connection alone when st is nil.
+// The windows are given back with a WINDOW_UPDATE once half of them were used
+func (c *Conn) giveBackLocked(st *stream, n int64) {
+	if n <= 0 {
+		return
+	}
+	var connInc, streamInc int64
+	c.recvUnacked += n
+	if c.recvUnacked >= connWindowSize/2 {
+		connInc = c.recvUnacked
+		c.recvWindow += connInc
+		c.recvUnacked = 0
+	}
+	if st != nil && !st.remoteClosed {
+		st.recvUnacked += n
+		if st.recvUnacked >= streamWindowSize/2 {
+			streamInc = st.recvUnacked
+			st.recvWindow += streamInc
+			st.recvUnacked = 0
+		}
+	}
+	if connInc == 0 && streamInc == 0 {
+		return
+	}
+	id := uint32(0)
+	if st != nil {
+		id = st.id
+	}
+	// the read loop may hold c.mu, the frames are written without it
+	go c.writeFrames(true, func(fr *Framer) error {
+		if connInc > 0 {
+			if err := fr.WriteWindowUpdate(0, uint32(connInc)); err != nil {
+				return err
+			}
+		}
+		if streamInc > 0 {
+			return fr.WriteWindowUpdate(id, uint32(streamInc))
+		}
+		return nil
+	})
+}
+
+// serveUpgrade serves the request of an "Upgrade: h2c" as stream 1, whose client side is closed
+func (c *Conn) serveUpgrade() error {
+	settings, err := ParseSettings(c.opts.Settings)
+	if err != nil {
+		return err
+	}
+	if err := c.applySettings(settings); err != nil {
+		return err
+	}
+	req := c.opts.Upgrade
+	for _, name := range []string{"Connection", "Upgrade", "HTTP2-Settings"} {
+		req.Header.Del(name)
+	}
+	req.RequestLine.HttpVersion = "2.0"
+
+	c.mu.Lock()
+	st := &stream{c: c, id: 1, sendWindow: c.peerInitialWindow, remoteClosed: true, contentLength: -1, done: make(chan struct{})}
+	c.lastStreamID = 1
+	c.streams[1] = st
+	c.running++
+	c.updateIdleLocked()
+	c.mu.Unlock()
+
+	w := response.NewStreamWriter(st)
+	w.SetMethod(req.RequestLine.Method)
+	go c.runHandler(st, w, req)
+	return nil
+}
+
+func (c *Conn) runHandler(st *stream, w *response.Writer, req *request.Request) {
+	defer c.handlerDone(st)
+	defer func() {
+		if v := recover(); v != nil {
+			c.logf("panic serving stream %d of %s: %v\n%s", st.id, c.nc.RemoteAddr(), v, debug.Stack())
+		}
+	}()
+	c.srv.Handler.ServeHTTP(w, req)
+}
+
+// runError answers a request that can't be served
+func (c *Conn) runError(st *stream, w *response.Writer, err *request.ParseError) {
+	defer c.handlerDone(st)
+	if c.srv.ErrorHandler != nil {
+		c.srv.ErrorHandler(w, err.StatusCode, err)
+	} else {
+		w.Error(err.StatusCode, err.Message)
+	}
+	w.Finish()
+}
+
+// handlerDone resets a stream whose response didn't end. When the client is still sending
+// a body nobody will read, it is told to stop without an error (RFC 9113 section 8.1)
+func (c *Conn) handlerDone(st *stream) {
+	c.mu.Lock()
+	code, reset := ErrCodeNo, false
+	if !st.reset {
+		switch {
+		case !st.localClosed:
+			code, reset = ErrCodeInternal, true
+			c.resetLocked(st)
+		case !st.remoteClosed:
+			reset = true
+			c.resetLocked(st)
+		}
+	}
+	c.mu.Unlock()
+	if reset {
+		c.writeFrames(true, func(fr *Framer) error {
+			return fr.WriteRSTStream(st.id, code)
+		})
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.running--
+	c.updateIdleLocked()
+}
@@ -0,0 +1,448 @@
+package http2
+
+import (
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nichol20/http-server/internal/header"
+	"github.com/nichol20/http-server/internal/http2/hpack"
+	"github.com/nichol20/http-server/internal/request"
+	"github.com/nichol20/http-server/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testClient speaks HTTP/2 to a Conn served over a loopback connection
+type testClient struct {
+	t    *testing.T
+	nc   net.Conn
+	conn *Conn
+	fr   *Framer
+	enc  *hpack.Encoder
+	dec  *hpack.Decoder
+	done chan error
+}
+
+func newTestClient(t *testing.T, s *Server, settings ...Setting) *testClient {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	c := &testClient{t: t, enc: hpack.NewEncoder(), dec: hpack.NewDecoder(hpack.DefaultTableSize), done: make(chan error, 1)}
+	accepted := make(chan *Conn, 1)
+	go func() {
+		nc, err := ln.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		conn := s.NewConn(nc, ConnOptions{})
+		accepted <- conn
+		c.done <- conn.Serve()
+	}()
+	c.nc, err = net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	c.conn = <-accepted
+	require.NotNil(t, c.conn)
+	t.Cleanup(func() { c.nc.Close() })
+	c.nc.SetDeadline(time.Now().Add(5 * time.Second))
+	c.fr = NewFramer(c.nc, c.nc)
+
+	_, err = io.WriteString(c.nc, ClientPreface)
+	require.NoError(t, err)
+	require.NoError(t, c.fr.WriteSettings(settings...))
+	require.NoError(t, c.fr.Flush())
+	f := c.next(FrameSettings)
+	assert.False(t, f.Flags.Has(FlagAck))
+	require.NoError(t, c.fr.WriteSettingsAck())
+	require.NoError(t, c.fr.Flush())
+	return c
+}
+
+// next reads frames until one of type t, skipping the ones that only manage the connection
+func (c *testClient) next(t FrameType) *Frame {
+	c.t.Helper()
+	for {
+		f, err := c.fr.ReadFrame()
+		require.NoError(c.t, err)
+		if f.Type == t && !(t == FrameSettings && f.Flags.Has(FlagAck)) {
+			return f
+		}
+		switch f.Type {
+		case FrameSettings, FrameWindowUpdate, FramePing:
+			continue
+		}
+		require.Failf(c.t, "unexpected frame", "got %v on stream %d, want %v", f.Type, f.StreamID, t)
+	}
+}
+
+func (c *testClient) writeHeaders(id uint32, endStream bool, pairs ...string) {
+	c.t.Helper()
+	var fields []hpack.HeaderField
+	for i := 0; i < len(pairs); i += 2 {
+		fields = append(fields, hpack.HeaderField{Name: pairs[i], Value: pairs[i+1]})
+	}
+	require.NoError(c.t, c.fr.WriteHeaders(id, endStream, c.enc.AppendFields(nil, fields), defaultMaxFrameSize))
+	require.NoError(c.t, c.fr.Flush())
+}
+
+func (c *testClient) writeData(id uint32, endStream bool, data string) {
+	c.t.Helper()
+	require.NoError(c.t, c.fr.WriteData(id, endStream, []byte(data)))
+	require.NoError(c.t, c.fr.Flush())
+}
+
+// readHeaders reads the next field block, which is on stream id
+func (c *testClient) readHeaders(id uint32) (map[string]string, bool) {
+	c.t.Helper()
+	f := c.next(FrameHeaders)
+	require.Equal(c.t, id, f.StreamID)
+	require.True(c.t, f.Flags.Has(FlagEndHeaders))
+	fields, err := c.dec.Decode(f.Data)
+	require.NoError(c.t, err)
+	h := map[string]string{}
+	for _, field := range fields {
+		h[field.Name] = field.Value
+	}
+	return h, f.Flags.Has(FlagEndStream)
+}
+
+// readBody reads DATA frames of stream id until its end
+func (c *testClient) readBody(id uint32) string {
+	c.t.Helper()
+	var body strings.Builder
+	for {
+		f := c.next(FrameData)
+		require.Equal(c.t, id, f.StreamID)
+		body.Write(f.Data)
+		if f.Flags.Has(FlagEndStream) {
+			return body.String()
+		}
+	}
+}
+
+func discardLogger() *log.Logger {
+	return log.New(io.Discard, "", 0)
+}
+
+var echoHandler = request.HandlerFunc(func(w *response.Writer, req *request.Request) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		w.Error(400, err.Error())
+		w.Finish()
+		return
+	}
+	h := response.GetDefaultHeaders(len(body))
+	h.Set("X-Method", req.RequestLine.Method)
+	h.Set("X-Target", req.RequestLine.RequestTarget)
+	h.Set("X-Host", req.Host)
+	h.Set("X-Cookie", req.Header.Get("Cookie"))
+	if req.Trailer != nil {
+		h.Set("X-Trailer", req.Trailer.Get("Checksum"))
+	}
+	w.WriteRespose(200, h, body)
+	w.Finish()
+})
+
+func TestServeStreams(t *testing.T) {
+	c := newTestClient(t, &Server{Handler: echoHandler})
+
+	// Test: A GET without a body
+	c.writeHeaders(1, true, ":method", "GET", ":scheme", "http", ":authority", "example.com",
+		":path", "/hello?x=1", "cookie", "a=1", "cookie", "b=2")
+	h, end := c.readHeaders(1)
+	assert.False(t, end)
+	assert.Equal(t, "200", h[":status"])
+	assert.Equal(t, "GET", h["x-method"])
+	assert.Equal(t, "/hello?x=1", h["x-target"])
+	assert.Equal(t, "example.com", h["x-host"])
+	assert.Equal(t, "a=1; b=2", h["x-cookie"])
+	assert.Equal(t, "0", h["content-length"])
+	_, ok := h["connection"]
+	assert.False(t, ok)
+	assert.Equal(t, "", c.readBody(1))
+
+	// Test: A POST whose body comes in several frames, with a trailer
+	c.writeHeaders(3, false, ":method", "POST", ":scheme", "http", ":authority", "example.com", ":path", "/echo")
+	c.writeData(3, false, "hello ")
+	c.writeData(3, false, "world")
+	c.writeHeaders(3, true, "checksum", "abc")
+	h, _ = c.readHeaders(3)
+	assert.Equal(t, "11", h["content-length"])
+	assert.Equal(t, "abc", h["x-trailer"])
+	assert.Equal(t, "hello world", c.readBody(3))
+
+	// Test: PING is acknowledged with the same data
+	require.NoError(t, c.fr.WritePing(false, [8]byte{1, 2, 3}))
+	require.NoError(t, c.fr.Flush())
+	f := c.next(FramePing)
+	assert.True(t, f.Flags.Has(FlagAck))
+	assert.Equal(t, []byte{1, 2, 3, 0, 0, 0, 0, 0}, f.Data)
+}
+
+func TestConcurrentStreams(t *testing.T) {
+	release := make(chan struct{})
+	handler := request.HandlerFunc(func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/wait" {
+			<-release
+		}
+		w.WriteRespose(200, response.GetDefaultHeaders(len(req.RequestLine.RequestTarget)), []byte(req.RequestLine.RequestTarget))
+		w.Finish()
+	})
+	c := newTestClient(t, &Server{Handler: handler, MaxConcurrentStreams: 2})
+
+	// Test: A slow stream doesn't hold back the next one
+	c.writeHeaders(1, true, ":method", "GET", ":scheme", "http", ":path", "/wait")
+	c.writeHeaders(3, true, ":method", "GET", ":scheme", "http", ":path", "/fast")
+	h, _ := c.readHeaders(3)
+	assert.Equal(t, "200", h[":status"])
+	assert.Equal(t, "/fast", c.readBody(3))
+
+	// Test: Streams beyond the limit are refused
+	c.writeHeaders(5, true, ":method", "GET", ":scheme", "http", ":path", "/wait")
+	c.writeHeaders(7, true, ":method", "GET", ":scheme", "http", ":path", "/wait")
+	f := c.next(FrameRSTStream)
+	assert.Equal(t, uint32(7), f.StreamID)
+	assert.Equal(t, ErrCodeRefusedStream, f.ErrCode())
+
+	close(release)
+	for range 2 {
+		f := c.next(FrameHeaders)
+		c.dec.Decode(f.Data)
+		c.readBody(f.StreamID)
+	}
+}
+
+func TestFlowControl(t *testing.T) {
+	body := strings.Repeat("x", 25)
+	handler := request.HandlerFunc(func(w *response.Writer, req *request.Request) {
+		w.WriteRespose(200, response.GetDefaultHeaders(len(body)), []byte(body))
+		w.Finish()
+	})
+	c := newTestClient(t, &Server{Handler: handler}, Setting{ID: SettingInitialWindowSize, Val: 10})
+
+	// Test: The response stops at the stream window and goes on once it opens
+	c.writeHeaders(1, true, ":method", "GET", ":scheme", "http", ":path", "/")
+	c.readHeaders(1)
+	f := c.next(FrameData)
+	assert.Equal(t, 10, len(f.Data))
+	assert.False(t, f.Flags.Has(FlagEndStream))
+
+	require.NoError(t, c.fr.WriteWindowUpdate(1, 100))
+	require.NoError(t, c.fr.Flush())
+	assert.Equal(t, body[10:], c.readBody(1))
+
+	// Test: Data beyond the window the server gave is a flow control error
+	c.writeHeaders(3, false, ":method", "POST", ":scheme", "http", ":path", "/")
+	big := strings.Repeat("y", defaultMaxFrameSize)
+	for sent := 0; sent <= streamWindowSize; sent += len(big) {
+		require.NoError(t, c.fr.WriteData(3, false, []byte(big)))
+	}
+	require.NoError(t, c.fr.Flush())
+	for {
+		f = c.next(FrameRSTStream)
+		if f.StreamID == 3 {
+			break
+		}
+	}
+	assert.Equal(t, ErrCodeFlowControl, f.ErrCode())
+}
+
+func TestPaddedUpload(t *testing.T) {
+	c := newTestClient(t, &Server{Handler: echoHandler})
+
+	// Test: The padding is given back to the stream window, an upload in padded frames
+	// goes well past the window
+	c.writeHeaders(1, false, ":method", "POST", ":scheme", "http", ":path", "/")
+	const frames = 2 * streamWindowSize / 256
+	var raw []byte
+	for i := 0; i < frames; i++ {
+		flags := FlagPadded
+		if i == frames-1 {
+			flags |= FlagEndStream
+		}
+		raw = append(raw, 0, 1, 0, byte(FrameData), byte(flags), 0, 0, 0, 1, 254, 'x')
+		raw = append(raw, make([]byte, 254)...)
+	}
+	go c.nc.Write(raw)
+	h, _ := c.readHeaders(1)
+	assert.Equal(t, "200", h[":status"])
+	assert.Equal(t, strings.Repeat("x", frames), c.readBody(1))
+}
+
+func TestFlowControlStall(t *testing.T) {
+	body := strings.Repeat("x", 25)
+	errs := make(chan error, 1)
+	handler := request.HandlerFunc(func(w *response.Writer, req *request.Request) {
+		err := w.WriteRespose(200, response.GetDefaultHeaders(len(body)), []byte(body))
+		if err == nil {
+			err = w.Finish()
+		}
+		errs <- err
+	})
+
+	// Test: A client that never opens the window gets the stream reset after WriteTimeout
+	c := newTestClient(t, &Server{Handler: handler, WriteTimeout: 50 * time.Millisecond}, Setting{ID: SettingInitialWindowSize, Val: 10})
+	c.writeHeaders(1, true, ":method", "GET", ":scheme", "http", ":path", "/")
+	c.readHeaders(1)
+	assert.Equal(t, 10, len(c.next(FrameData).Data))
+	f := c.next(FrameRSTStream)
+	assert.Equal(t, uint32(1), f.StreamID)
+	assert.ErrorIs(t, <-errs, errWindowTimeout)
+
+	// Test: Without a timeout, closing the connection releases the handler
+	c = newTestClient(t, &Server{Handler: handler}, Setting{ID: SettingInitialWindowSize, Val: 10})
+	c.writeHeaders(1, true, ":method", "GET", ":scheme", "http", ":path", "/")
+	c.readHeaders(1)
+	assert.Equal(t, 10, len(c.next(FrameData).Data))
+	c.nc.Close()
+	select {
+	case err := <-errs:
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handler is still waiting for the window")
+	}
+}
+
+func TestMalformedRequests(t *testing.T) {
+	c := newTestClient(t, &Server{Handler: echoHandler, Limits: request.Limits{MaxRequestLineBytes: 20}})
+
+	cases := []struct {
+		name   string
+		fields []string
+	}{
+		{"Uppercase field name", []string{":method", "GET", ":scheme", "http", ":path", "/", "X-Upper", "1"}},
+		{"Connection-specific field", []string{":method", "GET", ":scheme", "http", ":path", "/", "connection", "close"}},
+		{"Missing :path", []string{":method", "GET", ":scheme", "http"}},
+		{"Pseudo-header after a regular field", []string{":method", "GET", "accept", "*/*", ":scheme", "http", ":path", "/"}},
+		{"Unknown pseudo-header", []string{":method", "GET", ":scheme", "http", ":path", "/", ":protocol", "x"}},
+		{"Content-length without a body", []string{":method", "POST", ":scheme", "http", ":path", "/", "content-length", "3"}},
+	}
+	id := uint32(1)
+	for _, tc := range cases {
+		// Test: A malformed request resets its stream
+		c.writeHeaders(id, true, tc.fields...)
+		f := c.next(FrameRSTStream)
+		assert.Equal(t, id, f.StreamID, tc.name)
+		assert.Equal(t, ErrCodeProtocol, f.ErrCode(), tc.name)
+		id += 2
+	}
+
+	// Test: A request over the limits is answered with an error status
+	c.writeHeaders(id, true, ":method", "GET", ":scheme", "http", ":path", "/"+strings.Repeat("a", 30))
+	h, _ := c.readHeaders(id)
+	assert.Equal(t, "414", h[":status"])
+	c.readBody(id)
+
+	// Test: Too many fields are refused as soon as the limit is passed
+	id += 2
+	fields := []string{":method", "GET", ":scheme", "http", ":path", "/"}
+	for i := 0; i < 25000; i++ {
+		fields = append(fields, "x-a", "")
+	}
+	c.writeHeaders(id, true, fields...)
+	h, _ = c.readHeaders(id)
+	assert.Equal(t, "431", h[":status"])
+	c.readBody(id)
+
+	// Test: HEADERS on a closed stream
+	c.writeHeaders(1, true, ":method", "GET", ":scheme", "http", ":path", "/")
+	f := c.next(FrameRSTStream)
+	assert.Equal(t, ErrCodeStreamClosed, f.ErrCode())
+}
+
+func TestHandlerWithoutResponse(t *testing.T) {
+	handler := request.HandlerFunc(func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/panic" {
+			panic("boom")
+		}
+		h := header.NewHeader()
+		h.Set("Content-Length", "10")
+		w.WriteStatusLine(200)
+		w.WriteHeader(h)
+		w.WriteBody([]byte("short"))
+		w.Finish()
+	})
+	c := newTestClient(t, &Server{Handler: handler, Logger: discardLogger()})
+
+	// Test: A body shorter than its content-length resets the stream
+	c.writeHeaders(1, true, ":method", "GET", ":scheme", "http", ":path", "/")
+	c.readHeaders(1)
+	assert.Equal(t, "short", string(c.next(FrameData).Data))
+	f := c.next(FrameRSTStream)
+	assert.Equal(t, ErrCodeInternal, f.ErrCode())
+
+	// Test: A panic only resets its stream
+	c.writeHeaders(3, true, ":method", "GET", ":scheme", "http", ":path", "/panic")
+	f = c.next(FrameRSTStream)
+	assert.Equal(t, uint32(3), f.StreamID)
+	assert.Equal(t, ErrCodeInternal, f.ErrCode())
+}
+
+func TestConnectionErrors(t *testing.T) {
+	// Test: A frame interrupting a field block ends the connection
+	c := newTestClient(t, &Server{Handler: echoHandler})
+	// a HEADERS frame without END_HEADERS
+	c.fr.startFrame(FrameHeaders, FlagEndStream, 1)
+	c.fr.wbuf = append(c.fr.wbuf, 0x82)
+	require.NoError(t, c.fr.endFrame())
+	require.NoError(t, c.fr.WriteData(1, true, nil))
+	require.NoError(t, c.fr.Flush())
+	f := c.next(FrameGoAway)
+	assert.Equal(t, ErrCodeProtocol, f.ErrCode())
+	var ce ConnectionError
+	assert.ErrorAs(t, <-c.done, &ce)
+
+	// Test: A block the decoder can't read is a compression error
+	c = newTestClient(t, &Server{Handler: echoHandler})
+	require.NoError(t, c.fr.WriteHeaders(1, true, []byte{0xff}, defaultMaxFrameSize))
+	require.NoError(t, c.fr.Flush())
+	f = c.next(FrameGoAway)
+	assert.Equal(t, ErrCodeCompression, f.ErrCode())
+}
+
+func TestShutdown(t *testing.T) {
+	release := make(chan struct{})
+	handler := request.HandlerFunc(func(w *response.Writer, req *request.Request) {
+		<-release
+		w.WriteRespose(200, response.GetDefaultHeaders(2), []byte("ok"))
+		w.Finish()
+	})
+	c := newTestClient(t, &Server{Handler: handler})
+	c.writeHeaders(1, true, ":method", "GET", ":scheme", "http", ":path", "/")
+
+	// Test: Shutdown announces the last stream, which is still served
+	require.Eventually(t, func() bool {
+		c.conn.mu.Lock()
+		defer c.conn.mu.Unlock()
+		return c.conn.running == 1
+	}, time.Second, time.Millisecond)
+	c.conn.Shutdown()
+	f := c.next(FrameGoAway)
+	assert.Equal(t, uint32(1), f.LastStreamID())
+	assert.Equal(t, ErrCodeNo, f.ErrCode())
+
+	// Test: Streams opened after the GOAWAY are ignored
+	c.writeHeaders(3, true, ":method", "GET", ":scheme", "http", ":path", "/")
+	close(release)
+	c.readHeaders(1)
+	assert.Equal(t, "ok", c.readBody(1))
+
+	// Test: The connection closes once its last stream is done
+	_, err := c.fr.ReadFrame()
+	assert.Error(t, err)
+	assert.NoError(t, <-c.done)
+}
+
+func TestIdleTimeout(t *testing.T) {
+	c := newTestClient(t, &Server{Handler: echoHandler, IdleTimeout: 50 * time.Millisecond})
+
+	// Test: An idle connection is closed with a GOAWAY
+	f := c.next(FrameGoAway)
+	assert.Equal(t, ErrCodeNo, f.ErrCode())
+	assert.NoError(t, <-c.done)
+}
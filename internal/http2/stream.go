@@ -0,0 +1,264 @@
+package http2
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nichol20/http-server/internal/header"
+	"github.com/nichol20/http-server/internal/http2/hpack"
+	"github.com/nichol20/http-server/internal/request"
+	"github.com/nichol20/http-server/internal/response"
+)
+
+// stream is a request and its response. It is the response.Stream of the Writer its handler gets
+type stream struct {
+	c  *Conn
+	id uint32
+	// done is closed once the stream is forgotten by the connection
+	done chan struct{}
+
+	// guarded by c.mu
+	sendWindow   int64
+	recvWindow   int64
+	recvUnacked  int64
+	remoteClosed bool
+	localClosed  bool
+	reset        bool
+	// nil when the request came without a body
+	body *requestBody
+	// the declared length of the body or -1, and what arrived of it
+	contentLength int64
+	received      int64
+}
+
+var _ response.Stream = (*stream)(nil)
+
+func (st *stream) WriteHeaders(statusCode response.StatusCode, h header.Header, endStream bool) error {
+	fields := []hpack.HeaderField{{Name: ":status", Value: strconv.Itoa(int(statusCode))}}
+	return st.c.writeHeaders(st, appendHeaderFields(fields, h), endStream)
+}
+
+func (st *stream) WriteTrailers(h header.Header) error {
+	return st.c.writeHeaders(st, appendHeaderFields(nil, h), true)
+}
+
+// WriteData sends p in as many DATA frames as the flow control windows and the
+// client's maximum frame size require, waiting for the windows to open
+func (st *stream) WriteData(p []byte, endStream bool) error {
+	c := st.c
+	for {
+		n, err := c.reserve(st, len(p), endStream)
+		if err != nil {
+			return err
+		}
+		chunk := p[:n]
+		p = p[n:]
+		last := endStream && len(p) == 0
+		err = c.writeFrames(false, func(fr *Framer) error {
+			return fr.WriteData(st.id, last, chunk)
+		})
+		if err != nil || len(p) == 0 {
+			return err
+		}
+	}
+}
+
+func (st *stream) Flush() error {
+	return st.c.flush()
+}
+
+// writableLocked fails once the stream can't carry more of the response
+func (st *stream) writableLocked() error {
+	switch {
+	case st.c.closed:
+		return errConnClosed
+	case st.reset:
+		return errStreamReset
+	case st.localClosed:
+		return errStreamEnded
+	}
+	return nil
+}
+
+// endLocalLocked closes our side of the stream, before the frame ending it is written
+func (c *Conn) endLocalLocked(st *stream) {
+	st.localClosed = true
+	if st.remoteClosed {
+		c.closeStreamLocked(st)
+	}
+}
+
+func (c *Conn) writeHeaders(st *stream, fields []hpack.HeaderField, endStream bool) error {
+	c.mu.Lock()
+	if err := st.writableLocked(); err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	if endStream {
+		c.endLocalLocked(st)
+	}
+	maxFrameSize := c.peerMaxFrameSize
+	c.mu.Unlock()
+	return c.writeFrames(false, func(fr *Framer) error {
+		c.hbuf = c.enc.AppendFields(c.hbuf[:0], fields)
+		return fr.WriteHeaders(st.id, endStream, c.hbuf, maxFrameSize)
+	})
+}
+
+// reserve takes up to want bytes from the send windows for the next DATA frame of st.
+// While both are closed, what was written so far is flushed and it waits for the client
+// to open them, until the stream or the connection ends or WriteTimeout passes.
+// The frame that takes the rest of an ending body closes the stream
+func (c *Conn) reserve(st *stream, want int, endStream bool) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	flushed := false
+	var timeout <-chan time.Time
+	for {
+		if err := st.writableLocked(); err != nil {
+			return 0, err
+		}
+		n := min(int64(want), c.sendWindow, st.sendWindow, int64(c.peerMaxFrameSize))
+		if want == 0 || n > 0 {
+			n = max(n, 0)
+			c.sendWindow -= n
+			st.sendWindow -= n
+			if endStream && int(n) == want {
+				c.endLocalLocked(st)
+			}
+			return int(n), nil
+		}
+		if !flushed {
+			c.mu.Unlock()
+			err := c.flush()
+			c.mu.Lock()
+			if err != nil {
+				return 0, err
+			}
+			flushed = true
+			continue
+		}
+		if timeout == nil && c.srv.WriteTimeout > 0 {
+			timer := time.NewTimer(c.srv.WriteTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		grew := c.windowGrew
+		c.mu.Unlock()
+		select {
+		case <-grew:
+		case <-st.done:
+		case <-c.done:
+		case <-timeout:
+			c.mu.Lock()
+			return 0, errWindowTimeout
+		}
+		c.mu.Lock()
+	}
+}
+
+// appendHeaderFields appends the fields of h with lowercase names, as HTTP/2 requires.
+// Like in HTTP/1, fields whose name isn't a token are left out
+func appendHeaderFields(fields []hpack.HeaderField, h header.Header) []hpack.HeaderField {
+	for _, name := range h.Names() {
+		if !header.ValidFieldName(name) {
+			continue
+		}
+		lower := strings.ToLower(name)
+		for _, v := range h.Values(name) {
+			fields = append(fields, hpack.HeaderField{Name: lower, Value: v})
+		}
+	}
+	return fields
+}
+
+// requestBody is the body of a stream's request, filled by the DATA frames the read loop gets
+type requestBody struct {
+	st  *stream
+	req *request.Request
+	max int64
+	// called before the handler's first read, to send a 100 Continue
+	onRead func() error
+
+	// guarded by c.mu
+	buf    bytes.Buffer
+	total  int64
+	closed bool
+	// io.EOF once the stream ended, or why the body failed
+	err     error
+	trailer header.Header
+}
+
+// push adds data that arrived to the body. It fails when nobody will read it
+func (b *requestBody) push(data []byte) error {
+	if b.closed {
+		return request.ErrBodyReadAfterClose
+	}
+	if b.err != nil {
+		return b.err
+	}
+	b.total += int64(len(data))
+	if b.max > 0 && b.total > b.max {
+		b.err = request.ErrBodyTooLarge
+		b.st.c.giveBackLocked(nil, int64(b.buf.Len()))
+		b.buf.Reset()
+		b.st.c.cond.Broadcast()
+		return b.err
+	}
+	b.buf.Write(data)
+	b.st.c.cond.Broadcast()
+	return nil
+}
+
+// failBody ends the body of st with err, unless it ended already
+func (st *stream) failBody(err error) {
+	if st.body != nil && st.body.err == nil {
+		st.body.err = err
+	}
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	if b.onRead != nil {
+		onRead := b.onRead
+		b.onRead = nil
+		if err := onRead(); err != nil {
+			return 0, err
+		}
+	}
+	c := b.st.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for b.buf.Len() == 0 && b.err == nil && !b.closed {
+		c.cond.Wait()
+	}
+	if b.closed {
+		return 0, request.ErrBodyReadAfterClose
+	}
+	if b.buf.Len() == 0 {
+		if b.err == io.EOF && b.trailer != nil {
+			b.req.Trailer = b.trailer
+		}
+		return 0, b.err
+	}
+	n, _ := b.buf.Read(p)
+	c.giveBackLocked(b.st, int64(n))
+	return n, nil
+}
+
+// Close stops the handler from reading the body. What arrived of it is dropped,
+// and the client is asked to stop sending the rest once the response is done
+func (b *requestBody) Close() error {
+	c := b.st.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !b.closed {
+		b.closed = true
+		c.giveBackLocked(nil, int64(b.buf.Len()))
+		b.buf.Reset()
+		c.cond.Broadcast()
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/nichol20/http-server/internal/header"
+)
+
+var ErrBodyReadAfterClose = errors.New("read on closed body")
+
+// ErrBodyNotDrained is returned by DiscardBody when more of the body is left than the caller
+// is willing to read, the connection can't be reused for another request
+var ErrBodyNotDrained = errors.New("request body too large to drain")
+
+type noBody struct{}
+
+func (noBody) Read([]byte) (int, error) { return 0, io.EOF }
+func (noBody) Close() error             { return nil }
+
+// NoBody is the Body of requests without one
+var NoBody io.ReadCloser = noBody{}
+
+// chunk size lines are short, a longer one is either garbage or an attack
+const maxChunkLineBytes = 4096
+
+// body streams a Content-Length delimited or chunked body from the Reader the request came from
+type body struct {
+	rr      *Reader
+	req     *Request
+	chunked bool
+	// bytes left in the whole body, or in the current chunk when chunked
+	remaining int64
+	// decoded bytes read so far
+	total  int64
+	done   bool
+	closed bool
+	// called before the handler's first read, see Request.OnBodyRead
+	onRead func() error
+	// sticky error, once the body failed it keeps failing
+	err error
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	if b.closed {
+		return 0, ErrBodyReadAfterClose
+	}
+	if b.onRead != nil {
+		onRead := b.onRead
+		b.onRead = nil
+		if err := onRead(); err != nil {
+			return 0, b.fail(err)
+		}
+	}
+	return b.read(p)
+}
+
+func (b *body) read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if b.done {
+		return 0, io.EOF
+	}
+	if b.chunked && b.remaining == 0 {
+		if err := b.nextChunk(); err != nil {
+			return 0, b.fail(err)
+		}
+		if b.done {
+			return 0, io.EOF
+		}
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+
+	n, err := b.rr.read(p)
+	b.remaining -= int64(n)
+	b.total += int64(n)
+	if b.remaining == 0 {
+		if !b.chunked {
+			b.finish()
+			return n, nil
+		}
+		// every chunk's data is followed by a CRLF
+		line, err := b.rr.readLine(len(CRLF))
+		if err != nil && !errors.Is(err, errLineTooLong) {
+			return n, b.fail(err)
+		}
+		if err != nil || line != "" {
+			return n, b.fail(fmt.Errorf("%w: missing CRLF after chunk data", ErrMalformedChunk))
+		}
+		return n, nil
+	}
+	if err != nil {
+		return n, b.fail(err)
+	}
+	return n, nil
+}
+
+// nextChunk reads a chunk size line, or the trailer section after the last chunk
+func (b *body) nextChunk() error {
+	line, err := b.rr.readLine(maxChunkLineBytes)
+	if err != nil {
+		return err
+	}
+	// chunk extensions are allowed but we have no use for them
+	sizeStr, _, _ := strings.Cut(line, ";")
+	sizeStr = strings.TrimRight(sizeStr, " \t")
+	if !isDigits(sizeStr, true) {
+		return fmt.Errorf("%w: invalid chunk size %q", ErrMalformedChunk, sizeStr)
+	}
+	size, err := strconv.ParseInt(sizeStr, 16, 64)
+	if err != nil || size < 0 {
+		return fmt.Errorf("%w: invalid chunk size %q", ErrMalformedChunk, sizeStr)
+	}
+	if size == 0 {
+		if err := b.readTrailer(); err != nil {
+			return err
+		}
+		b.finish()
+		return nil
+	}
+	if exceeds(b.total+size, b.req.limits.MaxBodyBytes) {
+		return ErrBodyTooLarge
+	}
+	b.remaining = size
+	return nil
+}
+
+// readTrailer reads the fields after the last chunk into Request.Trailer
+func (b *body) readTrailer() error {
+	block := []byte{}
+	count := 0
+	for {
+		line, err := b.rr.readLine(b.req.limits.MaxHeaderBytes)
+		if errors.Is(err, errLineTooLong) {
+			return ErrHeaderTooLarge
+		}
+		if err != nil {
+			return err
+		}
+		block = append(block, line...)
+		block = append(block, CRLF...)
+		if line == "" {
+			break
+		}
+		count++
+		if exceeds(len(block), b.req.limits.MaxHeaderBytes) || exceeds(count, b.req.limits.MaxHeaderCount) {
+			return ErrHeaderTooLarge
+		}
+	}
+
+	trailer := header.NewHeader()
+	if _, _, err := trailer.Parse(block); err != nil {
+		return err
+	}
+	FilterTrailer(trailer)
+	b.req.Trailer = trailer
+	return nil
+}
+
+// FilterTrailer removes the fields that frame or route the message from a received
+// trailer, they have no business there
+func FilterTrailer(trailer header.Header) {
+	for _, name := range []string{"content-length", "transfer-encoding", "host", "trailer"} {
+		trailer.Del(name)
+	}
+}
+
+func (b *body) finish() {
+	b.done = true
+	b.req.ParserState = StateDone
+}
+
+func (b *body) fail(err error) error {
+	if errors.Is(err, io.EOF) {
+		err = fmt.Errorf("%w: %w", ErrIncompleteRequest, io.ErrUnexpectedEOF)
+	}
+	if errors.Is(err, errLineTooLong) {
+		err = fmt.Errorf("%w: chunk size line too long", ErrMalformedChunk)
+	}
+	b.err = err
+	return err
+}
+
+// Close stops the handler from reading the body. The unread part stays on the
+// connection until it is discarded
+func (b *body) Close() error {
+	b.closed = true
+	return nil
+}
+
+// discard reads and drops the rest of the body. It stops with ErrBodyNotDrained
+// once more than max bytes are left. A negative max means no limit
+func (b *body) discard(max int64) error {
+	if !b.chunked && max >= 0 && b.remaining > max {
+		return ErrBodyNotDrained
+	}
+	buf := make([]byte, 4096)
+	var discarded int64
+	for {
+		n, err := b.read(buf)
+		discarded += int64(n)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if max >= 0 && discarded > max {
+			return ErrBodyNotDrained
+		}
+	}
+}
+
+// OnBodyRead registers f to run right before the handler first reads the body,
+// which is when a client waiting for 100 Continue has to be told to go on.
+// If f fails, so does the read. Requests without a body never call f
+func (r *Request) OnBodyRead(f func() error) {
+	if r.body != nil {
+		r.body.onRead = f
+	}
+}
+
+// DiscardBody drops whatever part of the body the handler did not read, so the
+// connection can carry the next request. It gives up with ErrBodyNotDrained when
+// more than max bytes are left, in that case the connection must be closed
+func (r *Request) DiscardBody(max int64) error {
+	if r.body == nil {
+		return nil
+	}
+	return r.body.discard(max)
+}
@@ -1,10 +1,87 @@
 package request
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+
+	"github.com/nichol20/http-server/internal/header"
+	"github.com/nichol20/http-server/internal/response"
+)
 
 var (
 	ErrMalformedRequestLine   = errors.New("malformed request line")
 	ErrInvalidHTTPVersion     = errors.New("invalid http version")
 	ErrUnsupportedHTTPVersion = errors.New("unsupported http version")
 	ErrMethodNotAllowed       = errors.New("method not allowed")
+	ErrInvalidContentLength   = errors.New("invalid content length")
+	ErrIncompleteRequest      = errors.New("incomplete request")
+	ErrURITooLong             = errors.New("uri too long")
+	ErrHeaderTooLarge         = errors.New("request header fields too large")
+	ErrBodyTooLarge           = errors.New("request body too large")
+	ErrMalformedChunk         = errors.New("malformed chunked encoding")
+	ErrInvalidRequestTarget   = errors.New("invalid request target")
+	ErrMissingHost            = errors.New("missing host header")
+	ErrInvalidHost            = errors.New("invalid host header")
+
+	ErrContentLengthWithTransferEncoding = errors.New("both content-length and transfer-encoding are set")
+	ErrUnsupportedTransferEncoding       = errors.New("unsupported transfer encoding")
+	ErrTransferEncodingInHTTP10          = errors.New("transfer-encoding in an http/1.0 request")
+	ErrExpectationFailed                 = errors.New("expectation failed")
+
+	errLineTooLong = errors.New("line too long")
 )
+
+// ParseError describes why a request could not be parsed and which status the server should answer with
+type ParseError struct {
+	StatusCode response.StatusCode
+	// Message is safe to send back to the client
+	Message string
+	Err     error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%d %s: %v", e.StatusCode, e.Message, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// parseErrorStatus maps the known parse errors to the status code they deserve,
+// everything else is a 400
+var parseErrorStatus = []struct {
+	err        error
+	statusCode response.StatusCode
+}{
+	{ErrMalformedRequestLine, response.StatusBadRequest},
+	{ErrInvalidHTTPVersion, response.StatusBadRequest},
+	{ErrInvalidContentLength, response.StatusBadRequest},
+	{ErrIncompleteRequest, response.StatusBadRequest},
+	{ErrMalformedChunk, response.StatusBadRequest},
+	{ErrInvalidRequestTarget, response.StatusBadRequest},
+	{ErrMissingHost, response.StatusBadRequest},
+	{ErrInvalidHost, response.StatusBadRequest},
+	{ErrContentLengthWithTransferEncoding, response.StatusBadRequest},
+	{ErrTransferEncodingInHTTP10, response.StatusBadRequest},
+	{header.ErrMalformedFieldLine, response.StatusBadRequest},
+	{header.ErrInvalidFieldName, response.StatusBadRequest},
+	{header.ErrInvalidFieldValue, response.StatusBadRequest},
+	// the method is well formed, we just don't know it
+	{ErrMethodNotAllowed, response.StatusNotImplemented},
+	{ErrUnsupportedTransferEncoding, response.StatusNotImplemented},
+	{ErrUnsupportedHTTPVersion, response.StatusHTTPVersionNotSupported},
+	{ErrURITooLong, response.StatusURITooLong},
+	{ErrHeaderTooLarge, response.StatusRequestHeaderFieldsTooLarge},
+	{ErrBodyTooLarge, response.StatusContentTooLarge},
+	{ErrExpectationFailed, response.StatusExpectationFailed},
+}
+
+// NewParseError wraps err with the status code and the public message its kind of failure deserves
+func NewParseError(err error) *ParseError {
+	for _, e := range parseErrorStatus {
+		if errors.Is(err, e.err) {
+			return &ParseError{StatusCode: e.statusCode, Message: e.err.Error(), Err: err}
+		}
+	}
+	return &ParseError{StatusCode: response.StatusBadRequest, Message: "bad request", Err: err}
+}
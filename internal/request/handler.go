@@ -0,0 +1,15 @@
+package request
+
+import "github.com/nichol20/http-server/internal/response"
+
+// Handler responds to a request. HTTP/1 connections and HTTP/2 streams hand their requests to it alike
+type Handler interface {
+	ServeHTTP(w *response.Writer, req *Request)
+}
+
+// HandlerFunc adapts an ordinary function to the Handler interface
+type HandlerFunc func(w *response.Writer, req *Request)
+
+func (f HandlerFunc) ServeHTTP(w *response.Writer, req *Request) {
+	f(w, req)
+}
@@ -0,0 +1,42 @@
+package request
+
+const (
+	DefaultMaxRequestLineBytes = 8 << 10
+	DefaultMaxHeaderBytes      = 1 << 20
+	DefaultMaxHeaderCount      = 100
+	DefaultMaxBodyBytes        = 10 << 20
+)
+
+// Limits bounds how much a client may send. A zero field uses its default and a
+// negative one disables the limit
+type Limits struct {
+	// MaxRequestLineBytes bounds the request line, CRLF excluded. Exceeding it is a 414
+	MaxRequestLineBytes int
+	// MaxHeaderBytes bounds all the field lines together, CRLFs included. Exceeding it is a 431
+	MaxHeaderBytes int
+	// MaxHeaderCount bounds the number of field lines. Exceeding it is a 431
+	MaxHeaderCount int
+	// MaxBodyBytes bounds the body. Exceeding it is a 413
+	MaxBodyBytes int64
+}
+
+// WithDefaults returns a copy of l with zero fields replaced by their defaults
+func (l Limits) WithDefaults() Limits {
+	if l.MaxRequestLineBytes == 0 {
+		l.MaxRequestLineBytes = DefaultMaxRequestLineBytes
+	}
+	if l.MaxHeaderBytes == 0 {
+		l.MaxHeaderBytes = DefaultMaxHeaderBytes
+	}
+	if l.MaxHeaderCount == 0 {
+		l.MaxHeaderCount = DefaultMaxHeaderCount
+	}
+	if l.MaxBodyBytes == 0 {
+		l.MaxBodyBytes = DefaultMaxBodyBytes
+	}
+	return l
+}
+
+func exceeds[T int | int64](n T, limit T) bool {
+	return limit > 0 && n > limit
+}
@@ -1,10 +1,12 @@
 package request
 
 import (
+	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
-	"math"
+	"net/url"
 	"strconv"
 	"strings"
 
@@ -29,7 +31,31 @@ type Request struct {
 	ParserState parserState
 	RequestLine RequestLine
 	Header      header.Header
-	Body        []byte
+	// URL is the parsed request target. Only absolute-form targets set its scheme and host
+	URL *url.URL
+	// Host is the host the request is for, from an absolute-form target or the Host field
+	Host string
+	// Body streams the request body from the connection. It is never nil,
+	// requests without a body get NoBody
+	Body io.ReadCloser
+
+	// Trailer holds the fields sent after a chunked body. It is only set once Body was read to the end
+	Trailer header.Header
+
+	// TLS describes the connection the request came on, like the certificates the client
+	// presented. It is nil for plain connections
+	TLS *tls.ConnectionState
+
+	// body is the reader the parser created, handlers may replace Body with a wrapper
+	body          *body
+	contentLength int64
+	chunked       bool
+	pathValues    map[string]string
+	query         url.Values
+	limits        Limits
+	// bytes and field lines of the header parsed so far
+	headerBytes int
+	headerCount int
 }
 
 var allowedMethods = map[string]struct{}{
@@ -40,10 +66,11 @@ var allowedMethods = map[string]struct{}{
 	"PATCH":   {},
 	"OPTIONS": {},
 	"HEAD":    {},
+	"CONNECT": {},
 }
 
 var supportedVersions = map[string]struct{}{
-	//"1.0": {},
+	"1.0": {},
 	"1.1": {},
 }
 
@@ -54,58 +81,153 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 	switch r.ParserState {
 	case StateInitialized:
 		rl, consumed, err := parseRequestLine(data)
+		lineLen := consumed - len(CRLF)
+		if rl == nil && err == nil {
+			// still waiting for the CRLF, everything received so far is part of the line
+			lineLen = len(data)
+		}
+		if exceeds(lineLen, r.limits.MaxRequestLineBytes) {
+			return 0, ErrURITooLong
+		}
 		if rl != nil {
+			u, err := parseRequestTarget(rl.Method, rl.RequestTarget)
+			if err != nil {
+				return 0, err
+			}
 			r.RequestLine = *rl
+			r.URL = u
 			r.ParserState = StateParsingHeader
 		}
 		return consumed, err
 
 	case StateParsingHeader:
 		consumed, done, err := r.Header.Parse(data)
+		if err != nil {
+			return 0, err
+		}
+		r.headerBytes += consumed
+		r.headerCount += strings.Count(string(data[:consumed]), CRLF)
+		pending := 0
+		if done {
+			// the empty line ending the header is not a field
+			r.headerCount--
+		} else {
+			// whatever was not consumed is an incomplete field line
+			pending = len(data) - consumed
+		}
+		if exceeds(r.headerBytes+pending, r.limits.MaxHeaderBytes) || exceeds(r.headerCount, r.limits.MaxHeaderCount) {
+			return 0, ErrHeaderTooLarge
+		}
 		if done {
-			// I'm assuming that if there is no content-length there will be no body
-			if len(r.Header.Get("content-length")) == 0 {
-				r.ParserState = StateDone
-			} else {
-				r.ParserState = StateParsingBody
+			if err := r.parseHost(); err != nil {
+				return 0, err
+			}
+			if err := r.parseFraming(); err != nil {
+				return 0, err
 			}
 		}
-		return consumed, err
+		return consumed, nil
 
-	case StateParsingBody:
-		contentLen, err := strconv.Atoi(r.Header.Get("content-length"))
-		if err != nil {
-			return 0, fmt.Errorf("invalid content length")
+	case StateParsingBody, StateDone:
+		return 0, fmt.Errorf("error: the body is read through Request.Body, not the parser")
+	default:
+		return 0, fmt.Errorf("error: unkown state")
+	}
+}
+
+// parseFraming decides how the body is delimited once the header is complete (RFC 9112 section 6)
+func (r *Request) parseFraming() error {
+	// 100-continue is the only expectation defined
+	if expect := r.Header.Get("expect"); len(expect) > 0 && !strings.EqualFold(strings.TrimSpace(expect), "100-continue") {
+		return ErrExpectationFailed
+	}
+
+	te := r.Header.Get("transfer-encoding")
+	cl := r.Header.Get("content-length")
+
+	if len(te) > 0 {
+		// a request with both is the classic smuggling vector, intermediaries may disagree on where it ends
+		if len(cl) > 0 {
+			return ErrContentLengthWithTransferEncoding
 		}
-		r.Body = append(r.Body, data...)
-		if len(r.Body) > contentLen {
-			return 0, fmt.Errorf("the body size is larger than the content length specified in the header")
+		// HTTP/1.0 has no transfer codings, the framing can't be trusted (RFC 9112 section 6.1)
+		if r.RequestLine.HttpVersion == "1.0" {
+			return ErrTransferEncodingInHTTP10
 		}
-		if len(r.Body) == contentLen {
-			r.ParserState = StateDone
+		if !strings.EqualFold(strings.TrimSpace(te), "chunked") {
+			return ErrUnsupportedTransferEncoding
 		}
-		return len(data), nil
+		r.chunked = true
+		r.ParserState = StateParsingBody
+		return nil
+	}
 
-	case StateDone:
-		return 0, fmt.Errorf("error: trying to read data in a done state")
-	default:
-		return 0, fmt.Errorf("error: unkown state")
+	// without content-length or transfer-encoding a request has no body
+	if len(cl) == 0 {
+		r.ParserState = StateDone
+		return nil
+	}
+	contentLen, err := ParseContentLength(cl)
+	if err != nil {
+		return err
 	}
+	// refuse before reading a single byte of a body we won't accept
+	if exceeds(contentLen, r.limits.MaxBodyBytes) {
+		return ErrBodyTooLarge
+	}
+	r.contentLength = contentLen
+	r.ParserState = StateParsingBody
+	if contentLen == 0 {
+		r.ParserState = StateDone
+	}
+	return nil
 }
 
+// ParseContentLength parses a Content-Length value, which is only digits (RFC 9110 section 8.6)
+func ParseContentLength(v string) (int64, error) {
+	if !isDigits(v, false) {
+		return 0, ErrInvalidContentLength
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, ErrInvalidContentLength
+	}
+	return n, nil
+}
+
+// isDigits reports whether s is a non-empty run of digits, hexadecimal ones when hex is set.
+// strconv also takes a sign and underscores, a proxy reading "+5" differently could smuggle a request
+func isDigits(s string, hex bool) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= '0' && c <= '9':
+		case hex && (c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// parse consumes data until the request line and the header are parsed
 func (r *Request) parse(data []byte) (int, error) {
 	total := 0
 
-	for {
+	for r.ParserState == StateInitialized || r.ParserState == StateParsingHeader {
 		n, err := r.parseSingle(data[total:])
-		if n <= 0 || r.ParserState == StateDone {
-			return total, err
-		}
 		if err != nil {
 			return 0, err
 		}
 		total += n
+		if n <= 0 {
+			break
+		}
 	}
+	return total, nil
 }
 
 func parseRequestLine(data []byte) (*RequestLine, int, error) {
@@ -147,51 +269,241 @@ func parseRequestLine(data []byte) (*RequestLine, int, error) {
 	}, len(rlStr) + len(CRLF), nil
 }
 
-func RequestFromReader(reader io.Reader) (*Request, error) {
+// PathValue returns the value of a named path parameter set by a router, or "" if there is none
+func (r *Request) PathValue(name string) string {
+	return r.pathValues[name]
+}
+
+func (r *Request) SetPathValue(name string, value string) {
+	if r.pathValues == nil {
+		r.pathValues = map[string]string{}
+	}
+	r.pathValues[name] = value
+}
+
+// ExpectsContinue reports whether the client waits for a 100 Continue before sending the body.
+// HTTP/1.0 clients don't know about interim responses, so they never do
+func (r *Request) ExpectsContinue() bool {
+	return r.RequestLine.HttpVersion != "1.0" && r.Header.HasToken("expect", "100-continue")
+}
+
+// KeepAlive reports whether the client allows the connection to be reused after this request.
+// HTTP/1.1 connections are persistent unless closed, HTTP/1.0 ones only when asked for
+func (r *Request) KeepAlive() bool {
+	if r.RequestLine.HttpVersion == "1.0" {
+		return r.Header.HasToken("connection", "keep-alive")
+	}
+	return !r.Header.HasToken("connection", "close")
+}
+
+// Reader parses consecutive requests from a single connection. Bytes read past the
+// end of one request are kept for the next call, so pipelined requests are not lost
+type Reader struct {
+	reader io.Reader
+	buf    []byte
+	bufIdx int
+	limits Limits
+	// body of the last request, it has to be consumed before the next request is parsed
+	body *body
+}
+
+// NewReader returns a Reader enforcing the default Limits
+func NewReader(reader io.Reader) *Reader {
+	return NewReaderWithLimits(reader, Limits{})
+}
+
+func NewReaderWithLimits(reader io.Reader, limits Limits) *Reader {
+	return &Reader{
+		reader: reader,
+		buf:    make([]byte, INITIAL_BUFFER_SIZE),
+		limits: limits.WithDefaults(),
+	}
+}
+
+// Buffered returns the number of bytes already read that belong to following requests
+func (rr *Reader) Buffered() int {
+	return rr.bufIdx
+}
+
+// Peek blocks until at least one byte of the next request is available.
+// It returns io.EOF if the peer closes the connection before sending anything
+func (rr *Reader) Peek() error {
+	for rr.bufIdx == 0 {
+		n, err := rr.reader.Read(rr.buf)
+		rr.bufIdx += n
+		if rr.bufIdx > 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HasPrefix reports whether the next bytes on the connection are prefix, without consuming them.
+// It only waits for more bytes as long as the ones that arrived match, so a request that
+// doesn't start with prefix is never held up
+func (rr *Reader) HasPrefix(prefix []byte) (bool, error) {
+	for {
+		n := min(rr.bufIdx, len(prefix))
+		if !bytes.Equal(rr.buf[:n], prefix[:n]) {
+			return false, nil
+		}
+		if n == len(prefix) {
+			return true, nil
+		}
+		if err := rr.fill(); err != nil {
+			return false, err
+		}
+	}
+}
+
+// Read reads what follows the last request, for a protocol taking over the connection
+// like HTTP/2 after an upgrade. The body of that request must have been read already
+func (rr *Reader) Read(p []byte) (int, error) {
+	return rr.read(p)
+}
+
+// read reads from the bytes left over by the parser first, then from the connection
+func (rr *Reader) read(p []byte) (int, error) {
+	if rr.bufIdx > 0 {
+		n := copy(p, rr.buf[:rr.bufIdx])
+		copy(rr.buf, rr.buf[n:rr.bufIdx])
+		rr.bufIdx -= n
+		return n, nil
+	}
+	return rr.reader.Read(p)
+}
+
+// ReadRequest parses the request line and the header of the next request.
+// The body is not read, it streams from the connection through Request.Body.
+// Whatever the handler left unread from the previous body is discarded first
+func (rr *Reader) ReadRequest() (*Request, error) {
+	if rr.body != nil {
+		if err := rr.body.discard(-1); err != nil {
+			return nil, err
+		}
+		rr.body = nil
+	}
+
 	request := &Request{
 		ParserState: StateInitialized,
 		RequestLine: RequestLine{},
 		Header:      header.NewHeader(),
-		Body:        []byte{},
+		Body:        NoBody,
+		limits:      rr.limits,
+	}
+	if err := rr.readHeader(request); err != nil {
+		return nil, err
 	}
+	if request.ParserState == StateParsingBody {
+		request.body = &body{rr: rr, req: request, chunked: request.chunked, remaining: request.contentLength}
+		request.Body = request.body
+		rr.body = request.body
+	}
+	return request, nil
+}
 
-	buf := make([]byte, INITIAL_BUFFER_SIZE)
-	bufIdx := 0
+func (rr *Reader) readHeader(request *Request) error {
 	reachedEOF := false
-	for request.ParserState != StateDone {
-		if reachedEOF {
-			return nil, fmt.Errorf("the request parse has not finished, but there is no more data to read")
-		}
-		n, err := reader.Read(buf[bufIdx:])
-		reachedEOF = errors.Is(err, io.EOF)
+	for {
+		// leftover bytes from a previous request may already hold a whole request
+		consumed, err := request.parse(rr.buf[:rr.bufIdx])
 		if err != nil {
-			if !reachedEOF {
-				return nil, fmt.Errorf("error reading data: %w", err)
-			}
+			return NewParseError(err)
 		}
+		copy(rr.buf, rr.buf[consumed:rr.bufIdx])
+		rr.bufIdx -= consumed
 
-		bufIdx += n
-		bufLen := len(buf)
-		if bufIdx == bufLen {
-			newSize := bufLen * 2
-			newBuf := make([]byte, newSize)
-			copy(newBuf, buf)
-			buf = newBuf
+		if request.ParserState == StateDone || request.ParserState == StateParsingBody {
+			return nil
 		}
 
-		consumed, err := request.parse(buf[:bufIdx])
-		if err != nil {
-			return nil, fmt.Errorf("error parsing data: %w", err)
+		if reachedEOF {
+			// the peer closed the connection before sending anything, which is how
+			// clients end a persistent connection
+			if request.ParserState == StateInitialized && rr.bufIdx == 0 {
+				return io.EOF
+			}
+			return NewParseError(fmt.Errorf("%w: the connection closed before the request was complete", ErrIncompleteRequest))
 		}
 
-		if consumed > 0 {
-			newSize := math.Ceil((float64(bufIdx) / float64(INITIAL_BUFFER_SIZE))) * INITIAL_BUFFER_SIZE
-			newBuf := make([]byte, int(newSize))
-			copy(newBuf, buf[consumed:])
-			buf = newBuf
+		err = rr.fill()
+		reachedEOF = errors.Is(err, io.EOF)
+		if err != nil && !reachedEOF {
+			return fmt.Errorf("error reading data: %w", err)
 		}
-		bufIdx -= consumed
 	}
+}
 
-	return request, nil
+// fill reads more data from the connection into the buffer, growing it when full
+func (rr *Reader) fill() error {
+	if rr.bufIdx == len(rr.buf) {
+		newBuf := make([]byte, len(rr.buf)*2)
+		copy(newBuf, rr.buf)
+		rr.buf = newBuf
+	}
+	n, err := rr.reader.Read(rr.buf[rr.bufIdx:])
+	rr.bufIdx += n
+	if n > 0 {
+		return nil
+	}
+	return err
+}
+
+// readLine returns the next CRLF terminated line without its CRLF.
+// It fails with errLineTooLong once more than max bytes arrived without a CRLF,
+// a max that isn't positive means no limit, like a disabled limit of Limits
+func (rr *Reader) readLine(max int) (string, error) {
+	for {
+		if i := bytes.Index(rr.buf[:rr.bufIdx], []byte(CRLF)); i != -1 {
+			line := string(rr.buf[:i])
+			copy(rr.buf, rr.buf[i+len(CRLF):rr.bufIdx])
+			rr.bufIdx -= i + len(CRLF)
+			return line, nil
+		}
+		if exceeds(rr.bufIdx, max) {
+			return "", errLineTooLong
+		}
+		if err := rr.fill(); err != nil {
+			return "", err
+		}
+	}
+}
+
+// RequestFromReader parses a single request from reader. Use a Reader to parse
+// more than one request from the same connection
+func RequestFromReader(reader io.Reader) (*Request, error) {
+	return NewReader(reader).ReadRequest()
+}
+
+// NewRequest makes a request that didn't arrive as HTTP/1 text, like the one of an HTTP/2 stream.
+// The target is checked like a request line's, host is where the request is for, the Host field
+// when empty. A nil body is NoBody. Errors are *ParseError, like the parser's
+func NewRequest(method string, target string, version string, host string, h header.Header, body io.ReadCloser) (*Request, error) {
+	if _, ok := allowedMethods[method]; !ok {
+		return nil, NewParseError(ErrMethodNotAllowed)
+	}
+	u, err := parseRequestTarget(method, target)
+	if err != nil {
+		return nil, NewParseError(err)
+	}
+	if host == "" {
+		host = h.Get("host")
+	}
+	if host != "" && !validHost(host) {
+		return nil, NewParseError(ErrInvalidHost)
+	}
+	if body == nil {
+		body = NoBody
+	}
+	return &Request{
+		ParserState: StateDone,
+		RequestLine: RequestLine{HttpVersion: version, RequestTarget: target, Method: method},
+		Header:      h,
+		URL:         u,
+		Host:        host,
+		Body:        body,
+	}, nil
 }
@@ -5,6 +5,8 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/nichol20/http-server/internal/header"
+	"github.com/nichol20/http-server/internal/response"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -116,7 +118,10 @@ func TestBodyParse(t *testing.T) {
 	r, err := RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "hello world!\n", string(r.Body))
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!\n", string(body))
+	assert.Equal(t, StateDone, r.ParserState)
 
 	// Test: Body shorter than reported content length
 	reader = &chunkReader{
@@ -127,6 +132,458 @@ func TestBodyParse(t *testing.T) {
 			"partial content",
 		numBytesPerRead: 3,
 	}
-	_, err = RequestFromReader(reader)
-	require.Error(t, err)
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.Body)
+	require.ErrorIs(t, err, ErrIncompleteRequest)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Test: No body
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, NoBody, r.Body)
+	assert.Equal(t, StateDone, r.ParserState)
+
+	// Test: Reading after close
+	r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello"))
+	require.NoError(t, err)
+	require.NoError(t, r.Body.Close())
+	_, err = r.Body.Read(make([]byte, 5))
+	require.ErrorIs(t, err, ErrBodyReadAfterClose)
+}
+
+func TestKeepAlive(t *testing.T) {
+	// Test: HTTP/1.1 defaults to a persistent connection
+	r, err := RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n"))
+	require.NoError(t, err)
+	assert.True(t, r.KeepAlive())
+
+	// Test: Connection close
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost:42069\r\nConnection: Close\r\n\r\n"))
+	require.NoError(t, err)
+	assert.False(t, r.KeepAlive())
+
+	// Test: Connection closed before any byte was sent
+	_, err = RequestFromReader(strings.NewReader(""))
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestPipelinedRequests(t *testing.T) {
+	// Test: Two requests sent back to back on the same connection
+	reader := NewReader(&chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello" +
+			"GET /coffee HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"\r\n",
+		numBytesPerRead: 64,
+	})
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/submit", r.RequestLine.RequestTarget)
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+	assert.Greater(t, reader.Buffered(), 0)
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "GET", r.RequestLine.Method)
+	assert.Equal(t, "/coffee", r.RequestLine.RequestTarget)
+	assert.Equal(t, 0, reader.Buffered())
+
+	_, err = reader.ReadRequest()
+	require.ErrorIs(t, err, io.EOF)
+
+	// Test: Pipelined requests read one byte at a time
+	reader = NewReader(&chunkReader{
+		data:            "GET /a HTTP/1.1\r\nHost: localhost\r\n\r\nGET /b HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		numBytesPerRead: 1,
+	})
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/a", r.RequestLine.RequestTarget)
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/b", r.RequestLine.RequestTarget)
+}
+
+func TestUnreadBody(t *testing.T) {
+	data := "POST /a HTTP/1.1\r\nHost: localhost\r\nContent-Length: 11\r\n\r\nhello world" +
+		"POST /b HTTP/1.1\r\nHost: localhost\r\nContent-Length: 11\r\n\r\nhello world" +
+		"GET /c HTTP/1.1\r\nHost: localhost\r\n\r\n"
+
+	// Test: The Reader skips whatever the handler did not read
+	reader := NewReader(&chunkReader{data: data, numBytesPerRead: 4})
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, StateParsingBody, r.ParserState)
+	_, err = r.Body.Read(make([]byte, 5))
+	require.NoError(t, err)
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/b", r.RequestLine.RequestTarget)
+
+	// Test: DiscardBody refuses to drain more than asked
+	require.ErrorIs(t, r.DiscardBody(4), ErrBodyNotDrained)
+	require.NoError(t, r.DiscardBody(64))
+	assert.Equal(t, StateDone, r.ParserState)
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/c", r.RequestLine.RequestTarget)
+}
+
+func TestPeek(t *testing.T) {
+	reader := NewReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, reader.Peek())
+	assert.Equal(t, 35, reader.Buffered())
+
+	// Test: Peek on a closed connection
+	reader = NewReader(strings.NewReader(""))
+	require.ErrorIs(t, reader.Peek(), io.EOF)
+}
+
+func TestHasPrefix(t *testing.T) {
+	preface := []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+	// Test: The prefix is found across reads and left for Read
+	reader := NewReader(&chunkReader{data: string(preface) + "frames", numBytesPerRead: 3})
+	ok, err := reader.HasPrefix(preface)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	rest, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, string(preface)+"frames", string(rest))
+
+	// Test: A request that differs early is not waited on, it parses as usual
+	reader = NewReader(&chunkReader{data: "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n", numBytesPerRead: 2})
+	ok, err = reader.HasPrefix(preface)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, 2, reader.Buffered())
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "GET", r.RequestLine.Method)
+
+	// Test: A connection closing inside the prefix
+	reader = NewReader(strings.NewReader("PRI * HTTP/2.0"))
+	_, err = reader.HasPrefix(preface)
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestParseErrorStatus(t *testing.T) {
+	var parseErr *ParseError
+
+	// Test: Unknown method
+	_, err := RequestFromReader(strings.NewReader("BREW /coffee HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.ErrorAs(t, err, &parseErr)
+	assert.ErrorIs(t, err, ErrMethodNotAllowed)
+	assert.Equal(t, response.StatusNotImplemented, parseErr.StatusCode)
+
+	// Test: Unsupported version
+	_, err = RequestFromReader(strings.NewReader("GET / HTTP/2.0\r\nHost: localhost\r\n\r\n"))
+	require.ErrorAs(t, err, &parseErr)
+	assert.Equal(t, response.StatusHTTPVersionNotSupported, parseErr.StatusCode)
+	assert.Equal(t, "unsupported http version", parseErr.Message)
+
+	// Test: Malformed header
+	_, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost localhost\r\n\r\n"))
+	require.ErrorAs(t, err, &parseErr)
+	assert.Equal(t, response.StatusBadRequest, parseErr.StatusCode)
+
+	// Test: Negative content length
+	_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: -1\r\n\r\n"))
+	require.ErrorAs(t, err, &parseErr)
+	assert.ErrorIs(t, err, ErrInvalidContentLength)
+
+	// Test: Connection closed in the middle of the header
+	_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Len"))
+	require.ErrorAs(t, err, &parseErr)
+	assert.ErrorIs(t, err, ErrIncompleteRequest)
+}
+
+func TestLimits(t *testing.T) {
+	limits := Limits{MaxRequestLineBytes: 32, MaxHeaderBytes: 64, MaxHeaderCount: 2, MaxBodyBytes: 8}
+
+	// Test: Request line too long, even before its CRLF arrives
+	reader := NewReaderWithLimits(&chunkReader{
+		data:            "GET /" + strings.Repeat("a", 100) + " HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		numBytesPerRead: 8,
+	}, limits)
+	_, err := reader.ReadRequest()
+	require.ErrorIs(t, err, ErrURITooLong)
+
+	// Test: Too many header fields
+	reader = NewReaderWithLimits(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\nA: 1\r\nB: 2\r\nC: 3\r\n\r\n"), limits)
+	_, err = reader.ReadRequest()
+	require.ErrorIs(t, err, ErrHeaderTooLarge)
+
+	// Test: Exactly the allowed number of header fields
+	reader = NewReaderWithLimits(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\nA: 1\r\n\r\n"), limits)
+	_, err = reader.ReadRequest()
+	require.NoError(t, err)
+
+	// Test: A single never ending field line
+	reader = NewReaderWithLimits(&chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost\r\nA: " + strings.Repeat("a", 100),
+		numBytesPerRead: 16,
+	}, limits)
+	_, err = reader.ReadRequest()
+	require.ErrorIs(t, err, ErrHeaderTooLarge)
+
+	// Test: Body larger than allowed is refused from its content length
+	reader = NewReaderWithLimits(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 9\r\n\r\n"), limits)
+	_, err = reader.ReadRequest()
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+	var parseErr *ParseError
+	require.ErrorAs(t, err, &parseErr)
+	assert.Equal(t, response.StatusContentTooLarge, parseErr.StatusCode)
+
+	// Test: Negative limits disable the check
+	reader = NewReaderWithLimits(strings.NewReader("GET /"+strings.Repeat("a", 100)+" HTTP/1.1\r\nHost: localhost\r\n\r\n"), Limits{MaxRequestLineBytes: -1})
+	_, err = reader.ReadRequest()
+	require.NoError(t, err)
+}
+
+func TestChunkedBody(t *testing.T) {
+	// Test: Chunks with extensions and trailers, one byte at a time
+	reader := NewReader(&chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5;name=value\r\n" +
+			"hello\r\n" +
+			"7\r\n" +
+			", world\r\n" +
+			"0\r\n" +
+			"X-Checksum: abc\r\n" +
+			"\r\n" +
+			"GET /next HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		numBytesPerRead: 1,
+	})
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Nil(t, r.Trailer)
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello, world", string(body))
+	assert.Equal(t, "abc", r.Trailer.Get("x-checksum"))
+	assert.Equal(t, StateDone, r.ParserState)
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/next", r.RequestLine.RequestTarget)
+
+	// Test: Unread chunked body is skipped before the next request
+	reader = NewReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\nGET /next HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	_, err = reader.ReadRequest()
+	require.NoError(t, err)
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/next", r.RequestLine.RequestTarget)
+
+	// Test: Invalid chunk size
+	r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\nabc\r\n0\r\n\r\n"))
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.Body)
+	require.ErrorIs(t, err, ErrMalformedChunk)
+
+	// Test: A chunk size is only hex digits, strconv would take a sign
+	for _, size := range []string{"+5", "-5", "0x5", "5_0", ""} {
+		r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n" + size + "\r\nhello\r\n0\r\n\r\n"))
+		require.NoError(t, err)
+		_, err = io.ReadAll(r.Body)
+		require.ErrorIs(t, err, ErrMalformedChunk, size)
+	}
+
+	// Test: Chunk data longer than its size
+	r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nabc\r\n0\r\n\r\n"))
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.Body)
+	require.ErrorIs(t, err, ErrMalformedChunk)
+
+	// Test: Connection closed in the middle of a chunk
+	r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\na\r\nabc"))
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.Body)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Test: Disabled limits don't get in the way of trailers
+	reader = NewReaderWithLimits(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\nX-Checksum: abc\r\n\r\n",
+		numBytesPerRead: 3,
+	}, Limits{MaxRequestLineBytes: -1, MaxHeaderBytes: -1, MaxHeaderCount: -1, MaxBodyBytes: -1})
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	body, err = io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, "abc", r.Trailer.Get("x-checksum"))
+
+	// Test: Decoded body over the limit
+	reader = NewReaderWithLimits(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n5\r\nworld\r\n0\r\n\r\n"), Limits{MaxBodyBytes: 8})
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.Body)
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+}
+
+func TestRequestSmuggling(t *testing.T) {
+	var parseErr *ParseError
+
+	// Test: Both Content-Length and Transfer-Encoding
+	_, err := RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"))
+	require.ErrorAs(t, err, &parseErr)
+	assert.ErrorIs(t, err, ErrContentLengthWithTransferEncoding)
+	assert.Equal(t, response.StatusBadRequest, parseErr.StatusCode)
+
+	// Test: A Content-Length is only digits, strconv would take a sign
+	for _, cl := range []string{"+5", "-5", "5_0", "0x5"} {
+		_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: " + cl + "\r\n\r\nhello"))
+		assert.ErrorIs(t, err, ErrInvalidContentLength, cl)
+	}
+
+	// Test: A folded line can't smuggle a Transfer-Encoding past a front end that unfolds it
+	_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\nX-Foo: bar\r\n Transfer-Encoding: chunked\r\n\r\n0\r\n\r\n"))
+	require.ErrorAs(t, err, &parseErr)
+	assert.ErrorIs(t, err, header.ErrMalformedFieldLine)
+	assert.Equal(t, response.StatusBadRequest, parseErr.StatusCode)
+
+	// Test: A bare LF or a NUL in a value
+	for _, value := range []string{"a\nb", "a\x00b"} {
+		_, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\nX-Foo: " + value + "\r\n\r\n"))
+		require.ErrorAs(t, err, &parseErr, value)
+		assert.Equal(t, response.StatusBadRequest, parseErr.StatusCode, value)
+	}
+
+	// Test: Transfer coding other than chunked
+	_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: gzip, chunked\r\n\r\n"))
+	require.ErrorAs(t, err, &parseErr)
+	assert.Equal(t, response.StatusNotImplemented, parseErr.StatusCode)
+}
+
+func TestHTTP10(t *testing.T) {
+	// Test: HTTP/1.0 closes by default
+	r, err := RequestFromReader(strings.NewReader("GET / HTTP/1.0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "1.0", r.RequestLine.HttpVersion)
+	assert.False(t, r.KeepAlive())
+
+	// Test: HTTP/1.0 keep-alive is opt-in
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.0\r\nConnection: Keep-Alive\r\n\r\n"))
+	require.NoError(t, err)
+	assert.True(t, r.KeepAlive())
+
+	// Test: HTTP/1.0 clients never wait for 100 Continue
+	r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.0\r\nContent-Length: 2\r\nExpect: 100-continue\r\n\r\nhi"))
+	require.NoError(t, err)
+	assert.False(t, r.ExpectsContinue())
+
+	// Test: Transfer-Encoding in an HTTP/1.0 request
+	var parseErr *ParseError
+	_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.0\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"))
+	require.ErrorAs(t, err, &parseErr)
+	assert.ErrorIs(t, err, ErrTransferEncodingInHTTP10)
+	assert.Equal(t, response.StatusBadRequest, parseErr.StatusCode)
+}
+
+func TestRequestTarget(t *testing.T) {
+	// Test: Origin-form with a query
+	r, err := RequestFromReader(strings.NewReader("GET /search/a%20b?q=go+lang&tag=a&tag=b HTTP/1.1\r\nHost: localhost:42069\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "/search/a b", r.URL.Path)
+	assert.Equal(t, "q=go+lang&tag=a&tag=b", r.URL.RawQuery)
+	assert.Equal(t, "go lang", r.Query().Get("q"))
+	assert.Equal(t, []string{"a", "b"}, r.Query()["tag"])
+	assert.Equal(t, "localhost:42069", r.Host)
+
+	// Test: Absolute-form, its host wins over the Host field
+	r, err = RequestFromReader(strings.NewReader("GET http://example.com:8080?x=1 HTTP/1.1\r\nHost: other\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "http", r.URL.Scheme)
+	assert.Equal(t, "/", r.URL.Path)
+	assert.Equal(t, "1", r.Query().Get("x"))
+	assert.Equal(t, "example.com:8080", r.Host)
+
+	// Test: Authority-form for CONNECT
+	r, err = RequestFromReader(strings.NewReader("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "example.com:443", r.URL.Host)
+	assert.Equal(t, "example.com:443", r.Host)
+
+	// Test: Asterisk-form for OPTIONS
+	r, err = RequestFromReader(strings.NewReader("OPTIONS * HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "*", r.URL.Path)
+
+	// Test: Targets that don't fit the method
+	invalid := []string{
+		"GET * HTTP/1.1",
+		"CONNECT /path HTTP/1.1",
+		"CONNECT example.com HTTP/1.1",
+		"GET ftp://example.com/ HTTP/1.1",
+		"GET http://user@example.com/ HTTP/1.1",
+		"GET path HTTP/1.1",
+		"GET /page#top HTTP/1.1",
+	}
+	var parseErr *ParseError
+	for _, line := range invalid {
+		_, err = RequestFromReader(strings.NewReader(line + "\r\nHost: localhost\r\n\r\n"))
+		require.ErrorAs(t, err, &parseErr, line)
+		assert.ErrorIs(t, err, ErrInvalidRequestTarget, line)
+		assert.Equal(t, response.StatusBadRequest, parseErr.StatusCode, line)
+	}
+
+	// Test: HTTP/1.1 requires a Host field, HTTP/1.0 doesn't
+	_, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\n\r\n"))
+	require.ErrorAs(t, err, &parseErr)
+	assert.ErrorIs(t, err, ErrMissingHost)
+	assert.Equal(t, response.StatusBadRequest, parseErr.StatusCode)
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "", r.Host)
+
+	// Test: More than one Host field
+	_, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: a\r\nHost: b\r\n\r\n"))
+	require.ErrorIs(t, err, ErrInvalidHost)
+}
+
+func TestNewRequest(t *testing.T) {
+	h := header.NewHeader()
+	h.Add("accept", "*/*")
+
+	// Test: The target and host are checked like a parsed request's
+	r, err := NewRequest("GET", "/search?q=go", "2.0", "example.com", h, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "/search", r.URL.Path)
+	assert.Equal(t, "go", r.Query().Get("q"))
+	assert.Equal(t, "example.com", r.Host)
+	assert.Equal(t, "2.0", r.RequestLine.HttpVersion)
+	assert.Equal(t, StateDone, r.ParserState)
+	n, err := r.Body.Read(make([]byte, 1))
+	assert.Equal(t, 0, n)
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: Without a host, the Host field is used
+	h.Set("host", "localhost:8080")
+	r, err = NewRequest("OPTIONS", "*", "2.0", "", h, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "localhost:8080", r.Host)
+
+	// Test: Errors carry the status they deserve
+	var parseErr *ParseError
+	_, err = NewRequest("BREW", "/", "2.0", "example.com", h, nil)
+	require.ErrorAs(t, err, &parseErr)
+	assert.Equal(t, response.StatusNotImplemented, parseErr.StatusCode)
+	_, err = NewRequest("GET", "no-slash", "2.0", "example.com", h, nil)
+	require.ErrorAs(t, err, &parseErr)
+	assert.Equal(t, response.StatusBadRequest, parseErr.StatusCode)
+	_, err = NewRequest("GET", "/", "2.0", "a b", h, nil)
+	assert.ErrorIs(t, err, ErrInvalidHost)
 }
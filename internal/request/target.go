@@ -0,0 +1,94 @@
+package request
+
+import (
+	"net/url"
+	"strings"
+)
+
+// parseRequestTarget parses the request target in one of the four forms of RFC 9112 section 3.2.
+// Which form is allowed depends on the method:
+//
+//	origin-form     /path?query      any method but CONNECT
+//	absolute-form   http://host/path any method but CONNECT, sent to proxies
+//	authority-form  host:port        CONNECT only
+//	asterisk-form   *                OPTIONS only
+func parseRequestTarget(method string, target string) (*url.URL, error) {
+	// fragments are for the client, they are never sent
+	if strings.Contains(target, "#") {
+		return nil, ErrInvalidRequestTarget
+	}
+
+	if method == "CONNECT" {
+		return parseAuthorityForm(target)
+	}
+	if target == "*" {
+		if method != "OPTIONS" {
+			return nil, ErrInvalidRequestTarget
+		}
+		return &url.URL{Path: "*"}, nil
+	}
+
+	u, err := url.ParseRequestURI(target)
+	if err != nil {
+		return nil, ErrInvalidRequestTarget
+	}
+	if strings.HasPrefix(target, "/") {
+		return u, nil
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+		return nil, ErrInvalidRequestTarget
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	return u, nil
+}
+
+// parseAuthorityForm parses the host:port target of a CONNECT request, the port is mandatory
+func parseAuthorityForm(target string) (*url.URL, error) {
+	if !validHost(target) {
+		return nil, ErrInvalidRequestTarget
+	}
+	u := &url.URL{Host: target}
+	if u.Port() == "" || u.Hostname() == "" {
+		return nil, ErrInvalidRequestTarget
+	}
+	return u, nil
+}
+
+// validHost reports whether host is a bare host with an optional port, nothing more
+func validHost(host string) bool {
+	if host == "" || strings.ContainsAny(host, " \t,/?#@") {
+		return false
+	}
+	u, err := url.Parse("//" + host)
+	return err == nil && u.Host == host
+}
+
+// parseHost decides which host the request is for once the header is complete (RFC 9112 section 3.2).
+// The host of an absolute-form target wins over the Host field
+func (r *Request) parseHost() error {
+	host := r.Header.Get("host")
+	// the header joins repeated fields with a comma, more than one Host is an error
+	if len(host) > 0 && !validHost(host) {
+		return ErrInvalidHost
+	}
+	if r.URL.Host != "" {
+		r.Host = r.URL.Host
+		return nil
+	}
+	// an empty Host is fine, it's the missing field HTTP/1.1 forbids
+	if !r.Header.Has("host") && r.RequestLine.HttpVersion != "1.0" {
+		return ErrMissingHost
+	}
+	r.Host = host
+	return nil
+}
+
+// Query returns the decoded query parameters of the request target
+func (r *Request) Query() url.Values {
+	if r.query == nil {
+		r.query = r.URL.Query()
+	}
+	return r.query
+}
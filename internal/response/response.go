@@ -1,61 +1,617 @@
 package response
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"io"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/nichol20/http-server/internal/header"
 )
 
-type StatusCode uint16
+// TimeFormat is the IMF-fixdate format used by Date and other HTTP dates (RFC 9110 section 5.6.7)
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// DefaultServerName is sent in the Server field unless the handler sets its own
+const DefaultServerName = "nichol20-http-server"
+
+// DefaultBufferSize is the size of the buffer between a Writer and the connection
+const DefaultBufferSize = 4 << 10
+
+// maxBufferedBody is how much of a body without Content-Length is held back hoping
+// the handler finishes, so it can be sent with a Content-Length instead of chunked
+const maxBufferedBody = 4 << 10
+
+var (
+	ErrInterimAfterFinal     = errors.New("informational response after the final status line")
+	ErrWriteOutOfOrder       = errors.New("response written out of order")
+	ErrBodyNotAllowed        = errors.New("response status does not allow a body")
+	ErrContentLengthExceeded = errors.New("body longer than the declared content-length")
+	ErrContentLengthShort    = errors.New("body shorter than the declared content-length")
+	ErrInvalidStatusCode     = errors.New("invalid status code")
+)
+
+// writerState is the part of the response the writer expects next.
+// A response goes through them in order, never back
+type writerState int
 
 const (
-	StatusOK                  StatusCode = 200
-	StatusBadRequest          StatusCode = 400
-	StatusInternalServerError StatusCode = 500
+	stateStatusLine writerState = iota
+	stateHeader
+	stateBody
+	// the last chunk was written and a Trailer was announced
+	stateTrailer
+	stateDone
 )
 
-var reasonPhrases = map[StatusCode]string{
-	StatusOK:                  "OK",
-	StatusBadRequest:          "Bad Request",
-	StatusInternalServerError: "Internal Server Error",
+var stateNames = map[writerState]string{
+	stateStatusLine: "status line",
+	stateHeader:     "header",
+	stateBody:       "body",
+	stateTrailer:    "trailer",
+	stateDone:       "end of the response",
 }
 
+// framing is how the end of the body is told to the client
+type framing int
+
+const (
+	// the header has no framing yet, the body is buffered until it's finished or too big
+	framingPending framing = iota
+	framingLength
+	framingChunked
+	// HTTP/1.0 without Content-Length, closing the connection ends the body
+	framingClose
+	// nothing follows the header, like for a 204 or a HEAD response too big to count
+	framingNone
+)
+
+// Writer writes a response in order: status line, header, body and trailer.
+// Calls out of that order fail with ErrWriteOutOfOrder.
+//
+// The header gets a Date and a Server field when missing. When it has neither Content-Length
+// nor Transfer-Encoding, the body is buffered: a small one is sent with a Content-Length
+// once Finish is called, a bigger one switches to chunked encoding. Bodies of HEAD, 204 and 304
+// responses are never sent.
+//
+// Everything goes through a buffer, so a response is usually sent in a single write.
+// Flush sends what was written so far, for streaming responses that can't wait.
+// An Encoder set with SetEncoder can encode the body on the way, like compressing it.
+//
+// A Writer made by NewStreamWriter sends the same response through a Stream instead,
+// so handlers don't need to know which protocol carries it
 type Writer struct {
-	ioWriter io.Writer
+	bw *bufio.Writer
+	// stream carries the response instead of bw when set
+	stream Stream
+	// whether the stream was ended, by the header of a bodyless response or after the body
+	ended bool
+	// HTTP version of the request being answered, "1.1", "1.0" or "2.0" for a stream
+	version    string
+	method     string
+	serverName string
+	keepAlive  bool
+	// asked when the header is sent, whether the connection is about to close anyway
+	closing    func() bool
+	state      writerState
+	statusCode StatusCode
+	framing    framing
+	// header held back while the framing is pending
+	header header.Header
+	// buffered body while the framing is pending
+	buf              []byte
+	contentLength    int64
+	written          int64
+	trailerAnnounced bool
+	// chooses the content coding once the header is final, nil once it has
+	encode Encoder
+	// the body goes through it when the encoder picked a content coding
+	encoder io.WriteCloser
+	// the Content-Length the handler declared for a body that got encoded, and how much
+	// went into the encoder. The encoded body has a length of its own
+	declaredLength int64
+	checkLength    bool
+	unencoded      int64
+	// first error returned by the underlying writer
+	err error
+}
+
+// Encoder picks a content coding for the body of a response, like gzip. It is called once,
+// when the header is final and before any of the body is sent, with the length of the body
+// or -1 when it isn't known yet. It may edit h, and returns the writer the body goes through
+// on its way to dst, or nil to send the body as is. Closing that writer ends the encoded body
+type Encoder func(statusCode StatusCode, h header.Header, size int64, dst io.Writer) io.WriteCloser
+
+// Stream carries a response over a protocol with its own framing, like an HTTP/2 stream.
+// The Writer still decides what the header and body are, the Stream only sends them.
+// endStream marks the last frame of the response
+type Stream interface {
+	WriteHeaders(statusCode StatusCode, h header.Header, endStream bool) error
+	WriteData(p []byte, endStream bool) error
+	// WriteTrailers sends the trailer fields, which end the stream
+	WriteTrailers(h header.Header) error
+	Flush() error
+}
+
+// Flusher is implemented by writers that can send buffered data to the client on demand
+type Flusher interface {
+	Flush() error
 }
 
+var _ Flusher = (*Writer)(nil)
+
+// NewWriter returns a Writer with a buffer of DefaultBufferSize
 func NewWriter(w io.Writer) *Writer {
+	return NewWriterSize(w, DefaultBufferSize)
+}
+
+// NewWriterSize returns a Writer whose buffer holds at least size bytes
+func NewWriterSize(w io.Writer, size int) *Writer {
+	return &Writer{
+		bw:         bufio.NewWriterSize(w, size),
+		version:    "1.1",
+		serverName: DefaultServerName,
+	}
+}
+
+// NewStreamWriter returns a Writer sending the response through s
+func NewStreamWriter(s Stream) *Writer {
 	return &Writer{
-		ioWriter: w,
+		stream:     s,
+		version:    "2.0",
+		serverName: DefaultServerName,
+		keepAlive:  true,
 	}
 }
 
-func (w *Writer) WriteStatusLine(statusCode int16) error {
-	rp := ""
-	if v, ok := reasonPhrases[StatusCode(statusCode)]; ok {
-		rp = v
+// SetVersion sets the HTTP version of the request being answered, which is echoed in
+// the status line. It must be called before anything is written
+func (w *Writer) SetVersion(version string) {
+	w.version = version
+}
+
+// SetMethod sets the method of the request being answered. The body of a response to HEAD
+// is not sent, but it still counts for the Content-Length
+func (w *Writer) SetMethod(method string) {
+	w.method = method
+}
+
+// SetServerName sets the value of the Server field added to the header, "" adds none
+func (w *Writer) SetServerName(name string) {
+	w.serverName = name
+}
+
+// SetEncoder sets the Encoder asked for the content coding of the body.
+// It must be called before the header is written
+func (w *Writer) SetEncoder(encode Encoder) {
+	w.encode = encode
+}
+
+// WriteStatusLine writes the status line of the final response. Informational codes
+// go through WriteInterim, except 101 Switching Protocols which ends the HTTP/1.1 exchange.
+// A stream has no status line, the code is sent with the header
+func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
+	switchProtocols := statusCode == StatusSwitchingProtocols && w.stream == nil
+	if !statusCode.Valid() || (statusCode.Informational() && !switchProtocols) {
+		return fmt.Errorf("%w: %d", ErrInvalidStatusCode, statusCode)
+	}
+	if w.state != stateStatusLine {
+		return w.outOfOrder("status line")
 	}
-	statusLine := fmt.Sprintf("HTTP/1.1 %d %s\r\n", statusCode, rp)
-	_, err := w.ioWriter.Write([]byte(statusLine))
+	w.state = stateHeader
+	w.statusCode = statusCode
+	if w.stream != nil {
+		return nil
+	}
+	_, err := w.write(w.statusLine(statusCode))
 	return err
 }
 
-func (w *Writer) WriteHeader(header header.Header) error {
-	b := []byte{}
-	for key, value := range header {
-		b = fmt.Appendf(b, "%s: %s\r\n", key, value)
+// WriteInterim sends an informational (1xx) response, like 100 Continue or 103 Early Hints
+// with Link fields. Any number of them may precede the final response, but none can follow it.
+// HTTP/1.0 clients don't understand them, so nothing is sent to those.
+// They are flushed right away, the client may be waiting for them
+func (w *Writer) WriteInterim(statusCode StatusCode, h header.Header) error {
+	if !statusCode.Informational() {
+		return fmt.Errorf("%w: %d is not an informational status code", ErrInvalidStatusCode, statusCode)
+	}
+	if w.state != stateStatusLine {
+		return ErrInterimAfterFinal
 	}
+	if w.version == "1.0" {
+		return nil
+	}
+	if w.stream != nil {
+		if h == nil {
+			h = header.NewHeader()
+		}
+		if err := w.record(w.stream.WriteHeaders(statusCode, h, false)); err != nil {
+			return err
+		}
+		return w.flush()
+	}
+	b := w.statusLine(statusCode)
+	b = h.Append(b, false)
 	b = fmt.Append(b, "\r\n")
-	_, err := w.ioWriter.Write(b)
+	if _, err := w.write(b); err != nil {
+		return err
+	}
+	return w.flush()
+}
+
+// StatusWritten reports whether the final status line was written
+func (w *Writer) StatusWritten() bool {
+	return w.state > stateStatusLine
+}
+
+func (w *Writer) statusLine(statusCode StatusCode) []byte {
+	return fmt.Appendf(nil, "HTTP/%s %d %s\r\n", w.version, statusCode, StatusText(statusCode))
+}
+
+// SetKeepAlive tells the writer whether the connection may be reused after this response.
+// Disabling it after WriteHeader still closes the connection once the handler returns,
+// which is how a handler gives up on a response it can't finish
+func (w *Writer) SetKeepAlive(keepAlive bool) {
+	w.keepAlive = keepAlive
+}
+
+// SetClosing sets a function asked whether the connection is closing, like during a shutdown.
+// It is called when the header is sent, a true makes the response announce Connection: close
+func (w *Writer) SetClosing(closing func() bool) {
+	w.closing = closing
+}
+
+// KeepAlive reports whether the connection can serve another request once this response is done.
+// A connection that failed a write is never reused
+func (w *Writer) KeepAlive() bool {
+	return w.keepAlive && w.err == nil
+}
+
+// Err returns the first error the underlying writer returned, if any
+func (w *Writer) Err() error {
+	return w.err
+}
+
+func (w *Writer) write(p []byte) (int, error) {
+	n, err := w.bw.Write(p)
+	return n, w.record(err)
+}
+
+// record keeps the first error of the underlying writer
+func (w *Writer) record(err error) error {
+	if err != nil && w.err == nil {
+		w.err = err
+	}
 	return err
 }
 
+// Flush sends everything written so far to the client. A body whose framing is still
+// pending switches to chunked encoding, its length can't be known yet
+func (w *Writer) Flush() error {
+	if w.state == stateBody && w.framing == framingPending {
+		if err := w.commit(false); err != nil {
+			return err
+		}
+	}
+	// what the encoder holds back has to go out too
+	if f, ok := w.encoder.(Flusher); ok {
+		if err := f.Flush(); err != nil {
+			return err
+		}
+	}
+	return w.flush()
+}
+
+func (w *Writer) flush() error {
+	if w.stream != nil {
+		return w.record(w.stream.Flush())
+	}
+	return w.record(w.bw.Flush())
+}
+
+func (w *Writer) outOfOrder(part string) error {
+	return fmt.Errorf("%w: %s written while expecting the %s", ErrWriteOutOfOrder, part, stateNames[w.state])
+}
+
+// HeaderWritten reports whether WriteHeader was called. The header itself may still be
+// held back until the framing of the body is known
+func (w *Writer) HeaderWritten() bool {
+	return w.state > stateHeader
+}
+
+// bodyless reports whether the body must not be sent (RFC 9110 section 6.4.1)
+func (w *Writer) bodyless() bool {
+	return w.method == "HEAD" || w.statusCode == 204 || w.statusCode == 304
+}
+
+func (w *Writer) WriteHeader(h header.Header) error {
+	if w.state != stateHeader {
+		return w.outOfOrder("header")
+	}
+	w.state = stateBody
+
+	h = h.Clone()
+	if !h.Has("date") {
+		h.Set("Date", time.Now().UTC().Format(TimeFormat))
+	}
+	if !h.Has("server") && w.serverName != "" {
+		h.Set("Server", w.serverName)
+	}
+	w.trailerAnnounced = h.Has("trailer")
+
+	// 204 and 304 have no body at all, a HEAD response keeps the fields of the GET one
+	if w.statusCode == 204 || w.statusCode == 304 {
+		h.Del("Transfer-Encoding")
+		h.Del("Trailer")
+		if w.statusCode == 204 {
+			h.Del("Content-Length")
+		}
+		w.trailerAnnounced = false
+		w.framing = framingNone
+		w.encode = nil
+		return w.sendHeader(h)
+	}
+
+	// without any framing the choice waits for the body, its length may still become known
+	if w.encode != nil && (h.Has("transfer-encoding") || h.Has("content-length") || w.trailerAnnounced) {
+		size := int64(-1)
+		if cl, err := strconv.ParseInt(h.Get("content-length"), 10, 64); err == nil && !h.Has("transfer-encoding") {
+			size = cl
+		}
+		w.startEncoding(h, size)
+		if w.encoder != nil && size >= 0 {
+			w.declaredLength, w.checkLength = size, true
+		}
+	}
+
+	switch {
+	case h.HasToken("transfer-encoding", "chunked"):
+		// a message can't have both, the chunks are what frame the body
+		h.Del("Content-Length")
+		w.framing = framingChunked
+	case h.Has("content-length"):
+		cl, err := strconv.ParseInt(h.Get("content-length"), 10, 64)
+		if err != nil || cl < 0 {
+			return fmt.Errorf("invalid content-length %q", h.Get("content-length"))
+		}
+		w.contentLength = cl
+		w.framing = framingLength
+	case w.trailerAnnounced:
+		// trailers only exist in chunked encoding
+		h.Set("Transfer-Encoding", "chunked")
+		w.framing = framingChunked
+	default:
+		w.framing = framingPending
+		w.header = h
+		return nil
+	}
+	return w.sendHeader(h)
+}
+
+// sendHeader writes the header once the framing is decided
+func (w *Writer) sendHeader(h header.Header) error {
+	if w.stream != nil {
+		return w.sendStreamHeader(h)
+	}
+	if w.closing != nil && w.closing() {
+		w.keepAlive = false
+	}
+	// HTTP/1.0 has no chunked encoding, a close delimited body is the only way to stream
+	if w.framing == framingChunked && w.version == "1.0" {
+		h.Del("Transfer-Encoding")
+		h.Del("Trailer")
+		w.trailerAnnounced = false
+		w.framing = framingClose
+	}
+	if w.framing == framingClose || h.HasToken("connection", "close") {
+		w.keepAlive = false
+	}
+
+	b := h.Append([]byte{}, false)
+	if !w.keepAlive && !h.HasToken("connection", "close") {
+		b = fmt.Append(b, "Connection: close\r\n")
+	}
+	// persistence is opt-in for HTTP/1.0, the client needs to see we agreed
+	if w.keepAlive && w.version == "1.0" && !h.HasToken("connection", "keep-alive") {
+		b = fmt.Append(b, "Connection: keep-alive\r\n")
+	}
+	b = fmt.Append(b, "\r\n")
+	w.header = nil
+	_, err := w.write(b)
+	return err
+}
+
+// sendStreamHeader sends the header through the stream, ending it right away when there is no body
+func (w *Writer) sendStreamHeader(h header.Header) error {
+	// a Stream has its own framing
+	h.DelConnectionFields()
+	w.header = nil
+	w.ended = w.bodyless()
+	return w.record(w.stream.WriteHeaders(w.statusCode, h, w.ended))
+}
+
+// endStream ends the stream after the body, once
+func (w *Writer) endStream() error {
+	if w.stream == nil || w.ended {
+		return nil
+	}
+	w.ended = true
+	return w.record(w.stream.WriteData(nil, true))
+}
+
+// startEncoding asks the encoder for the content coding of the body. The body kept so far
+// is returned, the caller writes it through the chosen encoding once the header is settled
+func (w *Writer) startEncoding(h header.Header, size int64) []byte {
+	encode := w.encode
+	w.encode = nil
+	enc := encode(w.statusCode, h, size, encodedBody{w})
+	if enc == nil {
+		return nil
+	}
+	if w.method == "HEAD" {
+		// the body of a HEAD response isn't sent, and the length of the encoded one can't be known
+		w.encoder = discardBody{}
+		w.buf, w.written = nil, 0
+		return nil
+	}
+	w.encoder = enc
+	kept := w.buf
+	w.buf, w.written = nil, 0
+	return kept
+}
+
+// encodedBody is where an encoder writes the encoded body
+type encodedBody struct {
+	w *Writer
+}
+
+func (e encodedBody) Write(p []byte) (int, error) {
+	return e.w.writeBody(p)
+}
+
+type discardBody struct{}
+
+func (discardBody) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (discardBody) Close() error {
+	return nil
+}
+
+// closeEncoder ends the encoded body, writing what the encoder still holds
+func (w *Writer) closeEncoder() error {
+	enc := w.encoder
+	if enc == nil {
+		return nil
+	}
+	w.encoder = nil
+	return enc.Close()
+}
+
+// commit sends the held back header, with a Content-Length when the whole body is buffered
+// or chunked encoding when more is coming
+func (w *Writer) commit(complete bool) error {
+	var kept []byte
+	if w.encode != nil && !complete {
+		kept = w.startEncoding(w.header, -1)
+	}
+	if err := w.sendPending(complete); err != nil {
+		return err
+	}
+	if len(kept) > 0 {
+		if _, err := w.encoder.Write(kept); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendPending sends the held back header and the buffered body
+func (w *Writer) sendPending(complete bool) error {
+	h := w.header
+	switch {
+	case complete && w.method == "HEAD" && w.written == 0:
+		// a handler that writes nothing for HEAD doesn't say how long the GET body is
+		w.framing = framingNone
+	case complete:
+		h.Set("Content-Length", strconv.FormatInt(w.written, 10))
+		w.contentLength = w.written
+		w.framing = framingLength
+	case w.method == "HEAD":
+		w.framing = framingNone
+	default:
+		h.Set("Transfer-Encoding", "chunked")
+		w.framing = framingChunked
+	}
+	if err := w.sendHeader(h); err != nil {
+		return err
+	}
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 || w.bodyless() {
+		return nil
+	}
+	return w.writeFramed(buf)
+}
+
+// writeFramed writes p as the framing of the response requires
+func (w *Writer) writeFramed(p []byte) error {
+	if w.stream != nil {
+		return w.record(w.stream.WriteData(p, false))
+	}
+	var err error
+	if w.framing == framingChunked {
+		_, err = w.write(fmt.Appendf(nil, "%X\r\n%s\r\n", len(p), p))
+	} else {
+		_, err = w.write(p)
+	}
+	return err
+}
+
+// WriteBody writes part of the body, framed as the header says. Writing more than the
+// Content-Length fails with ErrContentLengthExceeded and 204 and 304 responses can't have a body
 func (w *Writer) WriteBody(p []byte) (int, error) {
-	return w.ioWriter.Write(p)
+	if w.encoder != nil {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		if w.checkLength && w.unencoded+int64(len(p)) > w.declaredLength {
+			return 0, ErrContentLengthExceeded
+		}
+		n, err := w.encoder.Write(p)
+		w.unencoded += int64(n)
+		return n, err
+	}
+	return w.writeBody(p)
+}
+
+// writeBody writes part of the body once it is encoded
+func (w *Writer) writeBody(p []byte) (int, error) {
+	if w.state != stateBody {
+		return 0, w.outOfOrder("body")
+	}
+	if w.statusCode == 204 || w.statusCode == 304 {
+		return 0, ErrBodyNotAllowed
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if w.framing == framingLength && w.written+int64(len(p)) > w.contentLength {
+		return 0, ErrContentLengthExceeded
+	}
+	w.written += int64(len(p))
+
+	if w.framing == framingPending {
+		if w.method != "HEAD" {
+			w.buf = append(w.buf, p...)
+		}
+		if w.written <= maxBufferedBody {
+			return len(p), nil
+		}
+		if err := w.commit(false); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if w.bodyless() {
+		return len(p), nil
+	}
+	if err := w.writeFramed(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
 }
 
-func (w *Writer) WriteRespose(statusCode int16, header header.Header, message []byte) error {
+// Write makes the Writer an io.Writer of the body, it is the same as WriteBody
+func (w *Writer) Write(p []byte) (int, error) {
+	return w.WriteBody(p)
+}
+
+func (w *Writer) WriteRespose(statusCode StatusCode, header header.Header, message []byte) error {
 	err := w.WriteStatusLine(statusCode)
 	if err != nil {
 		return fmt.Errorf("error writing status line: %w", err)
@@ -71,22 +627,207 @@ func (w *Writer) WriteRespose(statusCode int16, header header.Header, message []
 	return nil
 }
 
+// WriteChunkedBody writes a chunk of a chunked response. A response whose framing is
+// still open becomes chunked
 func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
-	return w.ioWriter.Write([]byte(fmt.Sprintf("%X\r\n%s\r\n", len(p), p)))
+	if w.state != stateBody {
+		return 0, w.outOfOrder("chunk")
+	}
+	if w.framing == framingLength {
+		return 0, fmt.Errorf("%w: chunk written to a response with a content-length", ErrWriteOutOfOrder)
+	}
+	if w.framing == framingPending {
+		if err := w.commit(false); err != nil {
+			return 0, err
+		}
+	}
+	return w.WriteBody(p)
 }
 
+// WriteChunkedBodyDone writes the last chunk. If a Trailer header was sent,
+// the message is only finished after WriteTrailer is called
 func (w *Writer) WriteChunkedBodyDone() (int, error) {
-	return w.ioWriter.Write([]byte("0\r\n\r\n"))
+	if w.state != stateBody {
+		return 0, w.outOfOrder("last chunk")
+	}
+	if w.framing == framingPending {
+		if err := w.commit(false); err != nil {
+			return 0, err
+		}
+	}
+	if err := w.closeEncoder(); err != nil {
+		return 0, err
+	}
+	if w.framing != framingChunked || w.bodyless() {
+		w.state = stateDone
+		return 0, w.endStream()
+	}
+	if w.trailerAnnounced {
+		w.state = stateTrailer
+		if w.stream != nil {
+			return 0, nil
+		}
+		return w.write([]byte("0\r\n"))
+	}
+	if w.stream != nil {
+		w.state = stateDone
+		return 0, w.endStream()
+	}
+	w.state = stateDone
+	return w.write([]byte("0\r\n\r\n"))
 }
 
+// WriteTrailer writes the trailer fields after the last chunk. They are dropped
+// when the body was not chunked, like for HTTP/1.0 clients, which have no way to receive them
 func (w *Writer) WriteTrailer(h header.Header) error {
-	return w.WriteHeader(h)
+	if w.state == stateDone && (w.framing != framingChunked || w.bodyless()) {
+		return nil
+	}
+	if w.state != stateTrailer {
+		return w.outOfOrder("trailer")
+	}
+	w.state = stateDone
+	if w.stream != nil {
+		if len(h) == 0 {
+			return w.endStream()
+		}
+		w.ended = true
+		return w.record(w.stream.WriteTrailers(h))
+	}
+	b := h.Append([]byte{}, false)
+	b = fmt.Append(b, "\r\n")
+	_, err := w.write(b)
+	return err
+}
+
+// Finish completes the response once the handler is done: a missing status line becomes
+// a 200, a held back header and body are sent, a chunked body gets its last chunk and
+// the buffer is flushed. A stream is ended, unless its body is shorter than its Content-Length.
+// An encoded body shorter than the declared Content-Length fails with ErrContentLengthShort
+// and the connection is not kept alive
+func (w *Writer) Finish() error {
+	if w.state == stateStatusLine {
+		if err := w.WriteStatusLine(200); err != nil {
+			return err
+		}
+	}
+	if w.state == stateHeader {
+		if err := w.WriteHeader(header.NewHeader()); err != nil {
+			return err
+		}
+	}
+	if w.state == stateBody {
+		if err := w.finishEncoding(); err != nil {
+			return err
+		}
+		switch w.framing {
+		case framingPending:
+			if err := w.commit(true); err != nil {
+				return err
+			}
+			w.state = stateDone
+			if err := w.endStream(); err != nil {
+				return err
+			}
+		case framingLength:
+			w.state = stateDone
+			// the client is still waiting for the rest of the body, only a close tells it there is none.
+			// A stream stays open for whoever serves it to reset
+			if w.written < w.contentLength && !w.bodyless() {
+				w.keepAlive = false
+			} else if err := w.endStream(); err != nil {
+				return err
+			}
+		case framingChunked:
+			if _, err := w.WriteChunkedBodyDone(); err != nil {
+				return err
+			}
+		default:
+			w.state = stateDone
+			if err := w.endStream(); err != nil {
+				return err
+			}
+		}
+	}
+	if w.state == stateTrailer {
+		if err := w.WriteTrailer(header.NewHeader()); err != nil {
+			return err
+		}
+	}
+	if err := w.flush(); err != nil {
+		return err
+	}
+	return w.err
+}
+
+// finishEncoding ends the encoded body. When the choice of the encoding was waiting for the
+// body, it is made now that its length is known. A body shorter than the Content-Length the
+// handler declared is not ended, the client would take what it got for the whole body
+func (w *Writer) finishEncoding() error {
+	if w.checkLength && w.unencoded < w.declaredLength && !w.bodyless() {
+		enc := w.encoder
+		w.encoder = nil
+		w.keepAlive = false
+		w.state = stateDone
+		// closing it lets it go back to wherever it came from, what it still
+		// holds is refused now that the response is done
+		enc.Close()
+		return ErrContentLengthShort
+	}
+	if w.framing == framingPending && w.encode != nil {
+		if kept := w.startEncoding(w.header, w.written); len(kept) > 0 {
+			if _, err := w.encoder.Write(kept); err != nil {
+				return err
+			}
+		}
+	}
+	return w.closeEncoder()
 }
 
 func GetDefaultHeaders(contentLen int) header.Header {
-	h := header.Header{}
+	h := header.NewHeader()
 	h.Set("Content-Length", fmt.Sprintf("%d", contentLen))
-	h.Set("Connection", "close")
 	h.Set("Content-Type", "text/plain")
 	return h
 }
+
+// Error replies with a plain text body holding message. It has to be called before
+// anything else was written
+func (w *Writer) Error(statusCode StatusCode, message string) error {
+	h := GetDefaultHeaders(len(message))
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	// the message may echo user input, it must not be taken for html
+	h.Set("X-Content-Type-Options", "nosniff")
+	return w.WriteRespose(statusCode, h, []byte(message))
+}
+
+// Redirect replies with a redirect to location. Bytes that can't appear in a URI, like
+// spaces, control characters and non-ASCII ones, are percent-encoded, the rest is sent as is.
+// statusCode has to be a 3xx code, like StatusFound or StatusPermanentRedirect
+func (w *Writer) Redirect(location string, statusCode StatusCode) error {
+	if statusCode < 300 || statusCode > 399 {
+		return fmt.Errorf("%w: %d is not a redirect", ErrInvalidStatusCode, statusCode)
+	}
+	location = escapeLocation(location)
+	body := fmt.Sprintf("%s: %s\n", StatusText(statusCode), location)
+	h := GetDefaultHeaders(len(body))
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	h.Set("Location", location)
+	return w.WriteRespose(statusCode, h, []byte(body))
+}
+
+// escapeLocation percent-encodes the bytes of a URI reference that RFC 3986 doesn't allow.
+// A '%' is kept, location may be escaped already
+func escapeLocation(location string) string {
+	const unsafe = "\"<>\\^`{|}"
+	var b strings.Builder
+	for i := 0; i < len(location); i++ {
+		c := location[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(unsafe, c) >= 0 {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
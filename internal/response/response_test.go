@@ -0,0 +1,505 @@
+package response
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/nichol20/http-server/internal/header"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testDate = "Wed, 21 Oct 2015 07:28:00 GMT"
+
+func TestWriteInterim(t *testing.T) {
+	// Test: Early hints before the final response
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	hints := header.NewHeader()
+	hints.Set("Link", "</style.css>; rel=preload; as=style")
+	require.NoError(t, w.WriteInterim(103, hints))
+	require.NoError(t, w.WriteRespose(200, GetDefaultHeaders(0), nil))
+	require.NoError(t, w.Finish())
+	want := "HTTP/1.1 103 Early Hints\r\nLink: </style.css>; rel=preload; as=style\r\n\r\nHTTP/1.1 200 OK\r\n"
+	assert.True(t, strings.HasPrefix(buf.String(), want), buf.String())
+
+	// Test: No interim response after the final one
+	require.ErrorIs(t, w.WriteInterim(100, nil), ErrInterimAfterFinal)
+
+	// Test: Only 1xx codes
+	w = NewWriter(&bytes.Buffer{})
+	require.Error(t, w.WriteInterim(200, nil))
+}
+
+func TestConnectionClose(t *testing.T) {
+	// Test: A keep-alive response with framing doesn't announce close
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteRespose(200, GetDefaultHeaders(2), []byte("ok")))
+	require.NoError(t, w.Finish())
+	assert.True(t, w.KeepAlive())
+	assert.NotContains(t, buf.String(), "Connection: close")
+
+	// Test: Connection close from the handler
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.SetKeepAlive(true)
+	h := GetDefaultHeaders(0)
+	h.Set("Connection", "close")
+	require.NoError(t, w.WriteRespose(200, h, nil))
+	require.NoError(t, w.Finish())
+	assert.False(t, w.KeepAlive())
+	assert.Equal(t, 1, strings.Count(buf.String(), "Connection: close\r\n"))
+}
+
+func TestChunkedTrailer(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	h := header.NewHeader()
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-Sum")
+	require.NoError(t, w.WriteStatusLine(200))
+	require.NoError(t, w.WriteHeader(h))
+	_, err := w.WriteChunkedBody([]byte("hello"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	trailer := header.NewHeader()
+	trailer.Set("X-Sum", "1")
+	require.NoError(t, w.WriteTrailer(trailer))
+	require.NoError(t, w.Finish())
+	assert.Contains(t, buf.String(), "\r\n\r\n5\r\nhello\r\n0\r\nX-Sum: 1\r\n\r\n")
+}
+
+func TestChunkedDropsContentLength(t *testing.T) {
+	// Test: Chunked encoding wins over a Content-Length set along with it
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	h := GetDefaultHeaders(5)
+	h.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteStatusLine(200))
+	require.NoError(t, w.WriteHeader(h))
+	_, err := w.WriteChunkedBody([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Contains(t, buf.String(), "Transfer-Encoding: chunked\r\n")
+	assert.NotContains(t, buf.String(), "Content-Length")
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n5\r\nhello\r\n0\r\n\r\n"), buf.String())
+}
+
+func TestHTTP10(t *testing.T) {
+	// Test: The status line echoes the request version and keep-alive is announced
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.SetVersion("1.0")
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteRespose(200, GetDefaultHeaders(2), []byte("ok")))
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.0 200 OK\r\n"), buf.String())
+	assert.Contains(t, buf.String(), "Connection: keep-alive\r\n")
+	assert.True(t, w.KeepAlive())
+
+	// Test: No interim responses
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.SetVersion("1.0")
+	require.NoError(t, w.WriteInterim(100, nil))
+	assert.Empty(t, buf.String())
+
+	// Test: Chunked bodies fall back to a close delimited body
+	w.SetKeepAlive(true)
+	w.SetServerName("")
+	h := header.NewHeader()
+	h.Set("Date", testDate)
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-Sum")
+	require.NoError(t, w.WriteStatusLine(200))
+	require.NoError(t, w.WriteHeader(h))
+	_, err := w.WriteChunkedBody([]byte("hello"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	trailer := header.NewHeader()
+	trailer.Set("X-Sum", "1")
+	require.NoError(t, w.WriteTrailer(trailer))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.0 200 OK\r\nDate: "+testDate+"\r\nConnection: close\r\n\r\nhello", buf.String())
+	assert.False(t, w.KeepAlive())
+}
+
+func TestSetCookie(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.SetServerName("")
+	h := GetDefaultHeaders(0)
+	h.Set("Date", testDate)
+	h.Add("Set-Cookie", "a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT")
+	h.Add("Set-Cookie", "b=2")
+	require.NoError(t, w.WriteRespose(200, h, nil))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+		"Content-Length: 0\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"Date: "+testDate+"\r\n"+
+		"Set-Cookie: a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT\r\n"+
+		"Set-Cookie: b=2\r\n"+
+		"Connection: close\r\n"+
+		"\r\n", buf.String())
+}
+
+func TestWriterState(t *testing.T) {
+	// Test: Body before the status line and the header
+	w := NewWriter(&bytes.Buffer{})
+	_, err := w.WriteBody([]byte("x"))
+	require.ErrorIs(t, err, ErrWriteOutOfOrder)
+	require.ErrorIs(t, w.WriteHeader(header.NewHeader()), ErrWriteOutOfOrder)
+
+	// Test: Status line or header twice
+	require.NoError(t, w.WriteStatusLine(200))
+	require.ErrorIs(t, w.WriteStatusLine(200), ErrWriteOutOfOrder)
+	require.NoError(t, w.WriteHeader(GetDefaultHeaders(1)))
+	require.ErrorIs(t, w.WriteHeader(GetDefaultHeaders(1)), ErrWriteOutOfOrder)
+
+	// Test: More than the declared Content-Length
+	_, err = w.WriteBody([]byte("ab"))
+	require.ErrorIs(t, err, ErrContentLengthExceeded)
+
+	// Test: Trailer without a chunked body
+	require.ErrorIs(t, w.WriteTrailer(header.NewHeader()), ErrWriteOutOfOrder)
+
+	// Test: A body shorter than its Content-Length closes the connection
+	w.SetKeepAlive(true)
+	require.NoError(t, w.Finish())
+	assert.False(t, w.KeepAlive())
+	_, err = w.WriteBody([]byte("x"))
+	require.ErrorIs(t, err, ErrWriteOutOfOrder)
+}
+
+func TestAutomaticFraming(t *testing.T) {
+	// Test: Date and Server are added, a small body gets a Content-Length
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.SetKeepAlive(true)
+	h := header.NewHeader()
+	h.Set("Content-Type", "text/plain")
+	require.NoError(t, w.WriteStatusLine(200))
+	require.NoError(t, w.WriteHeader(h))
+	_, err := w.WriteBody([]byte("hello "))
+	require.NoError(t, err)
+	_, err = w.WriteBody([]byte("world"))
+	require.NoError(t, err)
+	// nothing is sent before the response is finished
+	assert.Empty(t, buf.String())
+	require.NoError(t, w.Finish())
+	assert.Contains(t, buf.String(), "\r\nDate: ")
+	assert.Contains(t, buf.String(), "\r\nServer: "+DefaultServerName+"\r\n")
+	assert.True(t, strings.HasSuffix(buf.String(), "Content-Length: 11\r\n\r\nhello world"), buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: A big body switches to chunked encoding
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(200))
+	require.NoError(t, w.WriteHeader(header.NewHeader()))
+	big := strings.Repeat("a", maxBufferedBody+1)
+	_, err = w.WriteBody([]byte(big))
+	require.NoError(t, err)
+	_, err = w.WriteBody([]byte("b"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Contains(t, buf.String(), "Transfer-Encoding: chunked\r\n")
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n1001\r\n"+big+"\r\n1\r\nb\r\n0\r\n\r\n"), buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Nothing written at all is an empty 200
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, buf.String(), "Content-Length: 0\r\n")
+}
+
+func TestBodylessResponses(t *testing.T) {
+	// Test: HEAD gets the Content-Length of the body but not the body
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.SetMethod("HEAD")
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(200))
+	require.NoError(t, w.WriteHeader(header.NewHeader()))
+	n, err := w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(buf.String(), "Content-Length: 5\r\n\r\n"), buf.String())
+
+	// Test: HEAD with an explicit Content-Length
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.SetMethod("HEAD")
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteRespose(200, GetDefaultHeaders(5), []byte("hello")))
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n"), buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: 204 drops the framing fields and refuses a body
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	h := GetDefaultHeaders(5)
+	h.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteStatusLine(204))
+	require.NoError(t, w.WriteHeader(h))
+	_, err = w.WriteBody([]byte("hello"))
+	require.ErrorIs(t, err, ErrBodyNotAllowed)
+	require.NoError(t, w.Finish())
+	assert.NotContains(t, buf.String(), "Content-Length")
+	assert.NotContains(t, buf.String(), "Transfer-Encoding")
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n"), buf.String())
+
+	// Test: 304 keeps the Content-Length
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(304))
+	require.NoError(t, w.WriteHeader(GetDefaultHeaders(5)))
+	require.NoError(t, w.Finish())
+	assert.Contains(t, buf.String(), "Content-Length: 5\r\n")
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n"), buf.String())
+}
+
+// countingWriter counts the writes reaching the connection
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.writes++
+	return c.Buffer.Write(p)
+}
+
+func TestFlush(t *testing.T) {
+	// Test: A whole response goes out in a single write
+	conn := &countingWriter{}
+	w := NewWriter(conn)
+	require.NoError(t, w.WriteRespose(200, GetDefaultHeaders(5), []byte("hello")))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, 1, conn.writes)
+
+	// Test: Flush sends a streamed body right away, committing to chunked encoding
+	conn = &countingWriter{}
+	w = NewWriter(conn)
+	var f Flusher = w
+	require.NoError(t, w.WriteStatusLine(200))
+	require.NoError(t, w.WriteHeader(header.NewHeader()))
+	_, err := w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, f.Flush())
+	assert.Equal(t, 1, conn.writes)
+	assert.True(t, strings.HasSuffix(conn.String(), "Transfer-Encoding: chunked\r\nConnection: close\r\n\r\n5\r\nhello\r\n"), conn.String())
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(conn.String(), "5\r\nhello\r\n0\r\n\r\n"), conn.String())
+
+	// Test: Interim responses are flushed on their own
+	conn = &countingWriter{}
+	w = NewWriterSize(conn, 64)
+	require.NoError(t, w.WriteInterim(100, nil))
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n\r\n", conn.String())
+}
+
+// upperEncoder is an Encoder upper-casing the body, it records the sizes it was asked about
+type upperEncoder struct {
+	sizes []int64
+}
+
+type upperWriter struct {
+	dst io.Writer
+}
+
+func (u upperWriter) Write(p []byte) (int, error) {
+	return u.dst.Write(bytes.ToUpper(p))
+}
+
+func (u upperWriter) Close() error {
+	_, err := u.dst.Write([]byte("!"))
+	return err
+}
+
+func (e *upperEncoder) encode(statusCode StatusCode, h header.Header, size int64, dst io.Writer) io.WriteCloser {
+	e.sizes = append(e.sizes, size)
+	if size >= 0 && size < 3 {
+		return nil
+	}
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", "upper")
+	return upperWriter{dst}
+}
+
+func TestEncoder(t *testing.T) {
+	h := header.NewHeader()
+	h.Set("Date", testDate)
+
+	// Test: The length of a buffered body is known when the encoding is chosen
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	enc := &upperEncoder{}
+	w.SetEncoder(enc.encode)
+	require.NoError(t, w.WriteRespose(200, h, []byte("hello")))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, []int64{5}, enc.sizes)
+	assert.Contains(t, buf.String(), "Content-Encoding: upper\r\n")
+	assert.True(t, strings.HasSuffix(buf.String(), "Content-Length: 6\r\nConnection: close\r\n\r\nHELLO!"), buf.String())
+
+	// Test: A declared Content-Length is the length the encoder sees
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	enc = &upperEncoder{}
+	w.SetEncoder(enc.encode)
+	require.NoError(t, w.WriteRespose(200, GetDefaultHeaders(2), []byte("hi")))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, []int64{2}, enc.sizes)
+	assert.NotContains(t, buf.String(), "Content-Encoding")
+	assert.Contains(t, buf.String(), "Content-Length: 2\r\n")
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nhi"), buf.String())
+
+	// Test: A streamed body is encoded as it goes, its length unknown
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	enc = &upperEncoder{}
+	w.SetEncoder(enc.encode)
+	require.NoError(t, w.WriteStatusLine(200))
+	require.NoError(t, w.WriteHeader(h))
+	_, err := w.WriteBody([]byte("abc"))
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+	_, err = w.WriteBody([]byte("def"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, []int64{-1}, enc.sizes)
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n3\r\nABC\r\n3\r\nDEF\r\n1\r\n!\r\n0\r\n\r\n"), buf.String())
+
+	// Test: A HEAD response gets the encoded fields, without a length it can't know
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.SetMethod("HEAD")
+	enc = &upperEncoder{}
+	w.SetEncoder(enc.encode)
+	require.NoError(t, w.WriteRespose(200, h, []byte("hello")))
+	require.NoError(t, w.Finish())
+	assert.Contains(t, buf.String(), "Content-Encoding: upper\r\n")
+	assert.NotContains(t, buf.String(), "Content-Length")
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n"), buf.String())
+
+	// Test: Bodyless statuses don't ask
+	w = NewWriter(&bytes.Buffer{})
+	enc = &upperEncoder{}
+	w.SetEncoder(enc.encode)
+	require.NoError(t, w.WriteStatusLine(304))
+	require.NoError(t, w.WriteHeader(h))
+	require.NoError(t, w.Finish())
+	assert.Empty(t, enc.sizes)
+}
+
+// recordingStream records what a Writer sends through it, one line per call
+type recordingStream struct {
+	calls []string
+	body  []byte
+}
+
+func (s *recordingStream) WriteHeaders(statusCode StatusCode, h header.Header, endStream bool) error {
+	h.Del("Date")
+	h.Del("Server")
+	s.calls = append(s.calls, fmt.Sprintf("headers %d %q end=%t", statusCode, h.Names(), endStream))
+	return nil
+}
+
+func (s *recordingStream) WriteData(p []byte, endStream bool) error {
+	s.body = append(s.body, p...)
+	s.calls = append(s.calls, fmt.Sprintf("data %d end=%t", len(p), endStream))
+	return nil
+}
+
+func (s *recordingStream) WriteTrailers(h header.Header) error {
+	s.calls = append(s.calls, fmt.Sprintf("trailers %q", h.Names()))
+	return nil
+}
+
+func (s *recordingStream) Flush() error {
+	s.calls = append(s.calls, "flush")
+	return nil
+}
+
+func TestStreamWriter(t *testing.T) {
+	// Test: A small body is sent with its length and ends the stream
+	s := &recordingStream{}
+	w := NewStreamWriter(s)
+	h := header.NewHeader()
+	h.Set("Content-Type", "text/plain")
+	h.Set("Connection", "keep-alive, X-Hop")
+	h.Set("X-Hop", "1")
+	require.NoError(t, w.WriteRespose(200, h, []byte("hello")))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, []string{
+		`headers 200 ["Content-Type" "Content-Length"] end=false`,
+		"data 5 end=false",
+		"data 0 end=true",
+		"flush",
+	}, s.calls)
+	assert.Equal(t, "hello", string(s.body))
+
+	// Test: A bodyless response ends the stream with its header
+	for _, method := range []string{"GET", "HEAD"} {
+		s = &recordingStream{}
+		w = NewStreamWriter(s)
+		w.SetMethod(method)
+		require.NoError(t, w.WriteStatusLine(204))
+		require.NoError(t, w.WriteHeader(header.NewHeader()))
+		require.NoError(t, w.Finish())
+		assert.Equal(t, []string{`headers 204 [] end=true`, "flush"}, s.calls, method)
+	}
+
+	// Test: Chunked responses stream their data, without any chunked encoding, and end with the trailer
+	s = &recordingStream{}
+	w = NewStreamWriter(s)
+	h = header.NewHeader()
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-Checksum")
+	require.NoError(t, w.WriteStatusLine(200))
+	require.NoError(t, w.WriteHeader(h))
+	_, err := w.WriteChunkedBody([]byte("part"))
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	trailer := header.NewHeader()
+	trailer.Set("X-Checksum", "abc")
+	require.NoError(t, w.WriteTrailer(trailer))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, []string{
+		`headers 200 ["Trailer"] end=false`,
+		"data 4 end=false",
+		"flush",
+		`trailers ["X-Checksum"]`,
+		"flush",
+	}, s.calls)
+
+	// Test: Interim responses go out right away, 101 can't be sent at all
+	s = &recordingStream{}
+	w = NewStreamWriter(s)
+	require.NoError(t, w.WriteInterim(100, nil))
+	assert.Equal(t, []string{`headers 100 [] end=false`, "flush"}, s.calls)
+	assert.ErrorIs(t, w.WriteStatusLine(101), ErrInvalidStatusCode)
+
+	// Test: A body short of its Content-Length leaves the stream open
+	s = &recordingStream{}
+	w = NewStreamWriter(s)
+	require.NoError(t, w.WriteRespose(200, GetDefaultHeaders(10), []byte("short")))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "data 5 end=false", s.calls[len(s.calls)-2])
+	assert.False(t, w.KeepAlive())
+}
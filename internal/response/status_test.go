@@ -0,0 +1,79 @@
+package response
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusText(t *testing.T) {
+	assert.Equal(t, "OK", StatusText(StatusOK))
+	assert.Equal(t, "Range Not Satisfiable", StatusText(416))
+	assert.Equal(t, "Network Authentication Required", StatusText(StatusNetworkAuthenticationRequired))
+	assert.Equal(t, "", StatusText(299))
+
+	// Test: Every registered code is in range and has a phrase
+	for code, text := range reasonPhrases {
+		assert.True(t, code.Valid(), code)
+		assert.NotEmpty(t, text, code)
+	}
+}
+
+func TestStatusValidation(t *testing.T) {
+	// Test: Codes outside 100-599
+	for _, code := range []StatusCode{0, 99, 600, 1000} {
+		w := NewWriter(&bytes.Buffer{})
+		require.ErrorIs(t, w.WriteStatusLine(code), ErrInvalidStatusCode, code)
+		assert.False(t, w.StatusWritten())
+	}
+
+	// Test: Interim codes can't be the final status, except 101
+	w := NewWriter(&bytes.Buffer{})
+	require.ErrorIs(t, w.WriteStatusLine(StatusContinue), ErrInvalidStatusCode)
+	require.NoError(t, w.WriteStatusLine(StatusSwitchingProtocols))
+
+	// Test: An unregistered code has an empty reason phrase
+	buf := &bytes.Buffer{}
+	w = NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(299))
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 299 \r\n", buf.String())
+}
+
+func TestError(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	require.NoError(t, w.Error(StatusForbidden, "no access"))
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 403 Forbidden\r\n"), buf.String())
+	assert.Contains(t, buf.String(), "Content-Type: text/plain; charset=utf-8\r\n")
+	assert.Contains(t, buf.String(), "X-Content-Type-Options: nosniff\r\n")
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nno access"), buf.String())
+
+	// Test: Not after the status line
+	require.ErrorIs(t, w.Error(StatusInternalServerError, "oops"), ErrWriteOutOfOrder)
+}
+
+func TestRedirect(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	require.NoError(t, w.Redirect("/new/place", StatusMovedPermanently))
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 301 Moved Permanently\r\n"), buf.String())
+	assert.Contains(t, buf.String(), "Location: /new/place\r\n")
+
+	// Test: The location is escaped, it can't add field lines
+	buf.Reset()
+	w = NewWriter(buf)
+	require.NoError(t, w.Redirect("/a b/é?q=%41\r\nSet-Cookie: p=1", StatusFound))
+	require.NoError(t, w.Finish())
+	assert.Contains(t, buf.String(), "Location: /a%20b/%C3%A9?q=%41%0D%0ASet-Cookie:%20p=1\r\n")
+	assert.NotContains(t, buf.String(), "\r\nSet-Cookie")
+
+	// Test: Only 3xx codes
+	w = NewWriter(&bytes.Buffer{})
+	require.ErrorIs(t, w.Redirect("/", StatusOK), ErrInvalidStatusCode)
+}
@@ -0,0 +1,334 @@
+package router
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/nichol20/http-server/internal/request"
+	"github.com/nichol20/http-server/internal/response"
+	"github.com/nichol20/http-server/internal/server"
+)
+
+type segmentKind int
+
+// the order matters, a bigger kind is more specific
+const (
+	segmentWildcard segmentKind = iota
+	segmentParam
+	segmentLiteral
+)
+
+type segment struct {
+	kind segmentKind
+	// literal text, or the parameter name for params and wildcards
+	value string
+}
+
+type route struct {
+	method   string
+	pattern  string
+	segments []segment
+	handler  server.Handler
+}
+
+// Router dispatches requests to the handler of the most specific matching pattern.
+//
+// A pattern is an optional method followed by a path, like "GET /users/{id}" or "/health".
+// A segment written as {name} matches any single segment and a trailing {name...} matches
+// the rest of the path, including nothing. Both are available through req.PathValue(name).
+// A literal segment is more specific than a parameter, which is more specific than a wildcard.
+// Patterns without a method match every method and GET patterns also match HEAD. Between
+// equally specific paths, the pattern naming the method wins over a GET one matching HEAD,
+// which wins over one without a method
+type Router struct {
+	routes      []*route
+	middlewares []server.Middleware
+
+	// NotFound handles requests that match no pattern. Defaults to a plain text 404
+	NotFound server.Handler
+	// MethodNotAllowed handles requests whose path matches but whose method doesn't.
+	// allowed is already sent in the Allow header by the default handler
+	MethodNotAllowed func(w *response.Writer, req *request.Request, allowed []string)
+}
+
+func New() *Router {
+	return &Router{}
+}
+
+// Use adds middlewares that run for every request, including the ones answered with 404 or 405
+func (r *Router) Use(middlewares ...server.Middleware) {
+	r.middlewares = append(r.middlewares, middlewares...)
+}
+
+// Handle registers handler for pattern. It panics if the pattern is invalid or
+// conflicts with one already registered
+func (r *Router) Handle(pattern string, handler server.Handler) {
+	r.handle("", pattern, handler)
+}
+
+func (r *Router) HandleFunc(pattern string, handler server.HandlerFunc) {
+	r.Handle(pattern, handler)
+}
+
+// Group returns a group whose patterns are prefixed with prefix and wrapped with middlewares
+func (r *Router) Group(prefix string, middlewares ...server.Middleware) *Group {
+	return &Group{router: r, prefix: strings.TrimSuffix(prefix, "/"), middlewares: middlewares}
+}
+
+func (r *Router) ServeHTTP(w *response.Writer, req *request.Request) {
+	server.Chain(server.HandlerFunc(r.dispatch), r.middlewares...).ServeHTTP(w, req)
+}
+
+func (r *Router) handle(prefix string, pattern string, handler server.Handler) {
+	method, path, found := strings.Cut(pattern, " ")
+	if !found {
+		method, path = "", pattern
+	}
+	path = prefix + strings.TrimSpace(path)
+
+	segments, err := parsePattern(path)
+	if err != nil {
+		panic(fmt.Sprintf("router: invalid pattern %q: %v", pattern, err))
+	}
+	rt := &route{method: method, pattern: path, segments: segments, handler: handler}
+	for _, other := range r.routes {
+		if other.method == rt.method && sameShape(other.segments, rt.segments) {
+			panic(fmt.Sprintf("router: pattern %q conflicts with %q", pattern, other.pattern))
+		}
+	}
+	r.routes = append(r.routes, rt)
+}
+
+func (r *Router) dispatch(w *response.Writer, req *request.Request) {
+	// segments are unescaped one by one, so an encoded slash stays inside its segment
+	path := req.URL.EscapedPath()
+	method := req.RequestLine.Method
+
+	var best *route
+	var bestValues map[string]string
+	allowed := []string{}
+	for _, rt := range r.routes {
+		values, ok := match(rt.segments, path)
+		if !ok {
+			continue
+		}
+		if !methodMatches(rt.method, method) {
+			allowed = append(allowed, rt.method)
+			if rt.method == "GET" {
+				allowed = append(allowed, "HEAD")
+			}
+			continue
+		}
+		if best == nil || moreSpecificRoute(rt, best, method) {
+			best, bestValues = rt, values
+		}
+	}
+
+	if best != nil {
+		for name, value := range bestValues {
+			req.SetPathValue(name, value)
+		}
+		best.handler.ServeHTTP(w, req)
+		return
+	}
+	if len(allowed) > 0 {
+		slices.Sort(allowed)
+		allowed = slices.Compact(allowed)
+		if r.MethodNotAllowed != nil {
+			r.MethodNotAllowed(w, req, allowed)
+			return
+		}
+		methodNotAllowed(w, req, allowed)
+		return
+	}
+	if r.NotFound != nil {
+		r.NotFound.ServeHTTP(w, req)
+		return
+	}
+	notFound(w, req)
+}
+
+// Group registers routes under a shared prefix with shared middlewares
+type Group struct {
+	router      *Router
+	prefix      string
+	middlewares []server.Middleware
+}
+
+// Use adds middlewares to the group. They only apply to routes registered afterwards
+func (g *Group) Use(middlewares ...server.Middleware) {
+	g.middlewares = append(g.middlewares, middlewares...)
+}
+
+func (g *Group) Handle(pattern string, handler server.Handler) {
+	g.router.handle(g.prefix, pattern, server.Chain(handler, g.middlewares...))
+}
+
+func (g *Group) HandleFunc(pattern string, handler server.HandlerFunc) {
+	g.Handle(pattern, handler)
+}
+
+// Group returns a nested group that inherits the prefix and middlewares of g
+func (g *Group) Group(prefix string, middlewares ...server.Middleware) *Group {
+	return &Group{
+		router:      g.router,
+		prefix:      g.prefix + strings.TrimSuffix(prefix, "/"),
+		middlewares: append(slices.Clone(g.middlewares), middlewares...),
+	}
+}
+
+// StripPrefix returns a handler that removes prefix from the request path before calling h,
+// so h sees the path relative to where it is mounted. Requests outside prefix get a 404
+func StripPrefix(prefix string, h server.Handler) server.Handler {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return server.HandlerFunc(func(w *response.Writer, req *request.Request) {
+		p, ok := strings.CutPrefix(req.URL.Path, prefix)
+		if !ok || (p != "" && !strings.HasPrefix(p, "/")) {
+			notFound(w, req)
+			return
+		}
+		u := *req.URL
+		u.Path = "/" + strings.TrimPrefix(p, "/")
+		if rp, ok := strings.CutPrefix(req.URL.RawPath, prefix); ok {
+			u.RawPath = rp
+		} else {
+			u.RawPath = ""
+		}
+		req.URL = &u
+		h.ServeHTTP(w, req)
+	})
+}
+
+func parsePattern(path string) ([]segment, error) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("path must start with /")
+	}
+	parts := strings.Split(path[1:], "/")
+	segments := make([]segment, 0, len(parts))
+	names := map[string]struct{}{}
+	for i, part := range parts {
+		if !strings.HasPrefix(part, "{") || !strings.HasSuffix(part, "}") {
+			if strings.ContainsAny(part, "{}") {
+				return nil, fmt.Errorf("a parameter must be a whole segment")
+			}
+			segments = append(segments, segment{kind: segmentLiteral, value: part})
+			continue
+		}
+
+		name := part[1 : len(part)-1]
+		kind := segmentParam
+		if strings.HasSuffix(name, "...") {
+			if i != len(parts)-1 {
+				return nil, fmt.Errorf("a wildcard must be the last segment")
+			}
+			name = strings.TrimSuffix(name, "...")
+			kind = segmentWildcard
+		}
+		if name == "" {
+			return nil, fmt.Errorf("parameter without a name")
+		}
+		if _, ok := names[name]; ok {
+			return nil, fmt.Errorf("duplicate parameter %q", name)
+		}
+		names[name] = struct{}{}
+		segments = append(segments, segment{kind: kind, value: name})
+	}
+	return segments, nil
+}
+
+// match reports whether path matches the pattern segments, returning the parameter values
+func match(segments []segment, path string) (map[string]string, bool) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, false
+	}
+	parts := strings.Split(path[1:], "/")
+	values := map[string]string{}
+	for i, seg := range segments {
+		if seg.kind == segmentWildcard {
+			values[seg.value] = unescape(strings.Join(parts[i:], "/"))
+			return values, true
+		}
+		if i >= len(parts) {
+			return nil, false
+		}
+		switch seg.kind {
+		case segmentLiteral:
+			if parts[i] != seg.value {
+				return nil, false
+			}
+		case segmentParam:
+			if parts[i] == "" {
+				return nil, false
+			}
+			values[seg.value] = unescape(parts[i])
+		}
+	}
+	return values, len(parts) == len(segments)
+}
+
+// moreSpecific reports whether a should win over b when both match the same path
+func moreSpecific(a []segment, b []segment) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i].kind != b[i].kind {
+			return a[i].kind > b[i].kind
+		}
+	}
+	// both matched the same path, so the longer one can only end in a wildcard that matched nothing
+	return len(a) < len(b)
+}
+
+// moreSpecificRoute reports whether a should win over b for a request with method,
+// the method only decides between equally specific paths
+func moreSpecificRoute(a *route, b *route, method string) bool {
+	if moreSpecific(a.segments, b.segments) {
+		return true
+	}
+	if moreSpecific(b.segments, a.segments) {
+		return false
+	}
+	return methodRank(a.method, method) > methodRank(b.method, method)
+}
+
+// methodRank tells how closely routeMethod matches method
+func methodRank(routeMethod string, method string) int {
+	switch routeMethod {
+	case method:
+		return 2
+	case "":
+		return 0
+	}
+	return 1
+}
+
+func sameShape(a []segment, b []segment) bool {
+	return slices.EqualFunc(a, b, func(x, y segment) bool {
+		if x.kind != y.kind {
+			return false
+		}
+		return x.kind != segmentLiteral || x.value == y.value
+	})
+}
+
+func methodMatches(routeMethod string, method string) bool {
+	return routeMethod == "" || routeMethod == method || (routeMethod == "GET" && method == "HEAD")
+}
+
+func unescape(s string) string {
+	if v, err := url.PathUnescape(s); err == nil {
+		return v
+	}
+	return s
+}
+
+func notFound(w *response.Writer, req *request.Request) {
+	w.Error(response.StatusNotFound, "404 page not found")
+}
+
+func methodNotAllowed(w *response.Writer, req *request.Request, allowed []string) {
+	body := []byte("405 method not allowed")
+	header := response.GetDefaultHeaders(len(body))
+	header.Set("Allow", strings.Join(allowed, ", "))
+	w.WriteRespose(405, header, body)
+}
@@ -0,0 +1,148 @@
+package router
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/nichol20/http-server/internal/request"
+	"github.com/nichol20/http-server/internal/response"
+	"github.com/nichol20/http-server/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serve runs a request through the router and returns the raw response
+func serve(t *testing.T, r *Router, method string, target string) string {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader(method + " " + target + " HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	r.ServeHTTP(w, req)
+	require.NoError(t, w.Finish())
+	return buf.String()
+}
+
+func reply(body string) server.HandlerFunc {
+	return func(w *response.Writer, req *request.Request) {
+		w.WriteRespose(200, response.GetDefaultHeaders(len(body)), []byte(body))
+	}
+}
+
+func TestPathParams(t *testing.T) {
+	r := New()
+	r.HandleFunc("GET /users/{id}", func(w *response.Writer, req *request.Request) {
+		reply("user "+req.PathValue("id"))(w, req)
+	})
+	r.HandleFunc("GET /static/{path...}", func(w *response.Writer, req *request.Request) {
+		reply("file "+req.PathValue("path"))(w, req)
+	})
+
+	assert.Contains(t, serve(t, r, "GET", "/users/42"), "user 42")
+	assert.Contains(t, serve(t, r, "GET", "/users/a%20b?x=1"), "user a b")
+	assert.Contains(t, serve(t, r, "GET", "/static/css/main.css"), "file css/main.css")
+	assert.Contains(t, serve(t, r, "GET", "/static/"), "file ")
+	assert.Contains(t, serve(t, r, "GET", "/users/"), "404 Not Found")
+	assert.Contains(t, serve(t, r, "GET", "/users/42/posts"), "404 Not Found")
+}
+
+func TestPrecedence(t *testing.T) {
+	r := New()
+	r.Handle("/{path...}", reply("catch all"))
+	r.Handle("GET /users/{id}", reply("param"))
+	r.Handle("GET /users/me", reply("literal"))
+	r.Handle("GET /users/{id}/{rest...}", reply("wildcard"))
+
+	assert.Contains(t, serve(t, r, "GET", "/users/me"), "literal")
+	assert.Contains(t, serve(t, r, "GET", "/users/7"), "param")
+	assert.Contains(t, serve(t, r, "GET", "/users/7/posts/1"), "wildcard")
+	assert.Contains(t, serve(t, r, "GET", "/other"), "catch all")
+	// the method-less catch all still matches when the specific routes don't allow the method
+	assert.Contains(t, serve(t, r, "POST", "/users/me"), "catch all")
+
+	// Test: With the same path, the pattern with a method wins whatever the registration order
+	for _, methodFirst := range []bool{true, false} {
+		r = New()
+		if methodFirst {
+			r.Handle("GET /items/{id}", reply("get"))
+			r.Handle("/items/{id}", reply("any"))
+		} else {
+			r.Handle("/items/{id}", reply("any"))
+			r.Handle("GET /items/{id}", reply("get"))
+		}
+		assert.Contains(t, serve(t, r, "GET", "/items/1"), "get", "method first: %v", methodFirst)
+		assert.Contains(t, serve(t, r, "HEAD", "/items/1"), "get", "method first: %v", methodFirst)
+		assert.Contains(t, serve(t, r, "POST", "/items/1"), "any", "method first: %v", methodFirst)
+	}
+
+	// Test: An exact method wins over GET matching HEAD
+	r = New()
+	r.Handle("GET /page", reply("get"))
+	r.Handle("HEAD /page", reply("head"))
+	assert.Contains(t, serve(t, r, "HEAD", "/page"), "head")
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	r := New()
+	r.Handle("GET /items", reply("list"))
+	r.Handle("POST /items", reply("create"))
+
+	assert.Contains(t, serve(t, r, "POST", "/items"), "create")
+	assert.Contains(t, serve(t, r, "HEAD", "/items"), "list")
+	resp := serve(t, r, "DELETE", "/items")
+	assert.Contains(t, resp, "405 Method Not Allowed")
+	assert.Contains(t, resp, "Allow: GET, HEAD, POST")
+}
+
+func TestGroup(t *testing.T) {
+	tag := func(name string) server.Middleware {
+		return func(next server.Handler) server.Handler {
+			return server.HandlerFunc(func(w *response.Writer, req *request.Request) {
+				req.SetPathValue("tags", req.PathValue("tags")+name)
+				next.ServeHTTP(w, req)
+			})
+		}
+	}
+	r := New()
+	api := r.Group("/api", tag("api,"))
+	v1 := api.Group("/v1/", tag("v1"))
+	v1.HandleFunc("GET /ping", func(w *response.Writer, req *request.Request) {
+		reply("pong "+req.PathValue("tags"))(w, req)
+	})
+
+	assert.Contains(t, serve(t, r, "GET", "/api/v1/ping"), "pong api,v1")
+	assert.Contains(t, serve(t, r, "GET", "/v1/ping"), "404 Not Found")
+}
+
+func TestInvalidPatterns(t *testing.T) {
+	r := New()
+	r.Handle("GET /users/{id}", reply(""))
+	assert.Panics(t, func() { r.Handle("GET /users/{name}", reply("")) })
+	assert.Panics(t, func() { r.Handle("/files/{path...}/edit", reply("")) })
+	assert.Panics(t, func() { r.Handle("/a/{x}/{x}", reply("")) })
+	assert.Panics(t, func() { r.Handle("users", reply("")) })
+	assert.NotPanics(t, func() { r.Handle("POST /users/{name}", reply("")) })
+}
+
+func TestStripPrefix(t *testing.T) {
+	r := New()
+	echo := server.HandlerFunc(func(w *response.Writer, req *request.Request) {
+		reply("path "+req.URL.Path+" raw "+req.URL.EscapedPath())(w, req)
+	})
+	r.Handle("GET /static/{path...}", StripPrefix("/static/", echo))
+
+	assert.Contains(t, serve(t, r, "GET", "/static/css/main.css"), "path /css/main.css raw /css/main.css")
+	assert.Contains(t, serve(t, r, "GET", "/static/a%2Fb"), "path /a/b raw /a%2Fb")
+	assert.Contains(t, serve(t, r, "GET", "/static/"), "path / raw /")
+
+	// Test: Paths that only share the beginning of a segment
+	h := StripPrefix("/static", echo)
+	req, err := request.RequestFromReader(strings.NewReader("GET /staticfile HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	h.ServeHTTP(w, req)
+	require.NoError(t, w.Finish())
+	assert.Contains(t, buf.String(), "404 Not Found")
+}
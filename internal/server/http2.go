@@ -0,0 +1,114 @@
+package server
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"time"
+
+	"github.com/nichol20/http-server/internal/http2"
+	"github.com/nichol20/http-server/internal/request"
+	"github.com/nichol20/http-server/internal/response"
+)
+
+// WithH2C sets Config.H2C
+func WithH2C() Option {
+	return func(c *Config) {
+		c.H2C = true
+	}
+}
+
+// WithoutHTTP2 sets Config.DisableHTTP2
+func WithoutHTTP2() Option {
+	return func(c *Config) {
+		c.DisableHTTP2 = true
+	}
+}
+
+// WithMaxConcurrentStreams sets Config.MaxConcurrentStreams
+func WithMaxConcurrentStreams(n uint32) Option {
+	return func(c *Config) {
+		c.MaxConcurrentStreams = n
+	}
+}
+
+// http2Server configures HTTP/2 for conn, its streams go through the same handler as HTTP/1.1 requests
+func (s *Server) http2Server(conn net.Conn) *http2.Server {
+	return &http2.Server{
+		Handler: request.HandlerFunc(func(w *response.Writer, req *request.Request) {
+			if s.serveRequest(conn, w, req) {
+				if err := w.Finish(); err != nil {
+					s.logger.Printf("error writing response to %s: %v", conn.RemoteAddr(), err)
+				}
+			}
+		}),
+		ErrorHandler:         s.cfg.ErrorHandler,
+		MaxConcurrentStreams: s.cfg.MaxConcurrentStreams,
+		Limits:               s.limits(),
+		IdleTimeout:          s.cfg.IdleTimeout,
+		WriteTimeout:         s.cfg.WriteTimeout,
+		Logger:               s.logger,
+	}
+}
+
+// serveHTTP2 serves conn as an HTTP/2 connection until it closes. Shutdown sends it a GOAWAY
+func (s *Server) serveHTTP2(conn net.Conn, opts http2.ConnOptions) {
+	opts.StateChanged = func(idle bool) {
+		state := stateActive
+		if idle {
+			state = stateIdle
+		}
+		s.setConnState(conn, state)
+	}
+	c := s.http2Server(conn).NewConn(conn, opts)
+
+	s.mu.Lock()
+	if s.closed.Load() {
+		s.mu.Unlock()
+		return
+	}
+	s.h2conns[c] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.h2conns, c)
+		s.mu.Unlock()
+	}()
+
+	// the deadlines of the HTTP/1 side don't apply anymore, the connection sets its own
+	conn.SetDeadline(time.Time{})
+	if err := c.Serve(); err != nil && !isTimeout(err) {
+		s.logger.Printf("HTTP/2 error from %s: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// h2cSettings returns the settings of a request asking to upgrade to cleartext HTTP/2
+// (RFC 7540 section 3.2). Requests with a body aren't upgraded, they are served as HTTP/1.1
+func h2cSettings(req *request.Request) ([]byte, bool) {
+	if req.ParserState != request.StateDone || req.RequestLine.HttpVersion != "1.1" ||
+		!req.Header.HasToken("upgrade", "h2c") || !req.Header.HasToken("connection", "upgrade") {
+		return nil, false
+	}
+	values := req.Header.Values("http2-settings")
+	if len(values) != 1 {
+		return nil, false
+	}
+	settings, err := base64.RawURLEncoding.DecodeString(values[0])
+	if err != nil {
+		return nil, false
+	}
+	if _, err := http2.ParseSettings(settings); err != nil {
+		return nil, false
+	}
+	return settings, true
+}
+
+// upgradeH2C switches the connection of req to HTTP/2, req is answered on stream 1
+func (s *Server) upgradeH2C(conn net.Conn, reader *request.Reader, req *request.Request, settings []byte) {
+	const switching = "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n"
+	conn.SetWriteDeadline(time.Now().Add(errorWriteTimeout))
+	if _, err := io.WriteString(conn, switching); err != nil {
+		return
+	}
+	s.serveHTTP2(conn, http2.ConnOptions{Reader: reader, Upgrade: req, Settings: settings})
+}
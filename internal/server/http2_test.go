@@ -0,0 +1,264 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nichol20/http-server/internal/http2"
+	"github.com/nichol20/http-server/internal/http2/hpack"
+	"github.com/nichol20/http-server/internal/request"
+	"github.com/nichol20/http-server/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// h2Client speaks just enough HTTP/2 to send requests and read their responses
+type h2Client struct {
+	t   *testing.T
+	fr  *http2.Framer
+	enc *hpack.Encoder
+	dec *hpack.Decoder
+}
+
+// newH2Client sends the connection preface on conn, the server's frames are read from r
+func newH2Client(t *testing.T, conn net.Conn, r io.Reader) *h2Client {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err := io.WriteString(conn, http2.ClientPreface)
+	require.NoError(t, err)
+	c := &h2Client{t: t, fr: http2.NewFramer(conn, r), enc: hpack.NewEncoder(), dec: hpack.NewDecoder(hpack.DefaultTableSize)}
+	require.NoError(t, c.fr.WriteSettings())
+	require.NoError(t, c.fr.Flush())
+	return c
+}
+
+func (c *h2Client) get(id uint32, path string) {
+	c.t.Helper()
+	block := c.enc.AppendFields(nil, []hpack.HeaderField{
+		{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "https"},
+		{Name: ":authority", Value: "localhost"}, {Name: ":path", Value: path},
+	})
+	require.NoError(c.t, c.fr.WriteHeaders(id, true, block, 16384))
+	require.NoError(c.t, c.fr.Flush())
+}
+
+// next reads frames until one that isn't about the connection itself
+func (c *h2Client) next() *http2.Frame {
+	c.t.Helper()
+	for {
+		f, err := c.fr.ReadFrame()
+		require.NoError(c.t, err)
+		switch f.Type {
+		case http2.FrameSettings:
+			if !f.Flags.Has(http2.FlagAck) {
+				require.NoError(c.t, c.fr.WriteSettingsAck())
+				require.NoError(c.t, c.fr.Flush())
+			}
+		case http2.FrameWindowUpdate, http2.FramePing:
+		default:
+			return f
+		}
+	}
+}
+
+// response reads the status and the body of stream id
+func (c *h2Client) response(id uint32) (string, string) {
+	c.t.Helper()
+	f := c.next()
+	require.Equal(c.t, http2.FrameHeaders, f.Type)
+	require.Equal(c.t, id, f.StreamID)
+	fields, err := c.dec.Decode(f.Data)
+	require.NoError(c.t, err)
+	var status string
+	for _, field := range fields {
+		if field.Name == ":status" {
+			status = field.Value
+		}
+	}
+	var body strings.Builder
+	for end := f.Flags.Has(http2.FlagEndStream); !end; {
+		f = c.next()
+		require.Equal(c.t, http2.FrameData, f.Type)
+		body.Write(f.Data)
+		end = f.Flags.Has(http2.FlagEndStream)
+	}
+	return status, body.String()
+}
+
+func TestH2CPriorKnowledge(t *testing.T) {
+	versions := make(chan string, 2)
+	s := startTestServer(t, HandlerFunc(func(w *response.Writer, req *request.Request) {
+		versions <- req.RequestLine.HttpVersion
+		textHandler(w, req)
+	}), WithH2C())
+
+	// Test: A client starting with the preface speaks HTTP/2, streams go to the same handler
+	conn, err := net.Dial("tcp", s.Addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	c := newH2Client(t, conn, conn)
+	c.get(1, "/one")
+	status, body := c.response(1)
+	assert.Equal(t, "200", status)
+	assert.Equal(t, "/one", body)
+	c.get(3, "/two")
+	_, body = c.response(3)
+	assert.Equal(t, "/two", body)
+	assert.Equal(t, "2.0", <-versions)
+
+	// Test: HTTP/1.1 still works on an h2c server
+	conn, err = net.Dial("tcp", s.Addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /plain HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	statusLine, _, body := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, "HTTP/1.1 200 OK", statusLine)
+	assert.Equal(t, "/plain", body)
+
+	// Test: Without H2C the preface is a malformed request
+	plain := startTestServer(t, HandlerFunc(textHandler))
+	conn, err = net.Dial("tcp", plain.Addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, http2.ClientPreface)
+	require.NoError(t, err)
+	statusLine, _, _ = readResponse(t, bufio.NewReader(conn))
+	assert.NotContains(t, statusLine, "200")
+}
+
+func TestH2CUpgrade(t *testing.T) {
+	s := startTestServer(t, HandlerFunc(textHandler), WithH2C())
+	conn, err := net.Dial("tcp", s.Addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Test: The upgraded request is answered on stream 1
+	settings := base64.RawURLEncoding.EncodeToString([]byte{0, 4, 0, 0, 0x40, 0})
+	_, err = conn.Write([]byte("GET /upgraded HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade, HTTP2-Settings\r\n" +
+		"Upgrade: h2c\r\nHTTP2-Settings: " + settings + "\r\n\r\n"))
+	require.NoError(t, err)
+	r := bufio.NewReader(conn)
+	statusLine, err := r.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\n", statusLine)
+	for line := ""; line != "\r\n"; {
+		line, err = r.ReadString('\n')
+		require.NoError(t, err)
+	}
+	c := newH2Client(t, conn, r)
+	status, body := c.response(1)
+	assert.Equal(t, "200", status)
+	assert.Equal(t, "/upgraded", body)
+
+	// Test: The connection goes on with new streams
+	c.get(3, "/next")
+	_, body = c.response(3)
+	assert.Equal(t, "/next", body)
+
+	// Test: A request with a body isn't upgraded
+	conn2, err := net.Dial("tcp", s.Addr)
+	require.NoError(t, err)
+	defer conn2.Close()
+	_, err = conn2.Write([]byte("POST /post HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade, HTTP2-Settings\r\n" +
+		"Upgrade: h2c\r\nHTTP2-Settings: \r\nContent-Length: 2\r\n\r\nhi"))
+	require.NoError(t, err)
+	statusLine, _, body = readResponse(t, bufio.NewReader(conn2))
+	assert.Equal(t, "HTTP/1.1 200 OK", statusLine)
+	assert.Equal(t, "/post", body)
+}
+
+func TestHTTP2OverTLS(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, t.TempDir(), "localhost", 2, x509.ExtKeyUsageServerAuth)
+	var sawTLS *tls.ConnectionState
+	s := startTestServer(t, HandlerFunc(func(w *response.Writer, req *request.Request) {
+		sawTLS = req.TLS
+		textHandler(w, req)
+	}), WithCertificate(certFile, keyFile))
+
+	// Test: ALPN picks h2 when the client offers it
+	conn, err := tls.Dial("tcp", s.Addr, &tls.Config{RootCAs: ca.pool, ServerName: "localhost", NextProtos: []string{"h2", "http/1.1"}})
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "h2", conn.ConnectionState().NegotiatedProtocol)
+	c := newH2Client(t, conn, conn)
+	c.get(1, "/secure")
+	status, body := c.response(1)
+	assert.Equal(t, "200", status)
+	assert.Equal(t, "/secure", body)
+	require.NotNil(t, sawTLS)
+	assert.Equal(t, "h2", sawTLS.NegotiatedProtocol)
+
+	// Test: Clients that only know HTTP/1.1 get it
+	_, body = getTLS(t, s, &tls.Config{RootCAs: ca.pool, ServerName: "localhost", NextProtos: []string{"http/1.1"}})
+	assert.Equal(t, "/hello", body)
+
+	// Test: HTTP/2 can be turned off
+	off := startTestServer(t, HandlerFunc(textHandler), WithCertificate(certFile, keyFile), WithoutHTTP2())
+	conn, err = tls.Dial("tcp", off.Addr, &tls.Config{RootCAs: ca.pool, ServerName: "localhost", NextProtos: []string{"h2", "http/1.1"}})
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "http/1.1", conn.ConnectionState().NegotiatedProtocol)
+}
+
+func TestHTTP2PanicRecovery(t *testing.T) {
+	s := startTestServer(t, HandlerFunc(func(w *response.Writer, req *request.Request) {
+		panic("boom")
+	}), WithH2C(), WithLogger(log.New(io.Discard, "", 0)))
+	conn, err := net.Dial("tcp", s.Addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Test: A panic answers its stream with a 500, the connection stays up
+	c := newH2Client(t, conn, conn)
+	c.get(1, "/")
+	status, _ := c.response(1)
+	assert.Equal(t, "500", status)
+	c.get(3, "/")
+	status, _ = c.response(3)
+	assert.Equal(t, "500", status)
+}
+
+func TestHTTP2Shutdown(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	cfg := Config{Addr: "127.0.0.1:0", H2C: true, Handler: HandlerFunc(func(w *response.Writer, req *request.Request) {
+		close(started)
+		<-release
+		textHandler(w, req)
+	})}
+	s, err := Start(cfg)
+	require.NoError(t, err)
+	conn, err := net.Dial("tcp", s.Addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	c := newH2Client(t, conn, conn)
+	c.get(1, "/slow")
+	<-started
+
+	// Test: Shutdown sends a GOAWAY and waits for the stream in flight
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- s.Shutdown(ctx)
+	}()
+	f := c.next()
+	require.Equal(t, http2.FrameGoAway, f.Type)
+	assert.Equal(t, uint32(1), f.LastStreamID())
+	assert.Equal(t, http2.ErrCodeNo, f.ErrCode())
+
+	close(release)
+	_, body := c.response(1)
+	assert.Equal(t, "/slow", body)
+	assert.NoError(t, <-done)
+}
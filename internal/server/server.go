@@ -1,48 +1,395 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"runtime/debug"
+	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/nichol20/http-server/internal/http2"
 	"github.com/nichol20/http-server/internal/request"
 	"github.com/nichol20/http-server/internal/response"
 )
 
+const (
+	DefaultIdleTimeout       = 60 * time.Second
+	DefaultReadHeaderTimeout = 10 * time.Second
+)
+
+// how long the server tries to deliver an error response before giving up on the client
+const errorWriteTimeout = 5 * time.Second
+
+// how much of an unread request body the server reads to keep the connection alive
+const maxDrainBytes = 256 << 10
+
+// how often Shutdown checks whether all connections are gone
+const shutdownPollInterval = 50 * time.Millisecond
+
+type connState int
+
+const (
+	// waiting for the next request
+	stateIdle connState = iota
+	// a request is being handled
+	stateActive
+)
+
 type Server struct {
 	Addr     string
 	listener *net.Listener
 	closed   *atomic.Bool
+	cfg      Config
 	handler  Handler
+	logger   *log.Logger
+
+	// certificates loaded from files, nil when the server doesn't load any
+	certs *certStore
+
+	mu         sync.Mutex
+	conns      map[net.Conn]connState
+	h2conns    map[*http2.Conn]struct{}
+	onShutdown []func()
 }
 
 type HandlerError struct {
-	StatusCode int16
+	StatusCode response.StatusCode
 	Message    string
 }
 
-type Handler func(w *response.Writer, req *request.Request)
+// Handler responds to the requests of both HTTP/1 and HTTP/2 connections
+type Handler = request.Handler
+
+// HandlerFunc adapts an ordinary function to the Handler interface
+type HandlerFunc = request.HandlerFunc
+
+// Middleware wraps a Handler to add behaviour before or after it runs
+type Middleware func(Handler) Handler
+
+// Chain wraps h with the given middlewares. The first middleware is the outermost one,
+// so it sees the request first and the response last
+func Chain(h Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// ErrorHandler renders the response for a request the server could not read.
+// err is a *request.ParseError when the request was malformed, otherwise statusCode is 408
+type ErrorHandler func(w *response.Writer, statusCode response.StatusCode, err error)
+
+type Config struct {
+	// Addr is the TCP address to listen on, like ":42069"
+	Addr    string
+	Handler Handler
+	// Middlewares are applied to Handler as if passed to Chain
+	Middlewares []Middleware
+
+	// IdleTimeout is how long a keep-alive connection may wait for the next request.
+	// Zero uses DefaultIdleTimeout and a negative value disables the timeout
+	IdleTimeout time.Duration
+	// ReadHeaderTimeout is how long a client has to send the request line and header,
+	// counting from the first byte of the request.
+	// Zero uses DefaultReadHeaderTimeout and a negative value disables the timeout
+	ReadHeaderTimeout time.Duration
+	// ReadTimeout is how long a client has to send the whole request, body included.
+	// Zero or negative means no timeout
+	ReadTimeout time.Duration
+	// WriteTimeout is how long the handler has to write the response once the request is read.
+	// Zero or negative means no timeout
+	WriteTimeout time.Duration
+
+	// MaxRequestsPerConn limits how many requests are served on a single connection
+	// before it is closed. Zero means unlimited
+	MaxRequestsPerConn int
+
+	// size limits for incoming requests, see request.Limits.
+	// Zero uses the default and a negative value disables the limit
+	MaxRequestLineBytes int
+	MaxHeaderBytes      int
+	MaxHeaderCount      int
+	MaxBodyBytes        int64
+
+	// WriteBufferSize is the size of the buffer responses are written through.
+	// Zero or negative uses response.DefaultBufferSize
+	WriteBufferSize int
+
+	// TLSConfig makes the server speak TLS, see ServeTLS. Its MinVersion is TLS 1.2 unless set.
+	// The fields below are applied on top of it
+	TLSConfig *tls.Config
+	// ClientAuth and ClientCAs ask clients for a certificate (mutual TLS), replacing the ones
+	// of TLSConfig when ClientAuth isn't tls.NoClientCert
+	ClientAuth tls.ClientAuthType
+	ClientCAs  *x509.CertPool
+	// MinTLSVersion and CipherSuites replace the ones of TLSConfig when set
+	MinTLSVersion uint16
+	CipherSuites  []uint16
+	// Certificates are loaded for TLS. The one sent is the first valid for the server name the
+	// client asks for (SNI), or the first one. They are reloaded when their files change
+	Certificates []CertificateFiles
+	// CertReloadInterval is how often the files of Certificates are checked for changes.
+	// Zero uses DefaultCertReloadInterval and a negative value disables the checks
+	CertReloadInterval time.Duration
+
+	// DisableHTTP2 keeps TLS clients on HTTP/1.1, HTTP/2 is offered through ALPN otherwise
+	DisableHTTP2 bool
+	// H2C serves cleartext HTTP/2 to clients that start with the HTTP/2 preface
+	// or ask for it with "Upgrade: h2c"
+	H2C bool
+	// MaxConcurrentStreams limits the streams an HTTP/2 client may have open at once.
+	// Zero uses http2.DefaultMaxConcurrentStreams
+	MaxConcurrentStreams uint32
+
+	// Logger receives connection errors. Defaults to log.Default()
+	Logger *log.Logger
+	// ErrorHandler writes the response when a request cannot be read.
+	// Defaults to a plain text body with the error message
+	ErrorHandler ErrorHandler
+}
+
+type Option func(*Config)
+
+// WithIdleTimeout sets Config.IdleTimeout
+func WithIdleTimeout(d time.Duration) Option {
+	return func(c *Config) {
+		c.IdleTimeout = d
+	}
+}
+
+// WithReadHeaderTimeout sets Config.ReadHeaderTimeout
+func WithReadHeaderTimeout(d time.Duration) Option {
+	return func(c *Config) {
+		c.ReadHeaderTimeout = d
+	}
+}
+
+// WithReadTimeout sets Config.ReadTimeout
+func WithReadTimeout(d time.Duration) Option {
+	return func(c *Config) {
+		c.ReadTimeout = d
+	}
+}
+
+// WithWriteTimeout sets Config.WriteTimeout
+func WithWriteTimeout(d time.Duration) Option {
+	return func(c *Config) {
+		c.WriteTimeout = d
+	}
+}
+
+// WithMaxRequestsPerConn sets Config.MaxRequestsPerConn
+func WithMaxRequestsPerConn(n int) Option {
+	return func(c *Config) {
+		c.MaxRequestsPerConn = n
+	}
+}
+
+// WithLimits sets the request size limits of the Config, see request.Limits
+func WithLimits(limits request.Limits) Option {
+	return func(c *Config) {
+		c.MaxRequestLineBytes = limits.MaxRequestLineBytes
+		c.MaxHeaderBytes = limits.MaxHeaderBytes
+		c.MaxHeaderCount = limits.MaxHeaderCount
+		c.MaxBodyBytes = limits.MaxBodyBytes
+	}
+}
+
+// WithWriteBufferSize sets Config.WriteBufferSize
+func WithWriteBufferSize(size int) Option {
+	return func(c *Config) {
+		c.WriteBufferSize = size
+	}
+}
+
+// WithMiddleware appends middlewares to Config.Middlewares
+func WithMiddleware(middlewares ...Middleware) Option {
+	return func(c *Config) {
+		c.Middlewares = append(c.Middlewares, middlewares...)
+	}
+}
+
+// WithLogger sets Config.Logger
+func WithLogger(logger *log.Logger) Option {
+	return func(c *Config) {
+		c.Logger = logger
+	}
+}
+
+// WithErrorHandler sets Config.ErrorHandler
+func WithErrorHandler(h ErrorHandler) Option {
+	return func(c *Config) {
+		c.ErrorHandler = h
+	}
+}
+
+// Serve listens on port and serves every connection with handler in the background
+func Serve(port uint16, handler Handler, opts ...Option) (*Server, error) {
+	cfg := Config{
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: handler,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return Start(cfg)
+}
+
+// Start listens on cfg.Addr and serves every connection in the background
+func Start(cfg Config) (*Server, error) {
+	if cfg.Handler == nil {
+		return nil, fmt.Errorf("server: config has no handler")
+	}
+	if cfg.IdleTimeout == 0 {
+		cfg.IdleTimeout = DefaultIdleTimeout
+	}
+	if cfg.ReadHeaderTimeout == 0 {
+		cfg.ReadHeaderTimeout = DefaultReadHeaderTimeout
+	}
+	if cfg.WriteBufferSize <= 0 {
+		cfg.WriteBufferSize = response.DefaultBufferSize
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = log.Default()
+	}
+	if cfg.ErrorHandler == nil {
+		cfg.ErrorHandler = defaultErrorHandler(cfg.Logger)
+	}
+
+	if cfg.CertReloadInterval == 0 {
+		cfg.CertReloadInterval = DefaultCertReloadInterval
+	}
+
+	var tlsConfig *tls.Config
+	var certs *certStore
+	if cfg.TLSConfig != nil || len(cfg.Certificates) > 0 {
+		var err error
+		if tlsConfig, certs, err = serverTLSConfig(cfg); err != nil {
+			return nil, err
+		}
+	}
 
-func Serve(port uint16, handler Handler) (*Server, error) {
-	addr := fmt.Sprintf(":%d", port)
-	listener, err := net.Listen("tcp", addr)
+	listener, err := net.Listen("tcp", cfg.Addr)
 	if err != nil {
 		return nil, err
 	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
 	closed := &atomic.Bool{}
 	closed.Store(false)
-	s := &Server{Addr: addr, listener: &listener, closed: closed, handler: handler}
+	s := &Server{
+		Addr:     listener.Addr().String(),
+		listener: &listener,
+		closed:   closed,
+		cfg:      cfg,
+		handler:  Chain(cfg.Handler, cfg.Middlewares...),
+		logger:   cfg.Logger,
+		conns:    map[net.Conn]connState{},
+		h2conns:  map[*http2.Conn]struct{}{},
+		certs:    certs,
+	}
 
 	go s.listen()
+	if certs != nil && cfg.CertReloadInterval > 0 {
+		go s.watchCertificates(cfg.CertReloadInterval)
+	}
 
 	return s, nil
 }
 
+// Close immediately closes the listener and every open connection,
+// including the ones in the middle of a request. See Shutdown for a graceful alternative
 func (s *Server) Close() error {
-	fmt.Println("server closed!")
-	s.closed.Store(false)
-	return (*s.listener).Close()
+	s.closed.Store(true)
+	err := (*s.listener).Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return err
+}
+
+// Shutdown stops accepting new connections, closes idle ones and waits for active
+// requests to finish. If ctx is done before that, the remaining connections are
+// force closed and the context error is returned
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.closed.Store(true)
+	err := (*s.listener).Close()
+
+	s.mu.Lock()
+	hooks := s.onShutdown
+	h2conns := make([]*http2.Conn, 0, len(s.h2conns))
+	for c := range s.h2conns {
+		h2conns = append(h2conns, c)
+	}
+	s.mu.Unlock()
+	for _, f := range hooks {
+		go f()
+	}
+	// HTTP/2 clients are told to stop opening streams, the connections close once theirs are done
+	for _, c := range h2conns {
+		c.Shutdown()
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.closeIdleConns() {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			s.mu.Lock()
+			for conn := range s.conns {
+				conn.Close()
+			}
+			s.mu.Unlock()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// RegisterOnShutdown registers a function to be called when Shutdown starts.
+// Each hook runs in its own goroutine and Shutdown does not wait for it
+func (s *Server) RegisterOnShutdown(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onShutdown = append(s.onShutdown, f)
+}
+
+// closeIdleConns closes every idle connection and reports whether no connection is left
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn, state := range s.conns {
+		if state == stateIdle {
+			conn.Close()
+			delete(s.conns, conn)
+		}
+	}
+	return len(s.conns) == 0
+}
+
+func (s *Server) setConnState(conn net.Conn, state connState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[conn] = state
+}
+
+func (s *Server) removeConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
 }
 
 func (s *Server) listen() {
@@ -52,7 +399,7 @@ func (s *Server) listen() {
 			if s.closed.Load() {
 				return
 			}
-			log.Printf("Error accepting connection: %v", err)
+			s.logger.Printf("Error accepting connection: %v", err)
 			continue
 		}
 		go s.handle(conn)
@@ -60,21 +407,198 @@ func (s *Server) listen() {
 }
 
 func (s *Server) handle(conn net.Conn) {
-	writer := response.NewWriter(conn)
-	req, err := request.RequestFromReader(conn)
-	if err != nil {
-		header := response.GetDefaultHeaders(len(err.Error()))
-		err = writer.WriteRespose(400, header, []byte(err.Error()))
+	s.setConnState(conn, stateIdle)
+	defer s.removeConn(conn)
+	defer func() {
+		if v := recover(); v != nil {
+			s.logger.Printf("panic serving %s: %v\n%s", conn.RemoteAddr(), v, debug.Stack())
+		}
+		err := conn.Close()
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			s.logger.Printf("error closing connection %s: %v", conn.RemoteAddr(), err)
+		}
+	}()
+
+	var tlsState *tls.ConnectionState
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		// the handshake is part of reading the first request
+		conn.SetDeadline(deadline(time.Now(), s.cfg.ReadHeaderTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			s.logger.Printf("TLS handshake error from %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+		conn.SetDeadline(time.Time{})
+		state := tlsConn.ConnectionState()
+		tlsState = &state
+		if state.NegotiatedProtocol == "h2" {
+			s.serveHTTP2(conn, http2.ConnOptions{TLS: tlsState})
+			return
+		}
+	}
+
+	reader := request.NewReaderWithLimits(conn, s.limits())
+	// requests are answered one after another, so pipelined responses keep the request order
+	for served := 0; !s.closed.Load(); served++ {
+		conn.SetReadDeadline(deadline(time.Now(), s.cfg.IdleTimeout))
+		// the client went away, stayed idle for too long or the server closed the
+		// connection while shutting down, there is nobody to answer
+		if err := reader.Peek(); err != nil {
+			break
+		}
+		// a client with prior knowledge of cleartext HTTP/2 starts with its preface
+		if served == 0 && tlsState == nil && s.cfg.H2C {
+			if ok, err := reader.HasPrefix([]byte(http2.ClientPreface)); err != nil {
+				break
+			} else if ok {
+				s.serveHTTP2(conn, http2.ConnOptions{Reader: reader})
+				return
+			}
+		}
+		s.setConnState(conn, stateActive)
+
+		start := time.Now()
+		headerDeadline := deadline(start, s.cfg.ReadHeaderTimeout)
+		readDeadline := deadline(start, s.cfg.ReadTimeout)
+		if headerDeadline.IsZero() || (!readDeadline.IsZero() && readDeadline.Before(headerDeadline)) {
+			headerDeadline = readDeadline
+		}
+		conn.SetReadDeadline(headerDeadline)
+		req, err := reader.ReadRequest()
 		if err != nil {
-			log.Fatal("error writing response: ", err)
+			var parseErr *request.ParseError
+			switch {
+			case errors.As(err, &parseErr):
+				s.writeError(conn, parseErr.StatusCode, err)
+			case isTimeout(err):
+				s.writeError(conn, response.StatusRequestTimeout, err)
+			}
+			// any other error means the connection itself is broken
+			break
+		}
+		req.TLS = tlsState
+		if settings, ok := h2cSettings(req); ok && tlsState == nil && s.cfg.H2C {
+			s.upgradeH2C(conn, reader, req, settings)
+			return
+		}
+		// the body is read by the handler, still bounded by ReadTimeout
+		conn.SetReadDeadline(readDeadline)
+		conn.SetWriteDeadline(deadline(time.Now(), s.cfg.WriteTimeout))
+
+		writer := response.NewWriterSize(conn, s.cfg.WriteBufferSize)
+		writer.SetVersion(req.RequestLine.HttpVersion)
+		writer.SetMethod(req.RequestLine.Method)
+		// a shutdown starting while the handler runs must not leave the client expecting more
+		writer.SetClosing(s.closed.Load)
+		lastRequest := s.cfg.MaxRequestsPerConn > 0 && served+1 >= s.cfg.MaxRequestsPerConn
+		keepAlive := req.KeepAlive() && !lastRequest && !s.closed.Load()
+
+		// the client holds the body back until it hears from us. It is told to go on only
+		// if the handler reads the body, otherwise the final response (a 417 or anything else)
+		// closes the connection, since the body may never come
+		expectContinue := req.ExpectsContinue() && req.ParserState != request.StateDone
+		writer.SetKeepAlive(keepAlive && !expectContinue)
+		if expectContinue {
+			req.OnBodyRead(func() error {
+				if writer.StatusWritten() {
+					return nil
+				}
+				writer.SetKeepAlive(keepAlive)
+				return writer.WriteInterim(100, nil)
+			})
+		}
+
+		// a handler that panicked left a response that must not be completed as if it were whole
+		if s.serveRequest(conn, writer, req) {
+			if err := writer.Finish(); err != nil {
+				s.logger.Printf("error writing response to %s: %v", conn.RemoteAddr(), err)
+			}
 		}
-		return
+		if !writer.KeepAlive() {
+			break
+		}
+		// the next request starts where this body ends. Reading a big unread body just
+		// to throw it away is not worth it, closing the connection is cheaper
+		if err := req.DiscardBody(maxDrainBytes); err != nil {
+			break
+		}
+		conn.SetWriteDeadline(time.Time{})
+		s.setConnState(conn, stateIdle)
 	}
+}
 
-	s.handler(writer, req)
+// serveRequest runs the handler, recovering from a panic so that it only affects this connection.
+// It reports whether the handler returned normally
+func (s *Server) serveRequest(conn net.Conn, w *response.Writer, req *request.Request) (ok bool) {
+	defer func() {
+		v := recover()
+		if v == nil {
+			return
+		}
+		s.logger.Printf("panic serving %s: %v\n%s", conn.RemoteAddr(), v, debug.Stack())
+		// the response may be half written, the connection can't be trusted anymore
+		w.SetKeepAlive(false)
+		if !w.StatusWritten() {
+			body := []byte("internal server error")
+			if err := w.WriteRespose(500, response.GetDefaultHeaders(len(body)), body); err != nil {
+				s.logger.Printf("error writing response to %s: %v", conn.RemoteAddr(), err)
+			}
+			// the 500 is whole, an HTTP/2 stream ends with it
+			w.Finish()
+			return
+		}
+		w.Flush()
+	}()
+	s.handler.ServeHTTP(w, req)
+	return true
+}
 
-	err = conn.Close()
-	if err != nil {
-		log.Fatal("error closing connection: ", err)
+// limits are the size limits of the requests, see request.Limits
+func (s *Server) limits() request.Limits {
+	return request.Limits{
+		MaxRequestLineBytes: s.cfg.MaxRequestLineBytes,
+		MaxHeaderBytes:      s.cfg.MaxHeaderBytes,
+		MaxHeaderCount:      s.cfg.MaxHeaderCount,
+		MaxBodyBytes:        s.cfg.MaxBodyBytes,
 	}
 }
+
+// writeError answers a request that could not be read and leaves the connection ready to be closed
+func (s *Server) writeError(conn net.Conn, statusCode response.StatusCode, err error) {
+	// a client that stopped reading must not block the goroutine either
+	conn.SetWriteDeadline(time.Now().Add(errorWriteTimeout))
+	w := response.NewWriter(conn)
+	s.cfg.ErrorHandler(w, statusCode, err)
+	if err := w.Finish(); err != nil {
+		s.logger.Printf("error writing response to %s: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// defaultErrorHandler renders a plain text page. Only the public message of a
+// request.ParseError is sent, the underlying error stays on the server
+func defaultErrorHandler(logger *log.Logger) ErrorHandler {
+	return func(w *response.Writer, statusCode response.StatusCode, err error) {
+		message := "bad request"
+		var parseErr *request.ParseError
+		if errors.As(err, &parseErr) {
+			message = parseErr.Message
+		} else if statusCode == response.StatusRequestTimeout {
+			message = "request timeout"
+		}
+		if werr := w.Error(statusCode, message); werr != nil {
+			logger.Printf("error writing error response: %v", werr)
+		}
+	}
+}
+
+// deadline returns the point in time timeout after t, or the zero time (no deadline) if timeout is not positive
+func deadline(t time.Time, timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return t.Add(timeout)
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,489 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nichol20/http-server/internal/header"
+	"github.com/nichol20/http-server/internal/request"
+	"github.com/nichol20/http-server/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startTestServer(t *testing.T, handler Handler, opts ...Option) *Server {
+	t.Helper()
+	cfg := Config{Addr: "127.0.0.1:0", Handler: handler}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	s, err := Start(cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+	return s
+}
+
+// readResponse reads a status line, the header and a content-length delimited body
+func readResponse(t *testing.T, r *bufio.Reader) (string, map[string]string, string) {
+	t.Helper()
+	statusLine, err := r.ReadString('\n')
+	require.NoError(t, err)
+	header := map[string]string{}
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimSuffix(line, "\r\n")
+		if line == "" {
+			break
+		}
+		name, value, _ := strings.Cut(line, ":")
+		header[strings.ToLower(name)] = strings.TrimSpace(value)
+	}
+	var n int
+	fmt.Sscanf(header["content-length"], "%d", &n)
+	body := make([]byte, n)
+	_, err = io.ReadFull(r, body)
+	require.NoError(t, err)
+	return strings.TrimSuffix(statusLine, "\r\n"), header, string(body)
+}
+
+func textHandler(w *response.Writer, req *request.Request) {
+	body := req.RequestLine.RequestTarget
+	w.WriteRespose(200, response.GetDefaultHeaders(len(body)), []byte(body))
+}
+
+func TestChain(t *testing.T) {
+	order := []string{}
+	mw := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(w *response.Writer, req *request.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, req)
+			})
+		}
+	}
+	h := Chain(HandlerFunc(func(w *response.Writer, req *request.Request) {
+		order = append(order, "handler")
+	}), mw("first"), mw("second"))
+	h.ServeHTTP(nil, nil)
+	assert.Equal(t, []string{"first", "second", "handler"}, order)
+}
+
+func TestKeepAliveAndPipelining(t *testing.T) {
+	s := startTestServer(t, HandlerFunc(textHandler))
+	conn, err := net.Dial("tcp", s.Addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("GET /a HTTP/1.1\r\nHost: localhost\r\n\r\nGET /b HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+
+	r := bufio.NewReader(conn)
+	status, header, body := readResponse(t, r)
+	assert.Equal(t, "HTTP/1.1 200 OK", status)
+	assert.Empty(t, header["connection"])
+	assert.Equal(t, "/a", body)
+
+	status, header, body = readResponse(t, r)
+	assert.Equal(t, "HTTP/1.1 200 OK", status)
+	assert.Equal(t, "close", header["connection"])
+	assert.Equal(t, "/b", body)
+}
+
+func TestReadHeaderTimeout(t *testing.T) {
+	s := startTestServer(t, HandlerFunc(textHandler), WithReadHeaderTimeout(50*time.Millisecond))
+	conn, err := net.Dial("tcp", s.Addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n"))
+	require.NoError(t, err)
+
+	status, _, _ := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, "HTTP/1.1 408 Request Timeout", status)
+}
+
+func TestPanicRecovery(t *testing.T) {
+	s := startTestServer(t, HandlerFunc(func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/panic" {
+			panic("boom")
+		}
+		textHandler(w, req)
+	}), WithLogger(log.New(io.Discard, "", 0)))
+
+	conn, err := net.Dial("tcp", s.Addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /panic HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	status, header, _ := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, "HTTP/1.1 500 Internal Server Error", status)
+	assert.Equal(t, "close", header["connection"])
+
+	// Test: The server keeps serving other connections
+	conn, err = net.Dial("tcp", s.Addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /ok HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	status, _, body := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, "HTTP/1.1 200 OK", status)
+	assert.Equal(t, "/ok", body)
+}
+
+func TestParseErrorResponses(t *testing.T) {
+	s := startTestServer(t, HandlerFunc(textHandler))
+	cases := map[string]string{
+		"BREW / HTTP/1.1\r\nHost: localhost\r\n\r\n": "HTTP/1.1 501 Not Implemented",
+		"GET / HTTP/2.0\r\nHost: localhost\r\n\r\n":  "HTTP/1.1 505 HTTP Version Not Supported",
+		"GET /\r\n\r\n": "HTTP/1.1 400 Bad Request",
+	}
+	for raw, want := range cases {
+		conn, err := net.Dial("tcp", s.Addr)
+		require.NoError(t, err)
+		_, err = conn.Write([]byte(raw))
+		require.NoError(t, err)
+		status, header, body := readResponse(t, bufio.NewReader(conn))
+		conn.Close()
+		assert.Equal(t, want, status)
+		assert.Equal(t, "close", header["connection"])
+		assert.NotContains(t, body, "error parsing")
+	}
+}
+
+func TestDefaultErrorHandlerLogger(t *testing.T) {
+	var logs strings.Builder
+	handler := defaultErrorHandler(log.New(&logs, "", 0))
+
+	// Test: A failed write is reported to the server's logger
+	w := response.NewWriter(io.Discard)
+	require.NoError(t, w.WriteStatusLine(200))
+	handler(w, response.StatusBadRequest, errors.New("bad"))
+	assert.Contains(t, logs.String(), "error writing error response")
+}
+
+func TestStreamingBody(t *testing.T) {
+	s := startTestServer(t, HandlerFunc(func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/echo" {
+			body, err := io.ReadAll(req.Body)
+			require.NoError(t, err)
+			w.WriteRespose(200, response.GetDefaultHeaders(len(body)), body)
+			return
+		}
+		// the body is left unread on purpose
+		textHandler(w, req)
+	}))
+	conn, err := net.Dial("tcp", s.Addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("POST /echo HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello" +
+		"POST /ignore HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nworld" +
+		"GET /next HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+
+	r := bufio.NewReader(conn)
+	_, _, body := readResponse(t, r)
+	assert.Equal(t, "hello", body)
+	_, _, body = readResponse(t, r)
+	assert.Equal(t, "/ignore", body)
+	_, _, body = readResponse(t, r)
+	assert.Equal(t, "/next", body)
+}
+
+func TestExpectContinue(t *testing.T) {
+	s := startTestServer(t, HandlerFunc(func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/reject" {
+			w.WriteRespose(417, response.GetDefaultHeaders(0), nil)
+			return
+		}
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		w.WriteRespose(200, response.GetDefaultHeaders(len(body)), body)
+	}))
+
+	// Test: 100 Continue is sent once the handler reads the body
+	conn, err := net.Dial("tcp", s.Addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n"))
+	require.NoError(t, err)
+	r := bufio.NewReader(conn)
+	status, _, _ := readResponse(t, r)
+	assert.Equal(t, "HTTP/1.1 100 Continue", status)
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	status, header, body := readResponse(t, r)
+	assert.Equal(t, "HTTP/1.1 200 OK", status)
+	assert.Empty(t, header["connection"])
+	assert.Equal(t, "hello", body)
+
+	// Test: A handler answering without reading gets no 100 Continue and the connection closes
+	conn, err = net.Dial("tcp", s.Addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("POST /reject HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n"))
+	require.NoError(t, err)
+	status, header, _ = readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, "HTTP/1.1 417 Expectation Failed", status)
+	assert.Equal(t, "close", header["connection"])
+
+	// Test: Unknown expectations are refused before the handler runs
+	conn, err = net.Dial("tcp", s.Addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\nExpect: something-else\r\n\r\n"))
+	require.NoError(t, err)
+	status, _, _ = readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, "HTTP/1.1 417 Expectation Failed", status)
+}
+
+func TestHTTP10(t *testing.T) {
+	s := startTestServer(t, HandlerFunc(textHandler))
+
+	// Test: The connection stays open only when the client asks for it
+	conn, err := net.Dial("tcp", s.Addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /a HTTP/1.0\r\nConnection: keep-alive\r\n\r\nGET /b HTTP/1.0\r\n\r\n"))
+	require.NoError(t, err)
+	r := bufio.NewReader(conn)
+	status, header, body := readResponse(t, r)
+	assert.Equal(t, "HTTP/1.0 200 OK", status)
+	assert.Equal(t, "keep-alive", header["connection"])
+	assert.Equal(t, "/a", body)
+	status, header, body = readResponse(t, r)
+	assert.Equal(t, "HTTP/1.0 200 OK", status)
+	assert.Equal(t, "close", header["connection"])
+	assert.Equal(t, "/b", body)
+	_, err = r.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestAutomaticFraming(t *testing.T) {
+	s := startTestServer(t, HandlerFunc(func(w *response.Writer, req *request.Request) {
+		h := header.NewHeader()
+		h.Set("Content-Type", "text/plain")
+		w.WriteStatusLine(200)
+		w.WriteHeader(h)
+		w.WriteBody([]byte(req.RequestLine.RequestTarget))
+	}))
+
+	// Test: Responses without framing fields keep the connection usable, HEAD ones have no body
+	conn, err := net.Dial("tcp", s.Addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("HEAD /head HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+		"GET /get HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	r := bufio.NewReader(conn)
+	status, err := r.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", status)
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		if line == "\r\n" {
+			break
+		}
+		if strings.HasPrefix(line, "Content-Length") {
+			assert.Equal(t, "Content-Length: 5\r\n", line)
+		}
+	}
+	status, header, body := readResponse(t, r)
+	assert.Equal(t, "HTTP/1.1 200 OK", status)
+	assert.Equal(t, "4", header["content-length"])
+	assert.NotEmpty(t, header["date"])
+	assert.Equal(t, response.DefaultServerName, header["server"])
+	assert.Empty(t, header["connection"])
+	assert.Equal(t, "/get", body)
+}
+
+// assertClosed checks that the server closes conn without sending anything more
+func assertClosed(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(make([]byte, 1))
+	assert.Zero(t, n)
+	require.Error(t, err)
+	var netErr net.Error
+	assert.False(t, errors.As(err, &netErr) && netErr.Timeout(), "connection still open")
+}
+
+// blockingHandler answers /slow once release is closed, telling started when it got the request
+func blockingHandler(started chan<- struct{}, release <-chan struct{}) Handler {
+	return HandlerFunc(func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/slow" {
+			started <- struct{}{}
+			<-release
+		}
+		textHandler(w, req)
+	})
+}
+
+func TestShutdown(t *testing.T) {
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	s, err := Start(Config{Addr: "127.0.0.1:0", Handler: blockingHandler(started, release)})
+	require.NoError(t, err)
+	hook := make(chan struct{})
+	s.RegisterOnShutdown(func() { close(hook) })
+
+	idle, err := net.Dial("tcp", s.Addr)
+	require.NoError(t, err)
+	defer idle.Close()
+	_, err = idle.Write([]byte("GET /fast HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	_, _, body := readResponse(t, bufio.NewReader(idle))
+	assert.Equal(t, "/fast", body)
+
+	active, err := net.Dial("tcp", s.Addr)
+	require.NoError(t, err)
+	defer active.Close()
+	_, err = active.Write([]byte("GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	<-started
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- s.Shutdown(ctx)
+	}()
+
+	// Test: The hooks run and idle connections are closed right away
+	<-hook
+	assertClosed(t, idle)
+	_, err = net.Dial("tcp", s.Addr)
+	assert.Error(t, err)
+
+	// Test: Shutdown waits for the request in flight, which is answered whole
+	select {
+	case <-done:
+		t.Fatal("Shutdown returned with a request in flight")
+	case <-time.After(2 * shutdownPollInterval):
+	}
+	close(release)
+	r := bufio.NewReader(active)
+	status, header, body := readResponse(t, r)
+	assert.Equal(t, "HTTP/1.1 200 OK", status)
+	assert.Equal(t, "/slow", body)
+	// the client must not pipeline more on a connection about to close
+	assert.Equal(t, "close", header["connection"])
+	assert.NoError(t, <-done)
+	assertClosed(t, active)
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	defer close(release)
+	s, err := Start(Config{Addr: "127.0.0.1:0", Handler: blockingHandler(started, release)})
+	require.NoError(t, err)
+	conn, err := net.Dial("tcp", s.Addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	<-started
+
+	// Test: A request still running when the context ends is cut off
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, s.Shutdown(ctx), context.DeadlineExceeded)
+	assertClosed(t, conn)
+}
+
+func TestClose(t *testing.T) {
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	defer close(release)
+	s, err := Start(Config{Addr: "127.0.0.1:0", Handler: blockingHandler(started, release)})
+	require.NoError(t, err)
+	conn, err := net.Dial("tcp", s.Addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	<-started
+
+	// Test: Close doesn't wait for requests in flight
+	assert.NoError(t, s.Close())
+	assertClosed(t, conn)
+	_, err = net.Dial("tcp", s.Addr)
+	assert.Error(t, err)
+}
+
+func TestConnectionTimeouts(t *testing.T) {
+	// Test: An idle keep-alive connection is closed after IdleTimeout
+	s := startTestServer(t, HandlerFunc(textHandler), WithIdleTimeout(50*time.Millisecond))
+	conn, err := net.Dial("tcp", s.Addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /a HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	_, header, _ := readResponse(t, bufio.NewReader(conn))
+	assert.Empty(t, header["connection"])
+	assertClosed(t, conn)
+
+	// Test: ReadTimeout covers the header too, a client that stops sending it gets a 408
+	s = startTestServer(t, HandlerFunc(textHandler), WithReadHeaderTimeout(-1), WithReadTimeout(50*time.Millisecond))
+	conn, err = net.Dial("tcp", s.Addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: local"))
+	require.NoError(t, err)
+	status, _, _ := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, "HTTP/1.1 408 Request Timeout", status)
+
+	// Test: A client that stops sending its body is disconnected
+	conn, err = net.Dial("tcp", s.Addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Length: 10\r\n\r\nab"))
+	require.NoError(t, err)
+	_, _, body := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, "/upload", body)
+	assertClosed(t, conn)
+
+	// Test: A response written after WriteTimeout never reaches the client
+	s = startTestServer(t, HandlerFunc(func(w *response.Writer, req *request.Request) {
+		time.Sleep(100 * time.Millisecond)
+		textHandler(w, req)
+	}), WithWriteTimeout(50*time.Millisecond), WithLogger(log.New(io.Discard, "", 0)))
+	conn, err = net.Dial("tcp", s.Addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /late HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	assertClosed(t, conn)
+}
+
+func TestMaxRequestsPerConn(t *testing.T) {
+	s := startTestServer(t, HandlerFunc(textHandler), WithMaxRequestsPerConn(2))
+	conn, err := net.Dial("tcp", s.Addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /1 HTTP/1.1\r\nHost: localhost\r\n\r\nGET /2 HTTP/1.1\r\nHost: localhost\r\n\r\nGET /3 HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	r := bufio.NewReader(conn)
+
+	// Test: The last request allowed is answered with Connection: close, the next one never is
+	_, header, body := readResponse(t, r)
+	assert.Equal(t, "/1", body)
+	assert.Empty(t, header["connection"])
+	_, header, body = readResponse(t, r)
+	assert.Equal(t, "/2", body)
+	assert.Equal(t, "close", header["connection"])
+	_, err = r.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
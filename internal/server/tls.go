@@ -0,0 +1,223 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultCertReloadInterval is how often certificate files are checked for changes
+const DefaultCertReloadInterval = time.Minute
+
+var ErrNoCertificateFiles = errors.New("server: no certificate files to reload")
+
+// CertificateFiles is a PEM encoded certificate chain and its private key
+type CertificateFiles struct {
+	CertFile string
+	KeyFile  string
+}
+
+// WithTLSConfig sets Config.TLSConfig. The other TLS options apply on top of it,
+// whichever order they come in
+func WithTLSConfig(tlsConfig *tls.Config) Option {
+	return func(c *Config) {
+		c.TLSConfig = tlsConfig.Clone()
+	}
+}
+
+// WithCertificate adds a certificate to Config.Certificates
+func WithCertificate(certFile string, keyFile string) Option {
+	return func(c *Config) {
+		c.Certificates = append(c.Certificates, CertificateFiles{CertFile: certFile, KeyFile: keyFile})
+	}
+}
+
+// WithCertReloadInterval sets Config.CertReloadInterval
+func WithCertReloadInterval(d time.Duration) Option {
+	return func(c *Config) {
+		c.CertReloadInterval = d
+	}
+}
+
+// WithClientAuth asks clients for a certificate (mutual TLS), verified against the CAs in pool.
+// Handlers find the certificate the client sent in Request.TLS
+func WithClientAuth(auth tls.ClientAuthType, pool *x509.CertPool) Option {
+	return func(c *Config) {
+		c.ClientAuth = auth
+		c.ClientCAs = pool
+	}
+}
+
+// WithMinTLSVersion sets the oldest TLS version accepted, like tls.VersionTLS13. It is TLS 1.2 by default
+func WithMinTLSVersion(version uint16) Option {
+	return func(c *Config) {
+		c.MinTLSVersion = version
+	}
+}
+
+// WithCipherSuites restricts the cipher suites of TLS 1.2 and older, TLS 1.3 ones can't be chosen
+func WithCipherSuites(ids ...uint16) Option {
+	return func(c *Config) {
+		c.CipherSuites = ids
+	}
+}
+
+// ServeTLS is Serve over TLS, with the certificate chain and key in certFile and keyFile.
+// They may be empty when the certificates come from options, like WithCertificate for more
+// domains or WithTLSConfig
+func ServeTLS(port uint16, handler Handler, certFile string, keyFile string, opts ...Option) (*Server, error) {
+	cfg := Config{
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: handler,
+	}
+	if certFile != "" || keyFile != "" {
+		cfg.Certificates = []CertificateFiles{{CertFile: certFile, KeyFile: keyFile}}
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.TLSConfig == nil {
+		cfg.TLSConfig = &tls.Config{}
+	}
+	return Start(cfg)
+}
+
+// serverTLSConfig completes the TLS configuration of cfg, loading the certificate files
+func serverTLSConfig(cfg Config) (*tls.Config, *certStore, error) {
+	tlsConfig := cfg.TLSConfig.Clone()
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	if cfg.ClientAuth != tls.NoClientCert {
+		tlsConfig.ClientAuth = cfg.ClientAuth
+		tlsConfig.ClientCAs = cfg.ClientCAs
+	}
+	if cfg.MinTLSVersion != 0 {
+		tlsConfig.MinVersion = cfg.MinTLSVersion
+	}
+	if cfg.CipherSuites != nil {
+		tlsConfig.CipherSuites = cfg.CipherSuites
+	}
+	if tlsConfig.MinVersion == 0 {
+		tlsConfig.MinVersion = tls.VersionTLS12
+	}
+	if len(tlsConfig.NextProtos) == 0 {
+		tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+		if cfg.DisableHTTP2 {
+			tlsConfig.NextProtos = []string{"http/1.1"}
+		}
+	}
+
+	var certs *certStore
+	if len(cfg.Certificates) > 0 {
+		certs = &certStore{files: cfg.Certificates}
+		if err := certs.load(); err != nil {
+			return nil, nil, err
+		}
+		tlsConfig.GetCertificate = certs.getCertificate
+	}
+	if len(tlsConfig.Certificates) == 0 && tlsConfig.GetCertificate == nil && tlsConfig.GetConfigForClient == nil {
+		return nil, nil, fmt.Errorf("server: TLS needs a certificate")
+	}
+	return tlsConfig, certs, nil
+}
+
+// certStore holds the certificates loaded from files. A reload swaps them all at once,
+// handshakes in progress keep the ones they started with and open connections are untouched
+type certStore struct {
+	files []CertificateFiles
+	certs atomic.Pointer[[]*tls.Certificate]
+
+	mu sync.Mutex
+	// modification times of the files, in the order of files, as of the last load
+	modTimes []time.Time
+}
+
+// load reads every certificate again. When one of them fails, the ones in use are kept
+// and the files are only tried again once they change
+func (c *certStore) load() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.modTimes = c.stat()
+	certs := make([]*tls.Certificate, 0, len(c.files))
+	for _, f := range c.files {
+		cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+		if err != nil {
+			return fmt.Errorf("server: loading certificate %s: %w", f.CertFile, err)
+		}
+		certs = append(certs, &cert)
+	}
+	c.certs.Store(&certs)
+	return nil
+}
+
+// changed reports whether a file was modified since the last load
+func (c *certStore) changed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	modTimes := c.stat()
+	for i := range modTimes {
+		if !modTimes[i].Equal(c.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *certStore) stat() []time.Time {
+	modTimes := make([]time.Time, 0, 2*len(c.files))
+	for _, f := range c.files {
+		for _, name := range []string{f.CertFile, f.KeyFile} {
+			var modTime time.Time
+			if info, err := os.Stat(name); err == nil {
+				modTime = info.ModTime()
+			}
+			modTimes = append(modTimes, modTime)
+		}
+	}
+	return modTimes
+}
+
+// getCertificate picks the first certificate valid for the server name the client asked for (SNI),
+// or the first one when none is, the client decides what to do with it
+func (c *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certs := *c.certs.Load()
+	for _, cert := range certs {
+		if hello.SupportsCertificate(cert) == nil {
+			return cert, nil
+		}
+	}
+	return certs[0], nil
+}
+
+// ReloadCertificates reads the certificate files again, like after they were renewed.
+// New connections use the new certificates, open ones are not affected. When a file
+// can't be loaded the current certificates are kept and the error is returned
+func (s *Server) ReloadCertificates() error {
+	if s.certs == nil {
+		return ErrNoCertificateFiles
+	}
+	return s.certs.load()
+}
+
+// watchCertificates reloads the certificates whenever their files change, until the server is closed
+func (s *Server) watchCertificates(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if s.closed.Load() {
+			return
+		}
+		if !s.certs.changed() {
+			continue
+		}
+		if err := s.certs.load(); err != nil {
+			s.logger.Printf("Error reloading certificates: %v", err)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nichol20/http-server/internal/request"
+	"github.com/nichol20/http-server/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCA issues certificates for the tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue writes a certificate for name and its key to dir, returning their paths
+func (ca *testCA) issue(t *testing.T, dir string, name string, serial int64, usage x509.ExtKeyUsage) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile, keyFile
+}
+
+// clientCert loads a certificate issued by issue for a client
+func clientCert(t *testing.T, certFile string, keyFile string) tls.Certificate {
+	t.Helper()
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	require.NoError(t, err)
+	return cert
+}
+
+// getTLS sends a GET over a new TLS connection and returns the certificate the server sent
+// along with the response
+func getTLS(t *testing.T, s *Server, cfg *tls.Config) (*x509.Certificate, string) {
+	t.Helper()
+	conn, err := tls.Dial("tcp", s.Addr, cfg)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /hello HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	statusLine, _, body := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, "HTTP/1.1 200 OK", statusLine)
+	return conn.ConnectionState().PeerCertificates[0], body
+}
+
+func TestServeTLS(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certFile, keyFile := ca.issue(t, dir, "localhost", 2, x509.ExtKeyUsageServerAuth)
+
+	var sawTLS *tls.ConnectionState
+	handler := HandlerFunc(func(w *response.Writer, req *request.Request) {
+		sawTLS = req.TLS
+		textHandler(w, req)
+	})
+	s := startTestServer(t, handler, WithCertificate(certFile, keyFile))
+
+	// Test: A request over TLS, the handler sees the connection
+	cert, body := getTLS(t, s, &tls.Config{RootCAs: ca.pool, ServerName: "localhost"})
+	assert.Equal(t, "localhost", cert.Subject.CommonName)
+	assert.Equal(t, "/hello", body)
+	require.NotNil(t, sawTLS)
+	assert.Equal(t, "localhost", sawTLS.ServerName)
+	assert.Empty(t, sawTLS.PeerCertificates)
+
+	// Test: TLS 1.1 is below the default minimum
+	_, err := tls.Dial("tcp", s.Addr, &tls.Config{RootCAs: ca.pool, ServerName: "localhost", MaxVersion: tls.VersionTLS11})
+	assert.Error(t, err)
+
+	// Test: TLS needs a certificate
+	_, err = Start(Config{Addr: "127.0.0.1:0", Handler: handler, TLSConfig: &tls.Config{}})
+	assert.Error(t, err)
+	_, err = Start(Config{Addr: "127.0.0.1:0", Handler: handler, Certificates: []CertificateFiles{{CertFile: "missing.crt", KeyFile: "missing.key"}}})
+	assert.Error(t, err)
+
+	// Test: A plain server has no certificates to reload
+	plain := startTestServer(t, handler)
+	assert.ErrorIs(t, plain.ReloadCertificates(), ErrNoCertificateFiles)
+}
+
+func TestSNI(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	aCert, aKey := ca.issue(t, dir, "a.test", 2, x509.ExtKeyUsageServerAuth)
+	bCert, bKey := ca.issue(t, dir, "b.test", 3, x509.ExtKeyUsageServerAuth)
+	s := startTestServer(t, HandlerFunc(textHandler), WithCertificate(aCert, aKey), WithCertificate(bCert, bKey))
+
+	// Test: Each domain gets its own certificate
+	for _, name := range []string{"a.test", "b.test"} {
+		cert, _ := getTLS(t, s, &tls.Config{RootCAs: ca.pool, ServerName: name})
+		assert.Equal(t, []string{name}, cert.DNSNames)
+	}
+
+	// Test: An unknown name gets the first one
+	cert, _ := getTLS(t, s, &tls.Config{ServerName: "c.test", InsecureSkipVerify: true})
+	assert.Equal(t, []string{"a.test"}, cert.DNSNames)
+}
+
+func TestReloadCertificates(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certFile, keyFile := ca.issue(t, dir, "localhost", 2, x509.ExtKeyUsageServerAuth)
+	s := startTestServer(t, HandlerFunc(textHandler), WithCertificate(certFile, keyFile), WithCertReloadInterval(-1))
+	client := &tls.Config{RootCAs: ca.pool, ServerName: "localhost"}
+
+	// a connection made before the reload
+	open, err := tls.Dial("tcp", s.Addr, client)
+	require.NoError(t, err)
+	defer open.Close()
+
+	// Test: Reloading picks up renewed files
+	ca.issue(t, dir, "localhost", 3, x509.ExtKeyUsageServerAuth)
+	require.NoError(t, s.ReloadCertificates())
+	cert, _ := getTLS(t, s, client)
+	assert.Equal(t, int64(3), cert.SerialNumber.Int64())
+
+	// Test: Connections made before keep working
+	_, err = open.Write([]byte("GET /still-here HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	statusLine, _, body := readResponse(t, bufio.NewReader(open))
+	assert.Equal(t, "HTTP/1.1 200 OK", statusLine)
+	assert.Equal(t, "/still-here", body)
+	assert.Equal(t, int64(2), open.ConnectionState().PeerCertificates[0].SerialNumber.Int64())
+
+	// Test: A broken file keeps the certificates in use
+	require.NoError(t, os.WriteFile(keyFile, []byte("garbage"), 0o600))
+	assert.Error(t, s.ReloadCertificates())
+	cert, _ = getTLS(t, s, client)
+	assert.Equal(t, int64(3), cert.SerialNumber.Int64())
+}
+
+func TestWatchCertificates(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certFile, keyFile := ca.issue(t, dir, "localhost", 2, x509.ExtKeyUsageServerAuth)
+	s := startTestServer(t, HandlerFunc(textHandler), WithCertificate(certFile, keyFile), WithCertReloadInterval(10*time.Millisecond))
+	client := &tls.Config{RootCAs: ca.pool, ServerName: "localhost"}
+
+	// Test: Changed files are reloaded without being asked
+	ca.issue(t, dir, "localhost", 3, x509.ExtKeyUsageServerAuth)
+	// the file system may not tell writes apart within its timestamp resolution
+	later := time.Now().Add(time.Second)
+	require.NoError(t, os.Chtimes(certFile, later, later))
+	assert.Eventually(t, func() bool {
+		cert, _ := getTLS(t, s, client)
+		return cert.SerialNumber.Int64() == 3
+	}, 2*time.Second, 20*time.Millisecond)
+}
+
+func TestClientAuth(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certFile, keyFile := ca.issue(t, dir, "localhost", 2, x509.ExtKeyUsageServerAuth)
+	clientFile, clientKey := ca.issue(t, dir, "alice", 3, x509.ExtKeyUsageClientAuth)
+
+	var peer string
+	handler := HandlerFunc(func(w *response.Writer, req *request.Request) {
+		peer = req.TLS.PeerCertificates[0].Subject.CommonName
+		textHandler(w, req)
+	})
+	s := startTestServer(t, handler, WithCertificate(certFile, keyFile), WithClientAuth(tls.RequireAndVerifyClientCert, ca.pool))
+
+	// Test: The client certificate is verified and shown to the handler
+	client := &tls.Config{RootCAs: ca.pool, ServerName: "localhost", Certificates: []tls.Certificate{clientCert(t, clientFile, clientKey)}}
+	getTLS(t, s, client)
+	assert.Equal(t, "alice", peer)
+
+	// Test: Without one the handshake fails. With TLS 1.3 the client only learns it when reading
+	conn, err := tls.Dial("tcp", s.Addr, &tls.Config{RootCAs: ca.pool, ServerName: "localhost"})
+	if err == nil {
+		defer conn.Close()
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		if err == nil {
+			_, err = bufio.NewReader(conn).ReadString('\n')
+		}
+	}
+	assert.Error(t, err)
+}
+
+func TestTLSVersionAndCiphers(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certFile, keyFile := ca.issue(t, dir, "localhost", 2, x509.ExtKeyUsageServerAuth)
+
+	// Test: Clients older than the minimum version are refused
+	s := startTestServer(t, HandlerFunc(textHandler), WithCertificate(certFile, keyFile), WithMinTLSVersion(tls.VersionTLS13))
+	_, err := tls.Dial("tcp", s.Addr, &tls.Config{RootCAs: ca.pool, ServerName: "localhost", MaxVersion: tls.VersionTLS12})
+	assert.Error(t, err)
+	getTLS(t, s, &tls.Config{RootCAs: ca.pool, ServerName: "localhost"})
+
+	// Test: Only the configured cipher suites are negotiated
+	suite := tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256
+	s = startTestServer(t, HandlerFunc(textHandler), WithCertificate(certFile, keyFile), WithCipherSuites(suite))
+	conn, err := tls.Dial("tcp", s.Addr, &tls.Config{RootCAs: ca.pool, ServerName: "localhost", MaxVersion: tls.VersionTLS12})
+	require.NoError(t, err)
+	assert.Equal(t, suite, conn.ConnectionState().CipherSuite)
+	conn.Close()
+	_, err = tls.Dial("tcp", s.Addr, &tls.Config{
+		RootCAs: ca.pool, ServerName: "localhost", MaxVersion: tls.VersionTLS12,
+		CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	})
+	assert.Error(t, err)
+}
+
+func TestTLSOptionOrder(t *testing.T) {
+	ca := newTestCA(t)
+	base := &tls.Config{Certificates: []tls.Certificate{{}}, MinVersion: tls.VersionTLS12}
+	opts := []Option{WithClientAuth(tls.RequireAndVerifyClientCert, ca.pool), WithMinTLSVersion(tls.VersionTLS13), WithCipherSuites(tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256)}
+
+	// Test: A base config given after the other options doesn't drop them
+	for _, order := range [][]Option{append([]Option{WithTLSConfig(base)}, opts...), append(opts, WithTLSConfig(base))} {
+		var cfg Config
+		for _, opt := range order {
+			opt(&cfg)
+		}
+		tlsConfig, _, err := serverTLSConfig(cfg)
+		require.NoError(t, err)
+		assert.Equal(t, tls.RequireAndVerifyClientCert, tlsConfig.ClientAuth)
+		assert.Same(t, ca.pool, tlsConfig.ClientCAs)
+		assert.Equal(t, uint16(tls.VersionTLS13), tlsConfig.MinVersion)
+		assert.Equal(t, []uint16{tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256}, tlsConfig.CipherSuites)
+	}
+	// the caller's config is left as it was
+	assert.Equal(t, tls.NoClientCert, base.ClientAuth)
+}